@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/gatewayd-io/gatewayd-plugin-sql-ids-ips/plugin"
+)
+
+// runEvaluate measures the accuracy of the detectors on labeled datasets,
+// with the same environment variables as the plugin, and prints the report.
+// It returns the exit code.
+func runEvaluate(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("evaluate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "",
+		"Format of the dataset: jsonl or csv (default: by file extension)")
+	output := flags.String("output", "text", "Format of the report: text or json")
+	step := flags.Float64("sweep-step", plugin.DefaultSweepStep,
+		"Step of the threshold sweep per detector, zero disables the sweep")
+	configFile := flags.String("config-file", "",
+		"Config file that overrides the settings, like CONFIG_FILE")
+	logLevel := flags.String("log-level", "error", "Log level")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: gatewayd-plugin-sql-ids-ips evaluate [flags] [file ...]")
+		fmt.Fprintln(stderr, "Reads the dataset from stdin if no file is given.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "Invalid output: %s\n", *output)
+		return 2
+	}
+	if *step < 0 || *step > 1 {
+		fmt.Fprintf(stderr, "Invalid sweep step: %v\n", *step)
+		return 2
+	}
+
+	evaluated, err := newOfflinePlugin(newLogger(*logLevel, stderr), *configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer evaluated.Close()
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	evaluation := plugin.NewEvaluation()
+	for _, file := range files {
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = plugin.DatasetFormatOf(file)
+		}
+
+		err := readFile(file, stdin, func(reader io.Reader) error {
+			return plugin.ReadLabeledQueries(reader, fileFormat, func(query plugin.LabeledQuery) error {
+				evaluation.Add(context.Background(), evaluated, query)
+				return nil
+			})
+		})
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to evaluate %s: %s\n", file, err)
+			return 1
+		}
+	}
+
+	report := evaluation.Report(*step)
+	if *output == "json" {
+		err = json.NewEncoder(stdout).Encode(report)
+	} else {
+		err = report.Write(stdout)
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
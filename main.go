@@ -1,10 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
-	"time"
 
 	sdkConfig "github.com/gatewayd-io/gatewayd-plugin-sdk/config"
 	"github.com/gatewayd-io/gatewayd-plugin-sdk/logging"
@@ -19,6 +19,16 @@ import (
 )
 
 func main() {
+	// The subcommands run the detectors outside of GatewayD.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scan":
+			os.Exit(runScan(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		case "evaluate":
+			os.Exit(runEvaluate(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
+	}
+
 	sentryDSN := sdkConfig.GetEnv("SENTRY_DSN", "")
 	// Initialize Sentry SDK
 	err := sentry.Init(sentry.ClientOptions{
@@ -41,30 +51,88 @@ func main() {
 	})
 
 	pluginInstance := plugin.NewInjectionDetectionPlugin(plugin.Plugin{
-		Logger: logger,
+		Logger:      logger,
+		Connections: plugin.NewConnectionTracker(),
 	})
 
-	var metricsConfig *metrics.MetricsConfig
-	if cfg := cast.ToStringMap(plugin.PluginConfig["config"]); cfg != nil {
-		metricsConfig = metrics.NewMetricsConfig(cfg)
-		if metricsConfig != nil && metricsConfig.Enabled {
-			go metrics.ExposeMetrics(metricsConfig, logger)
+	config, err := plugin.LoadConfig(cast.ToStringMap(plugin.PluginConfig["config"]))
+	if err != nil {
+		logger.Error("Invalid plugin config", "error", err)
+		os.Exit(1)
+	}
+
+	if config.MetricsEnabled {
+		go metrics.ExposeMetrics(&metrics.MetricsConfig{
+			Enabled:          config.MetricsEnabled,
+			UnixDomainSocket: config.MetricsUnixDomainSocket,
+			Endpoint:         config.MetricsEndpoint,
+		}, logger)
+	}
+
+	config.Apply(&pluginInstance.Impl)
+
+	if config.AllowlistMode != plugin.AllowlistOff {
+		allowlist, err := plugin.NewAllowlist(
+			config.AllowlistMode, config.AllowlistFile, config.LearningPeriod)
+		if err != nil {
+			logger.Error("Failed to load allowlist", "error", err)
+		} else {
+			pluginInstance.Impl.Allowlist = allowlist
+			go allowlist.SavePeriodically(plugin.AllowlistSaveInterval, func(err error) {
+				logger.Error("Failed to save allowlist", "error", err)
+			})
 		}
+	}
 
-		pluginInstance.Impl.Threshold = cast.ToFloat32(cfg["threshold"])
-		pluginInstance.Impl.EnableLibinjection = cast.ToBool(cfg["enableLibinjection"])
-		pluginInstance.Impl.LibinjectionPermissiveMode = cast.ToBool(
-			cfg["libinjectionPermissiveMode"])
-		pluginInstance.Impl.PredictionAPIAddress = cast.ToString(cfg["predictionAPIAddress"])
-
-		pluginInstance.Impl.ResponseType = cast.ToString(cfg["responseType"])
-		pluginInstance.Impl.ErrorMessage = cast.ToString(cfg["errorMessage"])
-		pluginInstance.Impl.ErrorSeverity = cast.ToString(cfg["errorSeverity"])
-		pluginInstance.Impl.ErrorNumber = cast.ToString(cfg["errorNumber"])
-		pluginInstance.Impl.ErrorDetail = cast.ToString(cfg["errorDetail"])
-		pluginInstance.Impl.LogLevel = cast.ToString(cfg["logLevel"])
-		pluginInstance.Impl.PredictionTimeout = time.Duration(
-			cast.ToInt(cfg["predictionTimeout"])) * time.Second
+	if config.PolicyFile != "" {
+		policies, err := plugin.LoadPolicies(config.PolicyFile)
+		if err != nil {
+			logger.Error("Failed to load policies", "error", err)
+		} else {
+			pluginInstance.Impl.Policies = policies
+		}
+	}
+
+	if config.BanScore > 0 {
+		offenders := plugin.NewOffenderTracker(
+			config.BanScope, config.BanScore, config.RiskScoreHalfLife, config.BanDuration)
+		pluginInstance.Impl.Offenders = offenders
+		go offenders.ExpirePeriodically(plugin.BanExpireInterval, func(ban plugin.Ban) {
+			logger.Info("Client unbanned", "offender", ban.Offender)
+		})
+	}
+
+	// The config file is watched until the plugin shuts down.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	if config.ConfigFile != "" {
+		configFile, err := plugin.NewConfigFile(config.ConfigFile)
+		if err != nil {
+			logger.Error("Failed to load config file", "error", err)
+		}
+		pluginInstance.Impl.ConfigFile = configFile
+
+		if config.ConfigReloadInterval > 0 {
+			go configFile.Watch(ctx, config.ConfigReloadInterval, func(err error) {
+				if err != nil {
+					logger.Error("Failed to reload config file, keeping the previous config",
+						"error", err)
+					return
+				}
+				logger.Info("Config file reloaded", "path", config.ConfigFile)
+			})
+		}
+	}
+
+	if config.AdminEnabled {
+		pluginInstance.Impl.ModeSwitch = &plugin.ModeSwitch{}
+		pluginInstance.Impl.RecentDetections = plugin.NewDetectionLog(config.RecentDetectionsSize)
+		go plugin.ExposeAdmin(
+			config.AdminUnixDomainSocket,
+			plugin.NewAdminServer(&pluginInstance.Impl),
+			logger,
+		)
 	}
 
 	goplugin.Serve(&goplugin.ServeConfig{
@@ -79,4 +147,8 @@ func main() {
 		GRPCServer: p.DefaultGRPCServer,
 		Logger:     logger,
 	})
+
+	if err := pluginInstance.Impl.Close(); err != nil {
+		logger.Error("Failed to close the prediction backend", "error", err)
+	}
 }
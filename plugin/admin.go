@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// ModeSwitch holds the mode of the plugin after it is switched at runtime,
+// e.g. via the admin API.
+type ModeSwitch struct {
+	mode atomic.Pointer[string]
+}
+
+// Get returns the switched mode, or an empty string if it was never switched.
+func (s *ModeSwitch) Get() string {
+	if s == nil {
+		return ""
+	}
+	if mode := s.mode.Load(); mode != nil {
+		return *mode
+	}
+	return ""
+}
+
+func (s *ModeSwitch) Set(mode string) {
+	s.mode.Store(&mode)
+}
+
+// mode returns the current mode of the plugin.
+func (p *Plugin) mode() string {
+	if mode := p.ModeSwitch.Get(); mode != "" {
+		return mode
+	}
+	return p.Mode
+}
+
+// AdminServer serves the local admin API, which is used to operate the plugin
+// without restarting GatewayD.
+type AdminServer struct {
+	plugin *Plugin
+	mux    *http.ServeMux
+}
+
+// NewAdminServer returns the admin API of the plugin. The mode of the plugin
+// can only be switched if the plugin has a ModeSwitch.
+func NewAdminServer(p *Plugin) *AdminServer {
+	server := &AdminServer{plugin: p, mux: http.NewServeMux()}
+	server.mux.HandleFunc("GET /detections", server.getDetections)
+	server.mux.HandleFunc("GET /allowlist", server.getAllowlist)
+	server.mux.HandleFunc("POST /allowlist", server.addToAllowlist)
+	server.mux.HandleFunc("DELETE /allowlist/{fingerprint}", server.removeFromAllowlist)
+	server.mux.HandleFunc("GET /bans", server.getBans)
+	server.mux.HandleFunc("POST /bans", server.ban)
+	server.mux.HandleFunc("DELETE /bans/{offender}", server.unban)
+	server.mux.HandleFunc("GET /mode", server.getMode)
+	server.mux.HandleFunc("PUT /mode", server.setMode)
+	server.mux.HandleFunc("GET /config", server.getConfig)
+	return server
+}
+
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *AdminServer) getDetections(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.plugin.RecentDetections.Recent())
+}
+
+func (s *AdminServer) getAllowlist(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"mode":         s.plugin.Allowlist.Mode(),
+		"fingerprints": s.plugin.Allowlist.Entries(),
+	})
+}
+
+func (s *AdminServer) addToAllowlist(w http.ResponseWriter, r *http.Request) {
+	if s.plugin.Allowlist == nil {
+		writeError(w, http.StatusConflict, errors.New("allowlist is disabled"))
+		return
+	}
+
+	var body struct {
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Query == "" {
+		writeError(w, http.StatusBadRequest, errors.New("query is required"))
+		return
+	}
+	if err := s.plugin.Allowlist.Add(body.Query); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.plugin.Logger.Info("Query added to the allowlist via the admin API")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *AdminServer) removeFromAllowlist(w http.ResponseWriter, r *http.Request) {
+	if s.plugin.Allowlist == nil {
+		writeError(w, http.StatusConflict, errors.New("allowlist is disabled"))
+		return
+	}
+
+	if !s.plugin.Allowlist.Remove(r.PathValue("fingerprint")) {
+		writeError(w, http.StatusNotFound, errors.New("fingerprint is not allowlisted"))
+		return
+	}
+	s.plugin.Logger.Info("Fingerprint removed from the allowlist via the admin API",
+		"fingerprint", r.PathValue("fingerprint"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) getBans(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.plugin.Offenders.Bans())
+}
+
+func (s *AdminServer) ban(w http.ResponseWriter, r *http.Request) {
+	if s.plugin.Offenders == nil {
+		writeError(w, http.StatusConflict, errors.New("bans are disabled"))
+		return
+	}
+
+	var body struct {
+		Offender string `json:"offender"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	offender, err := parseOffender(body.Offender)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ban := s.plugin.Offenders.Ban(offender)
+	s.plugin.Logger.Warn("Client banned via the admin API",
+		OffenderField, ban.Offender, BannedUntilField, ban.Until)
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func (s *AdminServer) unban(w http.ResponseWriter, r *http.Request) {
+	if s.plugin.Offenders == nil {
+		writeError(w, http.StatusConflict, errors.New("bans are disabled"))
+		return
+	}
+
+	offender, err := parseOffender(r.PathValue("offender"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !s.plugin.Offenders.Unban(offender) {
+		writeError(w, http.StatusNotFound, errors.New("offender is not banned"))
+		return
+	}
+	s.plugin.Logger.Info("Client unbanned via the admin API", OffenderField, offender)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) getMode(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{ModeField: s.plugin.current().mode()})
+}
+
+func (s *AdminServer) setMode(w http.ResponseWriter, r *http.Request) {
+	if s.plugin.ModeSwitch == nil {
+		writeError(w, http.StatusConflict, errors.New("mode cannot be switched"))
+		return
+	}
+
+	var body struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Mode != PreventMode && body.Mode != DetectOnlyMode {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid mode: %s", body.Mode))
+		return
+	}
+
+	s.plugin.ModeSwitch.Set(body.Mode)
+	s.plugin.Logger.Warn("Mode switched via the admin API", ModeField, body.Mode)
+	writeJSON(w, http.StatusOK, map[string]string{ModeField: body.Mode})
+}
+
+func (s *AdminServer) getConfig(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.plugin.current().effectiveConfig())
+}
+
+// effectiveConfig returns the current settings of the plugin, keyed like the
+// plugin config.
+func (p *Plugin) effectiveConfig() map[string]any {
+	policies := []string{}
+	for _, policy := range p.Policies {
+		policies = append(policies, policy.Name)
+	}
+
+	return map[string]any{
+		"protocol":                   p.Protocol,
+		"mode":                       p.mode(),
+		"predictionAPIAddress":       p.PredictionAPIAddress,
+		"predictionTimeout":          p.PredictionTimeout.Seconds(),
+		"predictionBatchSize":        p.Batcher.MaxSize(),
+		"threshold":                  p.Threshold,
+		"enableLibinjection":         p.EnableLibinjection,
+		"libinjectionPermissiveMode": p.LibinjectionPermissiveMode,
+		"normalizeQueries":           p.NormalizeQueries,
+		"blockStackedQueries":        p.BlockStackedQueries,
+		"onPredictionFailure":        p.OnPredictionFailure,
+		"circuitBreakerState":        p.Breaker.State().String(),
+		"detectors":                  p.Detectors,
+		"detectorCombination":        p.DetectorCombination,
+		"denylistAction":             p.DenylistAction,
+		"denylistExemptUsers":        p.DenylistExemptUsers,
+		"latencyAnalysis":            p.Latency != nil,
+		"latencyTrackedQueries":      p.Latency.Len(),
+		"verdictCacheEntries":        p.Cache.Len(),
+		"allowlistMode":              p.Allowlist.Mode(),
+		"allowlistEntries":           p.Allowlist.Len(),
+		"staticAllowlistEntries":     p.StaticAllowlist.Len(),
+		"policies":                   policies,
+		"activeBans":                 len(p.Offenders.Bans()),
+		"terminateBannedConnections": p.TerminateBannedConnections,
+		"responseType":               p.ResponseType,
+		"errorMessage":               p.ErrorMessage,
+		"errorSeverity":              p.ErrorSeverity,
+		"errorNumber":                p.ErrorNumber,
+		"errorDetail":                p.ErrorDetail,
+		"mysqlErrorCode":             p.MySQLErrorCode,
+		"abortTransactionOnBlock":    p.AbortTransactionOnBlock,
+		"logLevel":                   p.LogLevel,
+		"trackedConnections":         p.Connections.Len(),
+		"recentDetections":           len(p.RecentDetections.Recent()),
+	}
+}
+
+// parseOffender validates an offender of a ban, i.e. client:<ip> or user:<name>.
+func parseOffender(offender string) (string, error) {
+	scope, value, _ := strings.Cut(offender, ":")
+	switch {
+	case scope == BanScopeClient:
+		if addr, ok := clientIP(value); ok {
+			return BanScopeClient + ":" + addr.String(), nil
+		}
+	case scope == BanScopeUser && value != "":
+		return offender, nil
+	}
+	return "", fmt.Errorf("invalid offender, expected client:<ip> or user:<name>: %s", offender)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{ErrorField: err.Error()})
+}
+
+// ExposeAdmin serves the admin API via HTTP over a Unix domain socket, which
+// is only accessible to the user running GatewayD.
+func ExposeAdmin(unixDomainSocket string, handler http.Handler, logger hclog.Logger) {
+	logger.Info("Starting admin server via HTTP over Unix domain socket",
+		"unixDomainSocket", unixDomainSocket)
+
+	listener, err := listenAdmin(unixDomainSocket)
+	if err != nil {
+		logger.Error("Failed to start admin server", ErrorField, err)
+		return
+	}
+	defer os.Remove(unixDomainSocket)
+
+	if err := http.Serve(listener, handler); err != nil {
+		logger.Error("Failed to serve admin server", ErrorField, err)
+	}
+}
+
+// listenAdmin listens on the Unix domain socket, replacing a stale socket.
+// The socket is created in a new directory that only the user can access,
+// and moved to its path once its access is restricted to the user, so that
+// no other user can connect to it in the meantime.
+func listenAdmin(unixDomainSocket string) (net.Listener, error) {
+	if file, err := os.Stat(unixDomainSocket); err == nil && file.Mode().Type() != os.ModeSocket {
+		return nil, fmt.Errorf("%s exists and is not a socket", unixDomainSocket)
+	}
+
+	// The directory is created with the permissions 0700.
+	dir, err := os.MkdirTemp(filepath.Dir(unixDomainSocket), ".admin-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from its final path instead.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(socket, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict access to the socket: %w", err)
+	}
+	if err := os.Rename(socket, unixDomainSocket); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to move the socket: %w", err)
+	}
+	return listener, nil
+}
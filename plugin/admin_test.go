@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAdminPlugin(t *testing.T) *Plugin {
+	t.Helper()
+
+	allowlist, err := NewAllowlist(AllowlistEnforce, "", 0)
+	require.NoError(t, err)
+	return &Plugin{
+		Logger:           hclog.NewNullLogger(),
+		Mode:             PreventMode,
+		Allowlist:        allowlist,
+		Offenders:        NewOffenderTracker([]string{BanScopeClient}, 5, time.Minute, time.Hour),
+		ModeSwitch:       &ModeSwitch{},
+		RecentDetections: NewDetectionLog(2),
+	}
+}
+
+func serveAdmin(t *testing.T, p *Plugin, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	NewAdminServer(p).ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func Test_DetectionLog(t *testing.T) {
+	log := NewDetectionLog(2)
+	assert.Empty(t, log.Recent())
+
+	log.Add(map[string]any{QueryField: "first"})
+	log.Add(map[string]any{QueryField: "second"})
+	log.Add(map[string]any{QueryField: "third"})
+
+	records := log.Recent()
+	require.Len(t, records, 2)
+	assert.Equal(t, "third", records[0].Fields[QueryField])
+	assert.Equal(t, "second", records[1].Fields[QueryField])
+}
+
+func Test_AdminServerDetections(t *testing.T) {
+	p := newAdminPlugin(t)
+	p.RecentDetections.Add(map[string]any{QueryField: "SELECT 1 OR 1=1"})
+
+	resp := serveAdmin(t, p, http.MethodGet, "/detections", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var records []DetectionRecord
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&records))
+	require.Len(t, records, 1)
+	assert.Equal(t, "SELECT 1 OR 1=1", records[0].Fields[QueryField])
+}
+
+func Test_AdminServerAllowlist(t *testing.T) {
+	p := newAdminPlugin(t)
+
+	resp := serveAdmin(t, p, http.MethodPost, "/allowlist", `{"query": "SELECT * FROM users WHERE id = 1"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	assert.True(t, p.Allowlist.Allowed("SELECT * FROM users WHERE id = 2"))
+
+	resp = serveAdmin(t, p, http.MethodGet, "/allowlist", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var body struct {
+		Mode         string            `json:"mode"`
+		Fingerprints map[string]string `json:"fingerprints"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, AllowlistEnforce, body.Mode)
+	require.Len(t, body.Fingerprints, 1)
+
+	for fingerprint := range body.Fingerprints {
+		resp = serveAdmin(t, p, http.MethodDelete, "/allowlist/"+fingerprint, "")
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+		resp = serveAdmin(t, p, http.MethodDelete, "/allowlist/"+fingerprint, "")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	}
+	assert.False(t, p.Allowlist.Allowed("SELECT * FROM users WHERE id = 2"))
+
+	resp = serveAdmin(t, p, http.MethodPost, "/allowlist", `{}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func Test_AdminServerBans(t *testing.T) {
+	p := newAdminPlugin(t)
+
+	resp := serveAdmin(t, p, http.MethodPost, "/bans", `{"offender": "client:10.0.0.1"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+	_, banned := p.Offenders.Banned(Session{ClientAddress: "10.0.0.1:5432"})
+	assert.True(t, banned)
+
+	resp = serveAdmin(t, p, http.MethodGet, "/bans", "")
+	var bans []Ban
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&bans))
+	require.Len(t, bans, 1)
+	assert.Equal(t, "client:10.0.0.1", bans[0].Offender)
+
+	resp = serveAdmin(t, p, http.MethodDelete, "/bans/client:10.0.0.1", "")
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	_, banned = p.Offenders.Banned(Session{ClientAddress: "10.0.0.1:5432"})
+	assert.False(t, banned)
+
+	resp = serveAdmin(t, p, http.MethodPost, "/bans", `{"offender": "client:nowhere"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	p.Offenders = nil
+	resp = serveAdmin(t, p, http.MethodPost, "/bans", `{"offender": "user:alice"}`)
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func Test_AdminServerMode(t *testing.T) {
+	p := newAdminPlugin(t)
+
+	resp := serveAdmin(t, p, http.MethodPut, "/mode", `{"mode": "detect-only"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, DetectOnlyMode, p.mode())
+	assert.Equal(t, PreventMode, p.Mode)
+
+	resp = serveAdmin(t, p, http.MethodGet, "/config", "")
+	assert.Equal(t, http.StatusOK, resp.Code)
+	var config map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+	assert.Equal(t, DetectOnlyMode, config["mode"])
+
+	resp = serveAdmin(t, p, http.MethodPut, "/mode", `{"mode": "panic"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func Test_listenAdmin(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "admin.sock")
+
+	// A stale socket is replaced.
+	stale, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenAdmin(socket)
+	require.NoError(t, err)
+	defer listener.Close()
+	server := NewAdminServer(newAdminPlugin(t))
+	go func() { _ = http.Serve(listener, server) }()
+
+	file, err := os.Stat(socket)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket, file.Mode().Type())
+	assert.Equal(t, os.FileMode(0o600), file.Mode().Perm())
+	// The directory of the socket is removed once the socket is moved.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://admin/mode")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A file that is not a socket is not replaced.
+	other := filepath.Join(dir, "other")
+	require.NoError(t, os.WriteFile(other, nil, 0o600))
+	_, err = listenAdmin(other)
+	require.Error(t, err)
+}
@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+// Allowlist holds the fingerprints of known good queries. The fingerprint of
+// a query ignores literals, comments and formatting, so a query is known by
+// its structure. In learning mode, the fingerprints of the queries that the
+// detectors find clean are added to the allowlist, and in enforce mode, the
+// allowlisted queries skip the detectors.
+type Allowlist struct {
+	mu           sync.RWMutex
+	mode         string
+	learnUntil   time.Time
+	path         string
+	fingerprints map[string]string
+	dirty        bool
+	now          func() time.Time
+}
+
+// allowlistFile is the format of the persistent allowlist file, which maps
+// the fingerprints to an example of the query with the literals stripped.
+type allowlistFile struct {
+	Fingerprints map[string]string `json:"fingerprints"`
+}
+
+// NewAllowlist returns a new Allowlist in the given mode, loading the known
+// fingerprints from the file, if it exists. In learning mode, the allowlist
+// switches to enforce mode after the learning period, unless it is zero.
+func NewAllowlist(mode, path string, learningPeriod time.Duration) (*Allowlist, error) {
+	allowlist := &Allowlist{
+		mode:         mode,
+		path:         path,
+		fingerprints: map[string]string{},
+		now:          time.Now,
+	}
+	if mode == AllowlistLearn && learningPeriod > 0 {
+		allowlist.learnUntil = allowlist.now().Add(learningPeriod)
+	}
+
+	if path == "" {
+		return allowlist, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return allowlist, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read allowlist: %w", err)
+	}
+
+	var file allowlistFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse allowlist: %w", err)
+	}
+	for fingerprint, query := range file.Fingerprints {
+		allowlist.fingerprints[fingerprint] = query
+	}
+
+	return allowlist, nil
+}
+
+// Mode returns the current mode of the allowlist. The mode is read under the
+// read lock, and the write lock is only taken to switch to enforcing once the
+// learning period has expired.
+func (a *Allowlist) Mode() string {
+	if a == nil {
+		return AllowlistOff
+	}
+
+	a.mu.RLock()
+	mode, expired := a.mode, a.learningExpired()
+	a.mu.RUnlock()
+	if !expired {
+		return mode
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// The mode may have been switched since the read lock was released.
+	if a.learningExpired() {
+		a.mode = AllowlistEnforce
+	}
+	return a.mode
+}
+
+// learningExpired returns true if the allowlist learns and its learning
+// period has expired. The lock must be held.
+func (a *Allowlist) learningExpired() bool {
+	return a.mode == AllowlistLearn && !a.learnUntil.IsZero() && a.now().After(a.learnUntil)
+}
+
+// Allowed returns true if the query is allowlisted and should not be inspected.
+// In learning mode, nothing is allowlisted, so that every query is inspected.
+// Queries that cannot be parsed are never allowlisted.
+func (a *Allowlist) Allowed(query string) bool {
+	if a.Mode() != AllowlistEnforce {
+		return false
+	}
+
+	fingerprint, err := pgQuery.Fingerprint(query)
+	if err != nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	_, ok := a.fingerprints[fingerprint]
+	return ok
+}
+
+// Learn adds the fingerprint of the query to the allowlist in learning mode.
+// It must only be called once the detectors have found the query clean, so
+// that probes sent while learning are never allowlisted.
+func (a *Allowlist) Learn(query string) {
+	if a.Mode() != AllowlistLearn {
+		return
+	}
+
+	fingerprint, err := pgQuery.Fingerprint(query)
+	if err != nil {
+		return
+	}
+	a.add(fingerprint, query)
+}
+
+// Add adds the fingerprint of the query to the allowlist.
+func (a *Allowlist) Add(query string) error {
+	fingerprint, err := pgQuery.Fingerprint(query)
+	if err != nil {
+		return fmt.Errorf("failed to fingerprint query: %w", err)
+	}
+	a.add(fingerprint, query)
+	return nil
+}
+
+func (a *Allowlist) add(fingerprint, query string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.fingerprints[fingerprint]; ok {
+		return
+	}
+
+	// Only the normalized query is stored, so that no sensitive
+	// literals end up in the allowlist file.
+	normalized, err := pgQuery.Normalize(query)
+	if err != nil {
+		normalized = ""
+	}
+	a.fingerprints[fingerprint] = normalized
+	a.dirty = true
+}
+
+// Remove removes the fingerprint from the allowlist and returns false if it
+// was not allowlisted.
+func (a *Allowlist) Remove(fingerprint string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.fingerprints[fingerprint]; !ok {
+		return false
+	}
+	delete(a.fingerprints, fingerprint)
+	a.dirty = true
+	return true
+}
+
+// Entries returns a copy of the allowlist, which maps the fingerprints to the
+// normalized queries.
+func (a *Allowlist) Entries() map[string]string {
+	if a == nil {
+		return map[string]string{}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return maps.Clone(a.fingerprints)
+}
+
+// Len returns the number of fingerprints in the allowlist.
+func (a *Allowlist) Len() int {
+	if a == nil {
+		return 0
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.fingerprints)
+}
+
+// Save writes the allowlist to the file if it has changed since it was
+// last saved. The file is replaced atomically.
+func (a *Allowlist) Save() error {
+	if a == nil || a.path == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(allowlistFile{Fingerprints: a.fingerprints}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal allowlist: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create allowlist: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write allowlist: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write allowlist: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return fmt.Errorf("failed to replace allowlist: %w", err)
+	}
+
+	a.dirty = false
+	return nil
+}
+
+// SavePeriodically saves the allowlist at the given interval, so that the
+// learned fingerprints are not written to disk on every single query.
+func (a *Allowlist) SavePeriodically(interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := a.Save(); err != nil {
+			onError(err)
+		}
+	}
+}
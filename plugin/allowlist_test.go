@@ -0,0 +1,87 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AllowlistLearnAndEnforce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist.json")
+
+	allowlist, err := NewAllowlist(AllowlistLearn, path, 0)
+	require.NoError(t, err)
+
+	// Queries are still inspected while learning, and only learned once they
+	// are found clean.
+	assert.False(t, allowlist.Allowed("SELECT * FROM pg_catalog.pg_tables WHERE schemaname = 'public'"))
+	assert.Equal(t, 0, allowlist.Len())
+	allowlist.Learn("SELECT * FROM pg_catalog.pg_tables WHERE schemaname = 'public'")
+	// Unparsable queries are never learned.
+	allowlist.Learn("' OR 1=1")
+	assert.Equal(t, 1, allowlist.Len())
+	require.NoError(t, allowlist.Save())
+
+	allowlist, err = NewAllowlist(AllowlistEnforce, path, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, allowlist.Len())
+
+	// Literals, comments and formatting don't change the fingerprint.
+	assert.True(t, allowlist.Allowed(
+		"select * from pg_catalog.pg_tables /* admin */ where schemaname = 'private'"))
+	assert.False(t, allowlist.Allowed(
+		"SELECT * FROM pg_catalog.pg_tables WHERE schemaname = 'public' OR 1=1"))
+}
+
+func Test_AllowlistLearningPeriod(t *testing.T) {
+	allowlist, err := NewAllowlist(AllowlistLearn, "", time.Hour)
+	require.NoError(t, err)
+	now := time.Now()
+	allowlist.now = func() time.Time { return now }
+
+	assert.Equal(t, AllowlistLearn, allowlist.Mode())
+	assert.False(t, allowlist.Allowed("SELECT name FROM products WHERE id = 42"))
+	allowlist.Learn("SELECT name FROM products WHERE id = 42")
+
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, AllowlistEnforce, allowlist.Mode())
+	assert.True(t, allowlist.Allowed("SELECT name FROM products WHERE id = 7"))
+}
+
+func Test_AllowlistDisabled(t *testing.T) {
+	var allowlist *Allowlist
+	assert.Equal(t, AllowlistOff, allowlist.Mode())
+	assert.False(t, allowlist.Allowed("SELECT 1"))
+	allowlist.Learn("SELECT 1")
+	assert.Equal(t, 0, allowlist.Len())
+}
+
+func Test_InspectLearnsCleanQueries(t *testing.T) {
+	allowlist, err := NewAllowlist(AllowlistLearn, "", 0)
+	require.NoError(t, err)
+	p := &Plugin{Logger: hclog.NewNullLogger(), Allowlist: allowlist}
+	pipeline := &Pipeline{
+		Detectors: []Detector{&prefixDetector{prefix: "DELETE"}},
+		Logger:    hclog.NewNullLogger(),
+	}
+
+	// Detected queries and bound parameters are never learned.
+	result := p.inspect(context.Background(), pipeline, &clientQuery{source: QuerySource, text: "DELETE FROM users"})
+	assert.True(t, result.Detected)
+	p.inspect(context.Background(), pipeline, &clientQuery{source: BindSource, text: "SELECT 1"})
+	assert.Equal(t, 0, allowlist.Len())
+
+	p.inspect(context.Background(), pipeline, &clientQuery{source: QuerySource, text: "SELECT * FROM users"})
+	assert.Equal(t, 1, allowlist.Len())
+
+	// Nor are the queries that a detector failed to inspect.
+	pipeline.Detectors = []Detector{&stubDetector{name: "failing", err: errors.New("failed")}}
+	p.inspect(context.Background(), pipeline, &clientQuery{source: QuerySource, text: "SELECT * FROM orders"})
+	assert.Equal(t, 1, allowlist.Len())
+}
@@ -0,0 +1,293 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/carlmjohnson/requests"
+)
+
+// PredictionBackend sends the queries to the model server and returns the
+// confidences of the model that the queries are injections, in the order of
+// the queries. Backends must be safe for concurrent use.
+type PredictionBackend interface {
+	Predict(ctx context.Context, queries []string) ([]float32, error)
+}
+
+// ErrMalformedResponse is returned if the response of the prediction API has
+// no valid score for every query, which is a prediction failure.
+var ErrMalformedResponse = errors.New("malformed prediction API response")
+
+// NewPredictionBackend returns the backend of the config. The model, input and
+// output names are only used by the KServe v2 backends, and the response
+// schema by the HTTP backend.
+func NewPredictionBackend(c *Config) PredictionBackend {
+	switch c.PredictionBackend {
+	case PredictionBackendKServe:
+		return &KServeRESTBackend{
+			Address: c.PredictionAPIAddress,
+			Model:   c.PredictionModelName,
+			Input:   c.PredictionModelInput,
+			Output:  c.PredictionModelOutput,
+		}
+	case PredictionBackendGRPC:
+		return &KServeGRPCBackend{
+			Address: c.PredictionAPIAddress,
+			Model:   c.PredictionModelName,
+			Input:   c.PredictionModelInput,
+			Output:  c.PredictionModelOutput,
+		}
+	default:
+		return &HTTPBackend{
+			Address: c.PredictionAPIAddress,
+			Schema: ResponseSchema{
+				ScorePath:      c.PredictionScorePath,
+				BatchScorePath: c.PredictionBatchScorePath,
+				LabelPath:      c.PredictionLabelPath,
+				BatchLabelPath: c.PredictionBatchLabelPath,
+				InjectionLabel: c.PredictionInjectionLabel,
+			},
+		}
+	}
+}
+
+// ResponseSchema locates the scores in the responses of the JSON API. The
+// score paths default to "confidence" and "confidences" of the predict and
+// batch endpoints. If a label path is set, the score is the confidence of the
+// label, and the confidence of an injection is one minus the score if the
+// label is not the injection label.
+type ResponseSchema struct {
+	ScorePath      JSONPath
+	BatchScorePath JSONPath
+	LabelPath      JSONPath
+	BatchLabelPath JSONPath
+	InjectionLabel string
+}
+
+// HTTPBackend sends the queries to the JSON API of the prediction API. A single
+// query is sent to the predict endpoint, and more queries to the batch endpoint.
+type HTTPBackend struct {
+	Address string
+	Schema  ResponseSchema
+}
+
+var _ PredictionBackend = (*HTTPBackend)(nil)
+
+func (b *HTTPBackend) Predict(ctx context.Context, queries []string) ([]float32, error) {
+	path := PredictPath
+	body := map[string]any{QueryField: queries[0]}
+	scorePath, labelPath := b.Schema.ScorePath, b.Schema.LabelPath
+	if scorePath == nil {
+		scorePath = JSONPath{{key: ConfidenceField}}
+	}
+	if len(queries) != 1 {
+		path = PredictBatchPath
+		body = map[string]any{QueriesField: queries}
+		scorePath, labelPath = b.Schema.BatchScorePath, b.Schema.BatchLabelPath
+		if scorePath == nil {
+			scorePath = JSONPath{{key: ConfidencesField}}
+		}
+	}
+
+	var output bytes.Buffer
+	err := requests.
+		URL(b.Address).
+		Path(path).
+		BodyJSON(body).
+		ToBytesBuffer(&output).
+		Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make POST request to prediction API: %w", err)
+	}
+
+	var response any
+	if err := json.Unmarshal(output.Bytes(), &response); err != nil {
+		return nil, malformedResponse(err)
+	}
+	return b.Schema.scores(response, scorePath, labelPath)
+}
+
+// scores returns the scores of the response, as the confidences of injections.
+func (s ResponseSchema) scores(response any, scorePath, labelPath JSONPath) ([]float32, error) {
+	value, err := scorePath.Resolve(response)
+	if err != nil {
+		return nil, malformedResponse(err)
+	}
+	scores, err := flattenScores(value, nil)
+	if err != nil {
+		return nil, malformedResponse(fmt.Errorf("%s: %w", scorePath, err))
+	}
+	if labelPath == nil {
+		return scores, nil
+	}
+
+	if value, err = labelPath.Resolve(response); err != nil {
+		return nil, malformedResponse(err)
+	}
+	labels, err := flattenLabels(value, nil)
+	if err != nil {
+		return nil, malformedResponse(fmt.Errorf("%s: %w", labelPath, err))
+	}
+	if len(labels) != len(scores) {
+		return nil, malformedResponse(fmt.Errorf("got %d labels for %d scores", len(labels), len(scores)))
+	}
+	for idx, label := range labels {
+		if !strings.EqualFold(label, s.InjectionLabel) {
+			scores[idx] = 1 - scores[idx]
+		}
+	}
+	return scores, nil
+}
+
+// KServeRESTBackend sends the queries to the model as a BYTES input tensor of
+// shape [n, 1], using the REST API of the KServe v2 inference protocol.
+type KServeRESTBackend struct {
+	Address string
+	Model   string
+	Input   string
+	Output  string
+}
+
+var _ PredictionBackend = (*KServeRESTBackend)(nil)
+
+// kserveTensor is an input or output tensor of the KServe v2 REST API.
+type kserveTensor struct {
+	Name     string  `json:"name"`
+	Shape    []int64 `json:"shape"`
+	Datatype string  `json:"datatype"`
+	Data     any     `json:"data"`
+}
+
+func (b *KServeRESTBackend) Predict(ctx context.Context, queries []string) ([]float32, error) {
+	request := map[string]any{
+		"inputs": []kserveTensor{{
+			Name:     b.Input,
+			Shape:    []int64{int64(len(queries)), 1},
+			Datatype: "BYTES",
+			Data:     queries,
+		}},
+	}
+	if b.Output != "" {
+		request["outputs"] = []map[string]any{{"name": b.Output}}
+	}
+
+	var response struct {
+		Outputs []kserveTensor `json:"outputs"`
+	}
+	err := requests.
+		URL(b.Address).
+		Pathf("/v2/models/%s/infer", b.Model).
+		BodyJSON(request).
+		ToJSON(&response).
+		Fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make POST request to inference API: %w", err)
+	}
+
+	outputs := make([]inferOutput, 0, len(response.Outputs))
+	for _, tensor := range response.Outputs {
+		data, err := flattenScores(tensor.Data, nil)
+		if err != nil {
+			return nil, malformedResponse(fmt.Errorf("output %s: %w", tensor.Name, err))
+		}
+		outputs = append(outputs, inferOutput{Name: tensor.Name, Scores: data})
+	}
+	scores, err := selectOutput(outputs, b.Output)
+	if err != nil {
+		return nil, malformedResponse(err)
+	}
+	return scores, nil
+}
+
+// flattenScores appends the numbers of the data in row-major order, as some
+// servers return the scores or the data of multi-dimensional outputs as nested
+// arrays.
+func flattenScores(data any, scores []float32) ([]float32, error) {
+	switch data := data.(type) {
+	case float64:
+		return append(scores, float32(data)), nil
+	case []any:
+		for _, item := range data {
+			var err error
+			if scores, err = flattenScores(item, scores); err != nil {
+				return nil, err
+			}
+		}
+		return scores, nil
+	default:
+		return nil, fmt.Errorf("score must be a number: %v", data)
+	}
+}
+
+// flattenLabels appends the labels of the data, which are strings, booleans or
+// numbers, in row-major order.
+func flattenLabels(data any, labels []string) ([]string, error) {
+	switch data := data.(type) {
+	case string:
+		return append(labels, data), nil
+	case bool:
+		return append(labels, strconv.FormatBool(data)), nil
+	case float64:
+		return append(labels, strconv.FormatFloat(data, 'f', -1, 64)), nil
+	case []any:
+		for _, item := range data {
+			var err error
+			if labels, err = flattenLabels(item, labels); err != nil {
+				return nil, err
+			}
+		}
+		return labels, nil
+	default:
+		return nil, fmt.Errorf("label must be a string, boolean or number: %v", data)
+	}
+}
+
+// checkScores checks that the backend returned a score for every query, and
+// that the scores are numbers.
+func checkScores(scores []float32, queries int) error {
+	if len(scores) != queries {
+		return malformedResponse(fmt.Errorf("got %d scores for %d queries", len(scores), queries))
+	}
+	for _, score := range scores {
+		if math.IsNaN(float64(score)) || math.IsInf(float64(score), 0) {
+			return malformedResponse(fmt.Errorf("score must be a finite number: %v", score))
+		}
+	}
+	return nil
+}
+
+// malformedResponse counts the malformed response and wraps the error with
+// ErrMalformedResponse.
+func malformedResponse(err error) error {
+	MalformedPredictionResponses.Inc()
+	return fmt.Errorf("%w: %w", ErrMalformedResponse, err)
+}
+
+// inferOutput is an output tensor of the KServe v2 inference protocol.
+type inferOutput struct {
+	Name   string
+	Scores []float32
+}
+
+// selectOutput returns the scores of the output with the given name, or of the
+// first output if the name is empty.
+func selectOutput(outputs []inferOutput, name string) ([]float32, error) {
+	if len(outputs) == 0 {
+		return nil, errors.New("inference API returned no outputs")
+	}
+	if name == "" {
+		return outputs[0].Scores, nil
+	}
+	for _, output := range outputs {
+		if output.Name == name {
+			return output.Scores, nil
+		}
+	}
+	return nil, fmt.Errorf("inference API returned no %s output", name)
+}
@@ -0,0 +1,278 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func Test_HTTPBackend(t *testing.T) {
+	var requests atomic.Int32
+	server := newBatchServer(t, &requests)
+	backend := &HTTPBackend{Address: server.URL}
+
+	confidences, err := backend.Predict(context.Background(), []string{"SELECT 1 OR 1=1"})
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.99}, confidences)
+
+	confidences, err = backend.Predict(context.Background(), []string{"SELECT 1", "SELECT 1 OR 1=1"})
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.01, 0.99}, confidences)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func Test_HTTPBackendSchema(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(body))
+		assert.NoError(t, err)
+	}))
+	defer server.Close()
+
+	path := func(path string) JSONPath {
+		parsed, err := ParseJSONPath(path)
+		require.NoError(t, err)
+		return parsed
+	}
+	backend := &HTTPBackend{Address: server.URL, Schema: ResponseSchema{
+		ScorePath:      path("outputs"),
+		BatchScorePath: path("[*].score"),
+		BatchLabelPath: path("[*].label"),
+		InjectionLabel: "SQLi",
+	}}
+
+	// The nested array of the score is flattened.
+	body = `{"outputs": [[0.99]]}`
+	confidences, err := backend.Predict(context.Background(), []string{"SELECT 1 OR 1=1"})
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.99}, confidences)
+
+	// The score of another label is the confidence that the query is benign.
+	body = `[{"label": "sqli", "score": 0.9}, {"label": "benign", "score": 0.75}]`
+	confidences, err = backend.Predict(context.Background(), []string{"SELECT 1 OR 1=1", "SELECT 1"})
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float32{0.9, 0.25}, confidences, 0.0001)
+
+	malformed := testutil.ToFloat64(MalformedPredictionResponses)
+	for response, expected := range map[string]string{
+		`{"confidence": 0.99}`:         "$.outputs is missing",
+		`{"outputs": [["0.99"]]}`:      "$.outputs: score must be a number: 0.99",
+		`{"outputs": [[null]]}`:        "$.outputs: score must be a number: <nil>",
+		`<html>Bad Gateway</html>`:     "invalid character '<' looking for beginning of value",
+		`{"outputs": [0.1, 0.9, 0.3]}`: "",
+	} {
+		body = response
+		confidences, err := backend.Predict(context.Background(), []string{"SELECT 1"})
+		if expected == "" {
+			// The number of scores is checked by the caller.
+			require.NoError(t, err)
+			assert.Len(t, confidences, 3)
+			continue
+		}
+		require.ErrorIs(t, err, ErrMalformedResponse)
+		assert.EqualError(t, err, "malformed prediction API response: "+expected)
+	}
+	assert.InDelta(t, 4, testutil.ToFloat64(MalformedPredictionResponses)-malformed, 0)
+}
+
+func Test_KServeRESTBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/models/sqli_model/infer", r.URL.Path)
+
+		var request struct {
+			Inputs  []kserveTensor   `json:"inputs"`
+			Outputs []map[string]any `json:"outputs"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		if !assert.Len(t, request.Inputs, 1) {
+			return
+		}
+		assert.Equal(t, "query", request.Inputs[0].Name)
+		assert.Equal(t, "BYTES", request.Inputs[0].Datatype)
+		assert.Equal(t, []int64{2, 1}, request.Inputs[0].Shape)
+		assert.Equal(t, []any{"SELECT 1", "SELECT 1 OR 1=1"}, request.Inputs[0].Data)
+
+		w.Header().Set("Content-Type", "application/json")
+		// The data of the confidence output is nested, as returned by some servers.
+		assert.NoError(t, json.NewEncoder(w).Encode(map[string]any{
+			"model_name": "sqli_model",
+			"outputs": []map[string]any{
+				{"name": "logits", "datatype": "FP32", "shape": []int{2, 1}, "data": []float32{-4, 4}},
+				{"name": "confidence", "datatype": "FP32", "shape": []int{2, 1}, "data": [][]float32{{0.01}, {0.99}}},
+			},
+		}))
+	}))
+	defer server.Close()
+
+	queries := []string{"SELECT 1", "SELECT 1 OR 1=1"}
+	backend := &KServeRESTBackend{Address: server.URL, Model: "sqli_model", Input: "query", Output: "confidence"}
+	confidences, err := backend.Predict(context.Background(), queries)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.01, 0.99}, confidences)
+
+	// The first output is used if the output is not set.
+	backend.Output = ""
+	confidences, err = backend.Predict(context.Background(), queries)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{-4, 4}, confidences)
+
+	backend.Output = "score"
+	_, err = backend.Predict(context.Background(), queries)
+	require.ErrorIs(t, err, ErrMalformedResponse)
+	require.EqualError(t, err, "malformed prediction API response: inference API returned no score output")
+}
+
+// newInferenceServer returns the address of a gRPC server that implements the
+// ModelInfer method with the handler, which gets the model and the queries of
+// the request and returns the encoded response.
+func newInferenceServer(
+	t *testing.T, handler func(model string, queries []string) ([]byte, error),
+) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer(
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+			method, _ := grpc.MethodFromServerStream(stream)
+			if method != ModelInferMethod {
+				return status.Errorf(codes.Unimplemented, "unknown method: %s", method)
+			}
+
+			var request rawMessage
+			if err := stream.RecvMsg(&request); err != nil {
+				return err
+			}
+			var model string
+			var queries []string
+			assert.NoError(t, walkFields(request, func(num protowire.Number, _ protowire.Type, value []byte) error {
+				switch num {
+				case inferRequestModelName:
+					model = string(value)
+				case inferRequestInputs:
+					return walkFields(value, func(num protowire.Number, _ protowire.Type, value []byte) error {
+						if num != inferTensorContents {
+							return nil
+						}
+						return walkFields(value, func(_ protowire.Number, _ protowire.Type, value []byte) error {
+							queries = append(queries, string(value))
+							return nil
+						})
+					})
+				}
+				return nil
+			}))
+
+			response, err := handler(model, queries)
+			if err != nil {
+				return err
+			}
+			message := rawMessage(response)
+			return stream.SendMsg(&message)
+		}),
+	)
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// encodeOutputTensor encodes an output tensor of a ModelInferResponse, with
+// the FP32 scores as contents, if any.
+func encodeOutputTensor(name string, scores []float32) []byte {
+	tensor := appendField(nil, inferTensorName, []byte(name))
+	tensor = appendField(tensor, inferTensorDatatype, []byte("FP32"))
+	if scores != nil {
+		var packed []byte
+		for _, score := range scores {
+			packed = protowire.AppendFixed32(packed, math.Float32bits(score))
+		}
+		tensor = appendField(tensor, inferTensorContents, appendField(nil, inferContentsFP32, packed))
+	}
+	return appendField(nil, inferResponseOutputs, tensor)
+}
+
+func Test_KServeGRPCBackend(t *testing.T) {
+	address := newInferenceServer(t, func(model string, queries []string) ([]byte, error) {
+		if model != "sqli_model" {
+			return nil, status.Errorf(codes.NotFound, "unknown model: %s", model)
+		}
+		response := encodeOutputTensor("logits", []float32{-4, 4})
+		return append(response, encodeOutputTensor("confidence", scoreQueries(queries))...), nil
+	})
+
+	queries := []string{"SELECT 1", "SELECT 1 OR 1=1"}
+	backend := &KServeGRPCBackend{Address: address, Model: "sqli_model", Input: "query", Output: "confidence"}
+	defer backend.Close()
+	confidences, err := backend.Predict(context.Background(), queries)
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.01, 0.99}, confidences)
+
+	backend = &KServeGRPCBackend{Address: address, Model: "unknown", Input: "query"}
+	defer backend.Close()
+	_, err = backend.Predict(context.Background(), queries)
+	require.Error(t, err)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// The plugin closes the backend when it shuts down.
+	p := &Plugin{Backend: backend}
+	require.NoError(t, p.Close())
+	assert.Nil(t, backend.conn)
+	_, err = backend.Predict(context.Background(), queries)
+	require.ErrorIs(t, err, ErrBackendClosed)
+	require.NoError(t, backend.Close())
+	require.NoError(t, (&Plugin{Backend: &HTTPBackend{}}).Close())
+}
+
+func Test_KServeGRPCBackendRawOutput(t *testing.T) {
+	address := newInferenceServer(t, func(_ string, queries []string) ([]byte, error) {
+		raw := make([]byte, 0, 4*len(queries))
+		for _, score := range scoreQueries(queries) {
+			raw = binary.LittleEndian.AppendUint32(raw, math.Float32bits(score))
+		}
+		response := encodeOutputTensor("confidence", nil)
+		return appendField(response, inferResponseRawOutputs, raw), nil
+	})
+
+	backend := &KServeGRPCBackend{Address: address, Model: "sqli_model", Input: "query"}
+	defer backend.Close()
+	confidences, err := backend.Predict(context.Background(), []string{"SELECT 1 OR 1=1", "SELECT 1"})
+	require.NoError(t, err)
+	assert.Equal(t, []float32{0.99, 0.01}, confidences)
+}
+
+func Test_DeepLearningDetectorBackend(t *testing.T) {
+	detector := &DeepLearningDetector{
+		Backend: backendFunc(func(_ context.Context, queries []string) ([]float32, error) {
+			return scoreQueries(queries), nil
+		}),
+		Threshold: 0.8,
+		Logger:    hclog.NewNullLogger(),
+	}
+	verdict, err := detector.Inspect(context.Background(), "SELECT 1 OR 1=1")
+	require.NoError(t, err)
+	assert.True(t, verdict.Injection)
+	assert.InDelta(t, 0.99, verdict.Score, 0.0001)
+
+	detector.Backend = backendFunc(func(context.Context, []string) ([]float32, error) {
+		return nil, nil
+	})
+	_, err = detector.Inspect(context.Background(), "SELECT 1")
+	require.EqualError(t, err, "malformed prediction API response: got 0 scores for 1 queries")
+}
@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PredictionBatcher collects the queries of concurrent predictions and sends
+// them to the prediction API in a single request, once the batch is full or
+// the oldest query has waited for the max wait. The confidences are passed
+// back to the waiting callers. Identical queries of a batch are sent once.
+// The outcome of each batch is recorded once by the circuit breaker, if set.
+type PredictionBatcher struct {
+	maxSize int
+	maxWait time.Duration
+	timeout time.Duration
+	backend PredictionBackend
+	breaker *CircuitBreaker
+
+	mu      sync.Mutex
+	pending *predictionBatch
+}
+
+// predictionBatch is a batch of queries, which is done once the confidences
+// are received or the request failed.
+type predictionBatch struct {
+	queries     []string
+	index       map[string]int
+	timer       *time.Timer
+	done        chan struct{}
+	confidences []float32
+	err         error
+	// waiters is the number of callers that wait for the batch, whose
+	// context is canceled once all of them stop waiting.
+	waiters int
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewPredictionBatcher returns a new PredictionBatcher that sends the batches
+// to the backend, and records their outcome by the breaker.
+func NewPredictionBatcher(
+	backend PredictionBackend, breaker *CircuitBreaker, maxSize int, maxWait, timeout time.Duration,
+) *PredictionBatcher {
+	if timeout == 0 {
+		timeout = DefaultPredictionTimeout
+	}
+	return &PredictionBatcher{
+		maxSize: maxSize,
+		maxWait: maxWait,
+		timeout: timeout,
+		backend: backend,
+		breaker: breaker,
+	}
+}
+
+// MaxSize returns the max number of queries per batch, or zero if the
+// predictions are not batched.
+func (b *PredictionBatcher) MaxSize() int {
+	if b == nil {
+		return 0
+	}
+	return b.maxSize
+}
+
+// Predict adds the query to the pending batch and returns its confidence once
+// the batch is done, or the error of the context if it is done first.
+func (b *PredictionBatcher) Predict(ctx context.Context, query string) (float32, error) {
+	b.mu.Lock()
+	batch := b.pending
+	if batch == nil {
+		batch = &predictionBatch{index: map[string]int{}, done: make(chan struct{})}
+		batch.ctx, batch.cancel = context.WithCancel(context.Background())
+		batch.timer = time.AfterFunc(b.maxWait, func() { b.flush(batch) })
+		b.pending = batch
+	}
+	batch.waiters++
+	idx, ok := batch.index[query]
+	if !ok {
+		idx = len(batch.queries)
+		batch.index[query] = idx
+		batch.queries = append(batch.queries, query)
+	}
+	full := len(batch.queries) >= b.maxSize
+	b.mu.Unlock()
+
+	if full {
+		// The batch is sent in the background, so that the caller still
+		// stops waiting once its context is done.
+		go b.flush(batch)
+	}
+
+	select {
+	case <-batch.done:
+		if batch.err != nil {
+			return 0, batch.err
+		}
+		return batch.confidences[idx], nil
+	case <-ctx.Done():
+		b.leave(batch)
+		return 0, ctx.Err()
+	}
+}
+
+// leave stops waiting for the batch. Once no caller waits for the batch, the
+// batch is dropped if it was not sent yet, and its request is canceled.
+func (b *PredictionBatcher) leave(batch *predictionBatch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch.waiters--
+	if batch.waiters > 0 {
+		return
+	}
+	if b.pending == batch {
+		// The batch is dropped before it was sent.
+		b.pending = nil
+		batch.timer.Stop()
+		b.breaker.Abandon()
+	}
+	batch.cancel()
+}
+
+// flush sends the batch, unless it was already sent, and records its outcome
+// once for all its queries. A batch whose callers all stopped waiting is not
+// a failure of the prediction API, but it is abandoned, in case it was the
+// probe of the breaker.
+func (b *PredictionBatcher) flush(batch *predictionBatch) {
+	b.mu.Lock()
+	if b.pending != batch {
+		b.mu.Unlock()
+		return
+	}
+	b.pending = nil
+	b.mu.Unlock()
+	batch.timer.Stop()
+
+	PredictionBatchSize.Observe(float64(len(batch.queries)))
+	ctx, cancel := context.WithTimeout(batch.ctx, b.timeout)
+	defer cancel()
+	defer batch.cancel()
+	batch.confidences, batch.err = b.backend.Predict(ctx, batch.queries)
+	if batch.err == nil {
+		batch.err = checkScores(batch.confidences, len(batch.queries))
+	}
+
+	switch {
+	case batch.ctx.Err() != nil:
+		// The callers stopped waiting for the batch.
+		b.breaker.Abandon()
+	case batch.err != nil:
+		b.breaker.Failure()
+	default:
+		b.breaker.Success()
+	}
+	close(batch.done)
+}
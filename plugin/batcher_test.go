@@ -0,0 +1,270 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backendFunc is a PredictionBackend that calls the function.
+type backendFunc func(ctx context.Context, queries []string) ([]float32, error)
+
+func (f backendFunc) Predict(ctx context.Context, queries []string) ([]float32, error) {
+	return f(ctx, queries)
+}
+
+// scoreQueries scores the queries that contain "OR" as injections.
+func scoreQueries(queries []string) []float32 {
+	confidences := make([]float32, 0, len(queries))
+	for _, query := range queries {
+		if strings.Contains(query, "OR") {
+			confidences = append(confidences, 0.99)
+		} else {
+			confidences = append(confidences, 0.01)
+		}
+	}
+	return confidences
+}
+
+// newBatchServer returns a prediction API that scores the queries with
+// scoreQueries, and counts the requests.
+func newBatchServer(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+
+		// A single query is sent to the predict endpoint.
+		if r.URL.Path == PredictPath {
+			var body struct {
+				Query string `json:"query"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.NoError(t, json.NewEncoder(w).Encode(
+				map[string]any{"confidence": scoreQueries([]string{body.Query})[0]}))
+			return
+		}
+
+		assert.Equal(t, PredictBatchPath, r.URL.Path)
+		var body struct {
+			Queries []string `json:"queries"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.NoError(t, json.NewEncoder(w).Encode(map[string]any{"confidences": scoreQueries(body.Queries)}))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func Test_PredictionBatcher(t *testing.T) {
+	var requests atomic.Int32
+	server := newBatchServer(t, &requests)
+	batcher := NewPredictionBatcher(&HTTPBackend{Address: server.URL}, nil, 4, time.Second, time.Second)
+
+	// A full batch is sent right away, without waiting for the max wait.
+	queries := []string{"SELECT 1", "SELECT 1 OR 1=1", "SELECT 2", "SELECT 2 OR 2=2"}
+	confidences := make([]float32, len(queries))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for idx, query := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			confidence, err := batcher.Predict(context.Background(), query)
+			assert.NoError(t, err)
+			confidences[idx] = confidence
+		}()
+	}
+	wg.Wait()
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, []float32{0.01, 0.99, 0.01, 0.99}, confidences)
+}
+
+func Test_PredictionBatcherMaxWait(t *testing.T) {
+	var requests atomic.Int32
+	server := newBatchServer(t, &requests)
+	batcher := NewPredictionBatcher(&HTTPBackend{Address: server.URL}, nil, 100, 10*time.Millisecond, time.Second)
+
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Identical queries share the confidence of a single query.
+			confidence, err := batcher.Predict(context.Background(), "SELECT 1 OR 1=1")
+			assert.NoError(t, err)
+			assert.InDelta(t, 0.99, confidence, 0.0001)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func Test_PredictionBatcherErrors(t *testing.T) {
+	batcher := NewPredictionBatcher(backendFunc(func(context.Context, []string) ([]float32, error) {
+		return []float32{0.5}, nil
+	}), nil, 2, time.Millisecond, time.Second)
+	_, err := batcher.Predict(context.Background(), "SELECT 1")
+	require.NoError(t, err)
+
+	// The batch of two queries gets a single confidence.
+	var wg sync.WaitGroup
+	for _, query := range []string{"SELECT 1", "SELECT 2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := batcher.Predict(context.Background(), query)
+			assert.ErrorContains(t, err, "malformed prediction API response: got 1 scores for 2 queries")
+		}()
+	}
+	wg.Wait()
+
+	batcher.backend = backendFunc(func(context.Context, []string) ([]float32, error) {
+		return nil, errors.New("connection refused")
+	})
+	_, err = batcher.Predict(context.Background(), "SELECT 1")
+	require.EqualError(t, err, "connection refused")
+
+	// The caller stops waiting for the batch once its context is done.
+	batcher = NewPredictionBatcher(&HTTPBackend{}, nil, 2, time.Hour, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = batcher.Predict(ctx, "SELECT 1")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func Test_DeepLearningDetectorBatcher(t *testing.T) {
+	var requests atomic.Int32
+	server := newBatchServer(t, &requests)
+	detector := &DeepLearningDetector{
+		APIAddress: "http://localhost:1",
+		Threshold:  0.8,
+		Batcher:    NewPredictionBatcher(&HTTPBackend{Address: server.URL}, nil, 2, time.Millisecond, time.Second),
+		Logger:     hclog.NewNullLogger(),
+	}
+
+	verdict, err := detector.Inspect(context.Background(), "SELECT 1 OR 1=1")
+	require.NoError(t, err)
+	assert.True(t, verdict.Injection)
+	assert.InDelta(t, 0.99, verdict.Score, 0.0001)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func Test_PredictionBatcherBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Hour)
+	batcher := NewPredictionBatcher(backendFunc(func(context.Context, []string) ([]float32, error) {
+		return nil, errors.New("connection refused")
+	}), breaker, 3, time.Hour, time.Second)
+
+	// A failed batch of three queries is a single failure.
+	var wg sync.WaitGroup
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 3"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := batcher.Predict(context.Background(), query)
+			assert.EqualError(t, err, "connection refused")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	// The request of a batch is canceled once all its callers stop waiting,
+	// which is not a failure of the prediction API.
+	canceled := make(chan struct{})
+	batcher = NewPredictionBatcher(backendFunc(func(ctx context.Context, _ []string) ([]float32, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}), breaker, 2, time.Millisecond, time.Hour)
+	for _, query := range []string{"SELECT 1", "SELECT 2"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := batcher.Predict(ctx, query)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		}()
+	}
+	wg.Wait()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the request of the batch was not canceled")
+	}
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	// A batch that was not sent yet is dropped.
+	batcher = NewPredictionBatcher(&HTTPBackend{}, breaker, 2, time.Hour, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := batcher.Predict(ctx, "SELECT 1")
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Nil(t, batcher.pending)
+}
+
+func Test_PredictionBatcherAbandonedProbe(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+	breaker.Failure()
+	now = now.Add(2 * time.Minute)
+
+	var slow atomic.Bool
+	slow.Store(true)
+	batcher := NewPredictionBatcher(backendFunc(func(ctx context.Context, queries []string) ([]float32, error) {
+		if slow.Load() {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return make([]float32, len(queries)), nil
+	}), breaker, 1, time.Hour, time.Hour)
+	detector := &DeepLearningDetector{
+		Threshold: 0.8,
+		Breaker:   breaker,
+		Batcher:   batcher,
+		Logger:    hclog.NewNullLogger(),
+	}
+
+	// The probe is abandoned by its caller while it is sent.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := detector.Inspect(ctx, "SELECT 1")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Eventually(t, func() bool { return breaker.State() == CircuitOpen }, time.Second, time.Millisecond)
+
+	// The next query probes the prediction API again.
+	slow.Store(false)
+	verdict, err := detector.Inspect(context.Background(), "SELECT 2")
+	require.NoError(t, err)
+	assert.False(t, verdict.Injection)
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	// A probe batch that was dropped before it was sent is abandoned as well.
+	breaker.Failure()
+	now = now.Add(2 * time.Minute)
+	batcher.maxSize = 2
+	batcher.maxWait = time.Hour
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = detector.Inspect(ctx, "SELECT 3")
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, CircuitOpen, breaker.State())
+	require.NoError(t, breaker.Allow())
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit breaker, which is exposed as
+// a number by the state metric.
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitHalfOpen
+	CircuitOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops calling a failing service, so that queries don't wait
+// for the full timeout of a service that is down. The breaker opens after a
+// number of consecutive failures, and after the open timeout a single probe
+// is let through (half-open): the breaker closes if the probe succeeds and
+// opens again if it fails.
+type CircuitBreaker struct {
+	mu               sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+	state            CircuitState
+	failures         int
+	openedAt         time.Time
+	now              func() time.Time
+}
+
+// NewCircuitBreaker returns a new closed CircuitBreaker.
+func NewCircuitBreaker(failureThreshold int, openTimeout time.Duration) *CircuitBreaker {
+	PredictionCircuitBreakerState.Set(float64(CircuitClosed))
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		state:            CircuitClosed,
+		now:              time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen if the call must not be made. A nil breaker
+// allows all calls.
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.openTimeout {
+			PredictionCircuitBreakerRejections.Inc()
+			return ErrCircuitOpen
+		}
+		// Let a single probe through.
+		b.setState(CircuitHalfOpen)
+		return nil
+	case CircuitHalfOpen:
+		// A probe is already in flight.
+		PredictionCircuitBreakerRejections.Inc()
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// Success records a successful call and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.setState(CircuitClosed)
+}
+
+// Failure records a failed call and opens the breaker if the probe failed or
+// there were too many consecutive failures.
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.failureThreshold {
+		b.openedAt = b.now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// Abandon records a call whose caller stopped waiting before it completed,
+// which is not a failure of the service. If the call was the probe, the
+// breaker is open again, with the open timeout elapsed, so that the next
+// call probes the service instead of all calls being rejected.
+func (b *CircuitBreaker) Abandon() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen {
+		b.openedAt = b.now().Add(-b.openTimeout)
+		b.setState(CircuitOpen)
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) setState(state CircuitState) {
+	b.state = state
+	PredictionCircuitBreakerState.Set(float64(state))
+}
@@ -0,0 +1,69 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+	breaker := NewCircuitBreaker(2, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	require.NoError(t, breaker.Allow())
+	breaker.Failure()
+	assert.Equal(t, CircuitClosed, breaker.State())
+	breaker.Failure()
+	assert.Equal(t, CircuitOpen, breaker.State())
+	require.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// After the open timeout, a single probe is let through.
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, breaker.Allow())
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+	require.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// A failed probe opens the breaker again.
+	breaker.Failure()
+	assert.Equal(t, CircuitOpen, breaker.State())
+	require.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// A successful probe closes the breaker.
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, breaker.Allow())
+	breaker.Success()
+	assert.Equal(t, CircuitClosed, breaker.State())
+	require.NoError(t, breaker.Allow())
+}
+
+func Test_CircuitBreakerAbandon(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	// An abandoned call doesn't change a closed breaker.
+	breaker.Abandon()
+	assert.Equal(t, CircuitClosed, breaker.State())
+
+	breaker.Failure()
+	now = now.Add(2 * time.Minute)
+	require.NoError(t, breaker.Allow())
+	require.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+	// The next call probes the service again if the probe is abandoned.
+	breaker.Abandon()
+	assert.Equal(t, CircuitOpen, breaker.State())
+	require.NoError(t, breaker.Allow())
+	assert.Equal(t, CircuitHalfOpen, breaker.State())
+}
+
+func Test_CircuitBreakerDisabled(t *testing.T) {
+	var breaker *CircuitBreaker
+	require.NoError(t, breaker.Allow())
+	breaker.Abandon()
+	breaker.Failure()
+	assert.Equal(t, CircuitClosed, breaker.State())
+}
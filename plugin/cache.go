@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// VerdictCache is a bounded LRU cache with expiring entries, which stores the
+// raw score of a detector for a query, e.g. the model confidence, so that the
+// same query is not inspected over and over again. The score is stored rather
+// than the verdict, so changing the threshold applies to cached queries.
+type VerdictCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[[sha256.Size]byte]*list.Element
+	lru        *list.List
+	now        func() time.Time
+}
+
+type cacheEntry struct {
+	key       [sha256.Size]byte
+	score     float32
+	expiresAt time.Time
+}
+
+// NewVerdictCache returns a new VerdictCache. A zero TTL means the entries
+// never expire and are only evicted when the cache is full.
+func NewVerdictCache(maxEntries int, ttl time.Duration) *VerdictCache {
+	return &VerdictCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[[sha256.Size]byte]*list.Element{},
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// Get returns the cached score of the detector for the query.
+func (c *VerdictCache) Get(detector, query string) (float32, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	key := cacheKey(detector, query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		CacheMisses.WithLabelValues(detector).Inc()
+		return 0, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if c.ttl > 0 && c.now().After(entry.expiresAt) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		CacheMisses.WithLabelValues(detector).Inc()
+		return 0, false
+	}
+
+	c.lru.MoveToFront(element)
+	CacheHits.WithLabelValues(detector).Inc()
+	return entry.score, true
+}
+
+// Set stores the score of the detector for the query, evicting the least
+// recently used entry if the cache is full.
+func (c *VerdictCache) Set(detector, query string, score float32) {
+	if c == nil || c.maxEntries <= 0 {
+		return
+	}
+
+	key := cacheKey(detector, query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		entry.score = score
+		entry.expiresAt = c.now().Add(c.ttl)
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:       key,
+		score:     score,
+		expiresAt: c.now().Add(c.ttl),
+	})
+
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Len returns the number of entries in the cache, including expired ones.
+func (c *VerdictCache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// cacheKey hashes the detector name and the exact query, so that large
+// queries don't take up memory in the cache. The query is not normalized, as
+// whitespace changes the meaning of SQL, e.g. a newline ends a -- comment, so
+// that a payload would get the cached score of a harmless query.
+func cacheKey(detector, query string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(detector + "\x00" + query))
+}
@@ -0,0 +1,102 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_VerdictCache(t *testing.T) {
+	cache := NewVerdictCache(2, time.Minute)
+
+	cache.Set(DeepLearningModel, "SELECT 1", 0.1)
+	cache.Set(DeepLearningModel, "SELECT 2", 0.2)
+
+	score, ok := cache.Get(DeepLearningModel, "SELECT 1")
+	assert.True(t, ok)
+	assert.InDelta(t, 0.1, score, 0.0001)
+
+	// The scores of the detectors are stored separately.
+	_, ok = cache.Get(Libinjection, "SELECT 1")
+	assert.False(t, ok)
+
+	// The least recently used entry is evicted.
+	cache.Set(DeepLearningModel, "SELECT 3", 0.3)
+	assert.Equal(t, 2, cache.Len())
+	_, ok = cache.Get(DeepLearningModel, "SELECT 2")
+	assert.False(t, ok)
+	_, ok = cache.Get(DeepLearningModel, "SELECT 1")
+	assert.True(t, ok)
+}
+
+func Test_VerdictCacheExactQuery(t *testing.T) {
+	cache := NewVerdictCache(10, time.Minute)
+
+	// A newline ends the comment, so the queries differ only by whitespace,
+	// but the second one runs OR 1=1.
+	cache.Set(DeepLearningModel, "SELECT * FROM t WHERE a = 'x' -- c OR 1=1", 0.1)
+	_, ok := cache.Get(DeepLearningModel, "SELECT * FROM t WHERE a = 'x' -- c\nOR 1=1")
+	assert.False(t, ok)
+
+	// So does whitespace in strings.
+	cache.Set(DeepLearningModel, "SELECT 'a  b'", 0.1)
+	_, ok = cache.Get(DeepLearningModel, "SELECT 'a b'")
+	assert.False(t, ok)
+}
+
+func Test_VerdictCacheExpiry(t *testing.T) {
+	cache := NewVerdictCache(10, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Set(DeepLearningModel, "SELECT 1", 0.1)
+	_, ok := cache.Get(DeepLearningModel, "SELECT 1")
+	assert.True(t, ok)
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.Get(DeepLearningModel, "SELECT 1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Len())
+}
+
+func Test_DeepLearningDetectorCache(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusOK)
+			data, _ := json.Marshal(map[string]any{"confidence": 0.9})
+			_, err := w.Write(data)
+			assert.NoError(t, err)
+		}),
+	)
+	defer server.Close()
+
+	detector := &DeepLearningDetector{
+		APIAddress: server.URL,
+		Threshold:  0.8,
+		Cache:      NewVerdictCache(10, time.Minute),
+		Logger:     hclog.NewNullLogger(),
+	}
+
+	for range 3 {
+		verdict, err := detector.Inspect(context.Background(), "SELECT * FROM users WHERE id = 1 OR 1=1")
+		require.NoError(t, err)
+		assert.True(t, verdict.Injection)
+	}
+	assert.Equal(t, 1, calls)
+
+	// The threshold applies to the cached confidence.
+	detector.Threshold = 0.95
+	verdict, err := detector.Inspect(context.Background(), "SELECT * FROM users WHERE id = 1 OR 1=1")
+	require.NoError(t, err)
+	assert.False(t, verdict.Injection)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,488 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// Config is the typed configuration of the plugin, as loaded from the config
+// of the PluginConfig. Durations are configured in seconds.
+type Config struct {
+	MetricsEnabled          bool
+	MetricsUnixDomainSocket string
+	MetricsEndpoint         string
+
+	AdminEnabled          bool
+	AdminUnixDomainSocket string
+	RecentDetectionsSize  int
+
+	Protocol string
+	Mode     string
+
+	PredictionBackend          string
+	PredictionAPIAddress       string
+	PredictionModelName        string
+	PredictionModelInput       string
+	PredictionModelOutput      string
+	PredictionScorePath        JSONPath
+	PredictionBatchScorePath   JSONPath
+	PredictionLabelPath        JSONPath
+	PredictionBatchLabelPath   JSONPath
+	PredictionInjectionLabel   string
+	PredictionTimeout          time.Duration
+	PredictionBatchSize        int
+	PredictionBatchMaxWait     time.Duration
+	Threshold                  float32
+	EnableLibinjection         bool
+	LibinjectionPermissiveMode bool
+	NormalizeQueries           bool
+	BlockStackedQueries        bool
+
+	OnPredictionFailure            string
+	CircuitBreakerFailureThreshold int
+	CircuitBreakerOpenTimeout      time.Duration
+
+	Detectors           []string
+	DetectorCombination string
+
+	DenylistFunctions   []string
+	DenylistCommands    []string
+	DenylistObjects     []string
+	DenylistExemptUsers []string
+	DenylistAction      string
+
+	LatencyAnalysis   bool
+	LatencyWindowSize int
+	LatencyMinDelay   time.Duration
+
+	VerdictCacheSize int
+	VerdictCacheTTL  time.Duration
+
+	AllowlistMode  string
+	AllowlistFile  string
+	LearningPeriod time.Duration
+
+	ConfigFile           string
+	ConfigReloadInterval time.Duration
+
+	PolicyFile string
+
+	BanScore                   float64
+	RiskScoreHalfLife          time.Duration
+	BanDuration                time.Duration
+	BanScope                   []string
+	TerminateBannedConnections bool
+
+	ResponseType            string
+	ErrorMessage            string
+	ErrorSeverity           string
+	ErrorNumber             string
+	ErrorDetail             string
+	MySQLErrorCode          uint16
+	AbortTransactionOnBlock bool
+
+	LogLevel string
+}
+
+var (
+	// ErrorSeverities are the severities of the error response that don't
+	// terminate the connection.
+	ErrorSeverities = []string{"DEBUG", "LOG", "INFO", "NOTICE", "WARNING", "ERROR", "EXCEPTION"}
+	// LogLevels are the log levels of the audit trail.
+	LogLevels = []string{"trace", "debug", "info", "warn", "error", "off"}
+
+	sqlStatePattern = regexp.MustCompile(`^[0-9A-Z]{5}$`)
+)
+
+// LoadConfig parses and validates the config. All the errors are reported at
+// once, so that they can be fixed in one go, and an invalid value is never
+// silently replaced with a zero value.
+func LoadConfig(cfg map[string]any) (*Config, error) {
+	parser := &configParser{cfg: cfg}
+	config := &Config{
+		MetricsEnabled:          parser.bool("metricsEnabled"),
+		MetricsUnixDomainSocket: parser.string("metricsUnixDomainSocket"),
+		MetricsEndpoint:         parser.string("metricsEndpoint"),
+
+		AdminEnabled:          parser.bool("adminEnabled"),
+		AdminUnixDomainSocket: parser.string("adminUnixDomainSocket"),
+		RecentDetectionsSize:  parser.int("recentDetectionsSize"),
+
+		Protocol: parser.oneOf("protocol", PostgresProtocol, MySQLProtocol),
+		Mode:     parser.oneOf("mode", PreventMode, DetectOnlyMode),
+
+		PredictionBackend: parser.oneOf("predictionBackend",
+			PredictionBackendHTTP, PredictionBackendKServe, PredictionBackendGRPC),
+		PredictionAPIAddress:       parser.string("predictionAPIAddress"),
+		PredictionModelName:        parser.string("predictionModelName"),
+		PredictionModelInput:       parser.string("predictionModelInput"),
+		PredictionModelOutput:      parser.string("predictionModelOutput"),
+		PredictionScorePath:        parser.jsonPath("predictionScorePath"),
+		PredictionBatchScorePath:   parser.jsonPath("predictionBatchScorePath"),
+		PredictionLabelPath:        parser.jsonPath("predictionLabelPath"),
+		PredictionBatchLabelPath:   parser.jsonPath("predictionBatchLabelPath"),
+		PredictionInjectionLabel:   parser.string("predictionInjectionLabel"),
+		PredictionTimeout:          parser.seconds("predictionTimeout"),
+		PredictionBatchSize:        parser.int("predictionBatchSize"),
+		PredictionBatchMaxWait:     parser.milliseconds("predictionBatchMaxWait"),
+		Threshold:                  float32(parser.float("threshold")),
+		EnableLibinjection:         parser.bool("enableLibinjection"),
+		LibinjectionPermissiveMode: parser.bool("libinjectionPermissiveMode"),
+		NormalizeQueries:           parser.bool("normalizeQueries"),
+		BlockStackedQueries:        parser.bool("blockStackedQueries"),
+
+		OnPredictionFailure: parser.oneOf(
+			"onPredictionFailure", FailureAllow, FailureBlock, FailureFallback),
+		CircuitBreakerFailureThreshold: parser.int("circuitBreakerFailureThreshold"),
+		CircuitBreakerOpenTimeout:      parser.seconds("circuitBreakerOpenTimeout"),
+
+		Detectors:           parser.list("detectors"),
+		DetectorCombination: parser.oneOf("detectorCombination", CombineAny, CombineAll),
+
+		DenylistFunctions:   parser.list("denylistFunctions"),
+		DenylistCommands:    parser.list("denylistCommands"),
+		DenylistObjects:     parser.list("denylistObjects"),
+		DenylistExemptUsers: parser.list("denylistExemptUsers"),
+		DenylistAction:      parser.oneOf("denylistAction", DenylistOff, DenylistBlock, DenylistFlag),
+
+		LatencyAnalysis:   parser.bool("latencyAnalysis"),
+		LatencyWindowSize: parser.int("latencyWindowSize"),
+		LatencyMinDelay:   parser.milliseconds("latencyMinDelay"),
+
+		VerdictCacheSize: parser.int("verdictCacheSize"),
+		VerdictCacheTTL:  parser.seconds("verdictCacheTTL"),
+
+		AllowlistMode: parser.oneOf(
+			"allowlistMode", AllowlistOff, AllowlistLearn, AllowlistEnforce),
+		AllowlistFile:  parser.string("allowlistFile"),
+		LearningPeriod: parser.seconds("learningPeriod"),
+
+		ConfigFile:           parser.string("configFile"),
+		ConfigReloadInterval: parser.seconds("configReloadInterval"),
+
+		PolicyFile: parser.string("policyFile"),
+
+		BanScore:                   parser.float("banScore"),
+		RiskScoreHalfLife:          parser.seconds("riskScoreHalfLife"),
+		BanDuration:                parser.seconds("banDuration"),
+		BanScope:                   parser.list("banScope"),
+		TerminateBannedConnections: parser.bool("terminateBannedConnections"),
+
+		ResponseType:            parser.oneOf("responseType", ResponseType, EmptyResponseType),
+		ErrorMessage:            parser.string("errorMessage"),
+		ErrorSeverity:           parser.oneOf("errorSeverity", ErrorSeverities...),
+		ErrorNumber:             parser.string("errorNumber"),
+		ErrorDetail:             parser.string("errorDetail"),
+		MySQLErrorCode:          parser.uint16("mysqlErrorCode"),
+		AbortTransactionOnBlock: parser.bool("abortTransactionOnBlock"),
+
+		LogLevel: parser.oneOf("logLevel", LogLevels...),
+	}
+
+	parser.errs = append(parser.errs, config.validate()...)
+	if len(parser.errs) > 0 {
+		return nil, errors.Join(parser.errs...)
+	}
+	return config, nil
+}
+
+// Apply sets the detection and response settings of the plugin, including the
+// circuit breaker and the verdict cache. The components that run in the
+// background, e.g. the allowlist and the bans, are left to the caller.
+func (c *Config) Apply(p *Plugin) {
+	p.Protocol = c.Protocol
+	p.Mode = c.Mode
+	p.Threshold = c.Threshold
+	p.EnableLibinjection = c.EnableLibinjection
+	p.LibinjectionPermissiveMode = c.LibinjectionPermissiveMode
+	p.NormalizeQueries = c.NormalizeQueries
+	p.BlockStackedQueries = c.BlockStackedQueries
+	p.PredictionAPIAddress = c.PredictionAPIAddress
+	p.PredictionTimeout = c.PredictionTimeout
+	p.OnPredictionFailure = c.OnPredictionFailure
+	p.Backend = NewPredictionBackend(c)
+	if c.CircuitBreakerFailureThreshold > 0 {
+		p.Breaker = NewCircuitBreaker(c.CircuitBreakerFailureThreshold, c.CircuitBreakerOpenTimeout)
+	}
+	if c.PredictionBatchSize > 1 {
+		p.Batcher = NewPredictionBatcher(
+			p.Backend, p.Breaker, c.PredictionBatchSize, c.PredictionBatchMaxWait, c.PredictionTimeout)
+	}
+	p.Detectors = c.Detectors
+	p.DetectorCombination = c.DetectorCombination
+	p.DenylistFunctions = c.DenylistFunctions
+	p.DenylistCommands = c.DenylistCommands
+	p.DenylistObjects = c.DenylistObjects
+	p.DenylistExemptUsers = c.DenylistExemptUsers
+	p.DenylistAction = c.DenylistAction
+	if c.LatencyAnalysis {
+		p.Latency = NewLatencyAnalyzer(c.LatencyWindowSize, c.LatencyMinDelay)
+	}
+	p.TerminateBannedConnections = c.TerminateBannedConnections
+	p.ResponseType = c.ResponseType
+	p.ErrorMessage = c.ErrorMessage
+	p.ErrorSeverity = c.ErrorSeverity
+	p.ErrorNumber = c.ErrorNumber
+	p.ErrorDetail = c.ErrorDetail
+	p.MySQLErrorCode = c.MySQLErrorCode
+	p.AbortTransactionOnBlock = c.AbortTransactionOnBlock
+	p.LogLevel = c.LogLevel
+	if c.VerdictCacheSize > 0 {
+		p.Cache = NewVerdictCache(c.VerdictCacheSize, c.VerdictCacheTTL)
+	}
+}
+
+// validate checks the ranges and formats of the parsed values, and the values
+// that depend on each other.
+func (c *Config) validate() []error {
+	var errs []error
+	if c.Threshold < 0 || c.Threshold > 1 {
+		errs = append(errs, fmt.Errorf("threshold must be between 0 and 1: %v", c.Threshold))
+	}
+	for _, name := range c.Detectors {
+		if _, ok := getDetectorFactory(name); !ok {
+			errs = append(errs, fmt.Errorf("detectors: unknown detector: %s", name))
+		}
+	}
+	if slices.Contains(c.Detectors, DeepLearningModel) {
+		validateAddress := validateAPIAddress
+		if c.PredictionBackend == PredictionBackendGRPC {
+			validateAddress = validateGRPCAddress
+		}
+		if err := validateAddress(c.PredictionAPIAddress); err != nil {
+			errs = append(errs, fmt.Errorf("predictionAPIAddress: %w", err))
+		}
+		if c.PredictionBackend == PredictionBackendKServe || c.PredictionBackend == PredictionBackendGRPC {
+			if c.PredictionModelName == "" {
+				errs = append(errs, errors.New(
+					"predictionModelName must be set for the KServe and gRPC backends"))
+			}
+			if c.PredictionModelInput == "" {
+				errs = append(errs, errors.New(
+					"predictionModelInput must be set for the KServe and gRPC backends"))
+			}
+		}
+		if c.PredictionBackend == PredictionBackendHTTP {
+			errs = append(errs, c.validateResponseSchema()...)
+		}
+		if c.PredictionTimeout <= 0 {
+			errs = append(errs, errors.New("predictionTimeout must be positive"))
+		}
+		if c.PredictionBatchSize > 1 && c.PredictionBatchMaxWait <= 0 {
+			errs = append(errs, errors.New(
+				"predictionBatchMaxWait must be positive if the predictions are batched"))
+		}
+	}
+	for _, command := range c.DenylistCommands {
+		if !slices.Contains(DenylistCommands, command) {
+			errs = append(errs, fmt.Errorf("denylistCommands: unknown command: %s", command))
+		}
+	}
+	if c.LatencyAnalysis {
+		if c.LatencyWindowSize < LatencyMinSamples {
+			errs = append(errs, fmt.Errorf(
+				"latencyWindowSize must be at least %d if the latency analysis is enabled: %d",
+				LatencyMinSamples, c.LatencyWindowSize))
+		}
+		if c.LatencyMinDelay <= 0 {
+			errs = append(errs, errors.New(
+				"latencyMinDelay must be positive if the latency analysis is enabled"))
+		}
+	}
+	if c.CircuitBreakerFailureThreshold > 0 && c.CircuitBreakerOpenTimeout <= 0 {
+		errs = append(errs, errors.New(
+			"circuitBreakerOpenTimeout must be positive if the circuit breaker is enabled"))
+	}
+	if c.BanScore > 0 {
+		if c.RiskScoreHalfLife <= 0 {
+			errs = append(errs, errors.New("riskScoreHalfLife must be positive if bans are enabled"))
+		}
+		if c.BanDuration <= 0 {
+			errs = append(errs, errors.New("banDuration must be positive if bans are enabled"))
+		}
+		if len(c.BanScope) == 0 {
+			errs = append(errs, errors.New("banScope must not be empty if bans are enabled"))
+		}
+	}
+	for _, scope := range c.BanScope {
+		if scope != BanScopeClient && scope != BanScopeUser {
+			errs = append(errs, fmt.Errorf("banScope: invalid scope: %s", scope))
+		}
+	}
+	if !sqlStatePattern.MatchString(c.ErrorNumber) {
+		errs = append(errs, fmt.Errorf(
+			"errorNumber must be a SQLSTATE of five digits or uppercase letters: %q", c.ErrorNumber))
+	}
+	if c.AdminEnabled {
+		if c.AdminUnixDomainSocket == "" {
+			errs = append(errs, errors.New("adminUnixDomainSocket must be set if the admin API is enabled"))
+		}
+		if c.RecentDetectionsSize <= 0 {
+			errs = append(errs, errors.New("recentDetectionsSize must be positive if the admin API is enabled"))
+		}
+	}
+	return errs
+}
+
+// validateResponseSchema checks the paths of the scores and labels of the
+// responses of the HTTP backend.
+func (c *Config) validateResponseSchema() []error {
+	var errs []error
+	if c.PredictionScorePath == nil {
+		errs = append(errs, errors.New("predictionScorePath must be set, or $ for the whole response"))
+	}
+	batched := c.PredictionBatchSize > 1
+	if batched && c.PredictionBatchScorePath == nil {
+		errs = append(errs, errors.New(
+			"predictionBatchScorePath must be set if the predictions are batched, or $ for the whole response"))
+	}
+	if c.PredictionLabelPath != nil || (batched && c.PredictionBatchLabelPath != nil) {
+		if c.PredictionInjectionLabel == "" {
+			errs = append(errs, errors.New("predictionInjectionLabel must be set if the labels are used"))
+		}
+		if batched && (c.PredictionLabelPath == nil) != (c.PredictionBatchLabelPath == nil) {
+			errs = append(errs, errors.New(
+				"predictionLabelPath and predictionBatchLabelPath must both be set if the predictions are batched"))
+		}
+	}
+	return errs
+}
+
+// validateAPIAddress checks that the address is an absolute HTTP(S) URL.
+func validateAPIAddress(address string) error {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("URL must use http or https: %q", address)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("URL must have a host: %q", address)
+	}
+	return nil
+}
+
+// validateGRPCAddress checks that the address is a host and port, as the
+// target of a gRPC client.
+func validateGRPCAddress(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("address must be host:port: %q", address)
+	}
+	if host == "" || port == "" {
+		return fmt.Errorf("address must have a host and port: %q", address)
+	}
+	return nil
+}
+
+// configParser parses the values of the config strictly, collecting the errors
+// instead of falling back to zero values.
+type configParser struct {
+	cfg  map[string]any
+	errs []error
+}
+
+func (p *configParser) fail(key string, value string, expected string) {
+	p.errs = append(p.errs, fmt.Errorf("%s must be %s: %q", key, expected, value))
+}
+
+func (p *configParser) string(key string) string {
+	value, err := cast.ToStringE(p.cfg[key])
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s: %w", key, err))
+	}
+	return strings.TrimSpace(value)
+}
+
+func (p *configParser) bool(key string) bool {
+	value := p.string(key)
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(key, value, "a boolean")
+	}
+	return parsed
+}
+
+// int parses a non-negative integer.
+func (p *configParser) int(key string) int {
+	value := p.string(key)
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		p.fail(key, value, "a non-negative integer")
+		return 0
+	}
+	return parsed
+}
+
+// uint16 parses a positive integer of 16 bits.
+func (p *configParser) uint16(key string) uint16 {
+	value := p.string(key)
+	parsed, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || parsed == 0 {
+		p.fail(key, value, fmt.Sprintf("an integer between 1 and %d", math.MaxUint16))
+		return 0
+	}
+	return uint16(parsed)
+}
+
+// float parses a non-negative number.
+func (p *configParser) float(key string) float64 {
+	value := p.string(key)
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+		p.fail(key, value, "a non-negative number")
+		return 0
+	}
+	return parsed
+}
+
+// seconds parses a non-negative duration in seconds.
+func (p *configParser) seconds(key string) time.Duration {
+	return time.Duration(p.int(key)) * time.Second
+}
+
+// milliseconds parses a non-negative duration in milliseconds.
+func (p *configParser) milliseconds(key string) time.Duration {
+	return time.Duration(p.int(key)) * time.Millisecond
+}
+
+// jsonPath parses a JSON path, which is nil if empty.
+func (p *configParser) jsonPath(key string) JSONPath {
+	path, err := ParseJSONPath(p.string(key))
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s: %w", key, err))
+		// An invalid path is not reported as missing as well.
+		return JSONPath{}
+	}
+	return path
+}
+
+func (p *configParser) oneOf(key string, values ...string) string {
+	value := p.string(key)
+	if !slices.Contains(values, value) {
+		p.fail(key, value, "one of "+strings.Join(values, ", "))
+	}
+	return value
+}
+
+// list splits a comma-separated list and drops empty items.
+func (p *configParser) list(key string) []string {
+	items := []string{}
+	for _, item := range strings.Split(p.string(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
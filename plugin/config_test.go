@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func defaultConfig() map[string]any {
+	return maps.Clone(cast.ToStringMap(PluginConfig["config"]))
+}
+
+func Test_LoadConfig(t *testing.T) {
+	config, err := LoadConfig(defaultConfig())
+	require.NoError(t, err)
+	assert.Equal(t, PostgresProtocol, config.Protocol)
+	assert.Equal(t, PreventMode, config.Mode)
+	assert.InDelta(t, 0.8, config.Threshold, 0.0001)
+	assert.Equal(t, DefaultPredictionTimeout, config.PredictionTimeout)
+	assert.Equal(t, []string{DeepLearningModel, Libinjection}, config.Detectors)
+	assert.Equal(t, []string{BanScopeClient}, config.BanScope)
+	assert.Equal(t, ResponseType, config.ResponseType)
+	assert.Equal(t, ErrorNumber, config.ErrorNumber)
+	assert.Equal(t, MySQLErrorCode, config.MySQLErrorCode)
+	assert.Equal(t, LogLevel, config.LogLevel)
+}
+
+func Test_LoadConfigTypes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg["threshold"] = 0.5
+	cfg["enableLibinjection"] = false
+	cfg["predictionTimeout"] = 3
+	cfg["banScore"] = "4.5"
+	cfg["banScope"] = " client , user,"
+
+	config, err := LoadConfig(cfg)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, config.Threshold, 0.0001)
+	assert.False(t, config.EnableLibinjection)
+	assert.Equal(t, 3*time.Second, config.PredictionTimeout)
+	assert.InDelta(t, 4.5, config.BanScore, 0.0001)
+	assert.Equal(t, []string{BanScopeClient, BanScopeUser}, config.BanScope)
+}
+
+func Test_LoadConfigInvalid(t *testing.T) {
+	cfg := defaultConfig()
+	cfg["threshold"] = "0,8"
+	cfg["enableLibinjection"] = "yes"
+	cfg["predictionAPIAddress"] = "localhost:8000"
+	cfg["predictionTimeout"] = "1.5"
+	cfg["responseType"] = "silent"
+	cfg["errorSeverity"] = "FATAL"
+	cfg["errorNumber"] = "4200"
+	cfg["logLevel"] = "verbose"
+	cfg["mysqlErrorCode"] = "70000"
+	cfg["detectors"] = "deep_learning_model,unknown"
+
+	_, err := LoadConfig(cfg)
+	require.Error(t, err)
+	for _, expected := range []string{
+		`threshold must be a non-negative number: "0,8"`,
+		`enableLibinjection must be a boolean: "yes"`,
+		`predictionAPIAddress: URL must use http or https: "localhost:8000"`,
+		`predictionTimeout must be a non-negative integer: "1.5"`,
+		`responseType must be one of error, empty: "silent"`,
+		`errorSeverity must be one of DEBUG, LOG, INFO, NOTICE, WARNING, ERROR, EXCEPTION: "FATAL"`,
+		`errorNumber must be a SQLSTATE of five digits or uppercase letters: "4200"`,
+		`logLevel must be one of trace, debug, info, warn, error, off: "verbose"`,
+		`mysqlErrorCode must be an integer between 1 and 65535: "70000"`,
+		`detectors: unknown detector: unknown`,
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func Test_LoadConfigDependencies(t *testing.T) {
+	cfg := defaultConfig()
+	cfg["threshold"] = "1.5"
+	cfg["banScore"] = "5"
+	cfg["banDuration"] = "0"
+	cfg["banScope"] = "everyone"
+	cfg["adminEnabled"] = "true"
+	cfg["recentDetectionsSize"] = "0"
+
+	_, err := LoadConfig(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "threshold must be between 0 and 1: 1.5")
+	assert.Contains(t, err.Error(), "banDuration must be positive if bans are enabled")
+	assert.Contains(t, err.Error(), "banScope: invalid scope: everyone")
+	assert.Contains(t, err.Error(), "recentDetectionsSize must be positive if the admin API is enabled")
+
+	// The prediction API is only validated if the deep learning model is used.
+	cfg = defaultConfig()
+	cfg["detectors"] = Libinjection
+	cfg["predictionAPIAddress"] = ""
+	_, err = LoadConfig(cfg)
+	require.NoError(t, err)
+}
+
+func Test_LoadConfigPredictionBackend(t *testing.T) {
+	cfg := defaultConfig()
+	cfg["predictionBackend"] = PredictionBackendGRPC
+	cfg["predictionAPIAddress"] = "localhost:8081"
+	config, err := LoadConfig(cfg)
+	require.NoError(t, err)
+
+	p := &Plugin{}
+	config.Apply(p)
+	assert.Equal(t, &KServeGRPCBackend{
+		Address: "localhost:8081", Model: DefaultModelName, Input: DefaultModelInput,
+	}, p.Backend)
+
+	// The address of the gRPC backend is not a URL.
+	cfg["predictionAPIAddress"] = "http://localhost:8081"
+	cfg["predictionModelInput"] = ""
+	_, err = LoadConfig(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `predictionAPIAddress: address must be host:port: "http://localhost:8081"`)
+	assert.Contains(t, err.Error(), "predictionModelInput must be set for the KServe and gRPC backends")
+
+	cfg = defaultConfig()
+	cfg["predictionBackend"] = "tensorflow"
+	_, err = LoadConfig(cfg)
+	require.EqualError(t, err, `predictionBackend must be one of http, kserve, grpc: "tensorflow"`)
+}
+
+func Test_LoadConfigResponseSchema(t *testing.T) {
+	cfg := defaultConfig()
+	cfg["predictionScorePath"] = "outputs[0][0]"
+	cfg["predictionLabelPath"] = "label"
+	config, err := LoadConfig(cfg)
+	require.NoError(t, err)
+
+	p := &Plugin{}
+	config.Apply(p)
+	backend, ok := p.Backend.(*HTTPBackend)
+	require.True(t, ok)
+	assert.Equal(t, "$.outputs[0][0]", backend.Schema.ScorePath.String())
+	assert.Equal(t, "$.confidences", backend.Schema.BatchScorePath.String())
+	assert.Equal(t, "$.label", backend.Schema.LabelPath.String())
+	assert.Nil(t, backend.Schema.BatchLabelPath)
+	assert.Equal(t, "injection", backend.Schema.InjectionLabel)
+
+	cfg["predictionScorePath"] = ""
+	cfg["predictionBatchScorePath"] = "confidences["
+	cfg["predictionBatchSize"] = "8"
+	_, err = LoadConfig(cfg)
+	require.Error(t, err)
+	for _, expected := range []string{
+		`predictionBatchScorePath: path has an unclosed bracket: "confidences["`,
+		"predictionScorePath must be set, or $ for the whole response",
+		"predictionLabelPath and predictionBatchLabelPath must both be set if the predictions are batched",
+	} {
+		assert.Contains(t, err.Error(), expected)
+	}
+}
+
+func Test_LoadConfigDenylist(t *testing.T) {
+	config, err := LoadConfig(defaultConfig())
+	require.NoError(t, err)
+	assert.Equal(t, DefaultDenylistFunctions, config.DenylistFunctions)
+	assert.Equal(t, DefaultDenylistCommands, config.DenylistCommands)
+	assert.Equal(t, DefaultDenylistObjects, config.DenylistObjects)
+	assert.Empty(t, config.DenylistExemptUsers)
+
+	assert.Equal(t, DenylistOff, config.DenylistAction)
+
+	cfg := defaultConfig()
+	cfg["denylistAction"] = "deny"
+	cfg["denylistCommands"] = "copy_program, drop_table"
+	cfg["denylistExemptUsers"] = "postgres,dba"
+	_, err = LoadConfig(cfg)
+	require.EqualError(t, err, "denylistAction must be one of off, block, flag: \"deny\"\n"+
+		"denylistCommands: unknown command: drop_table")
+
+	cfg["denylistAction"] = DenylistFlag
+	cfg["denylistCommands"] = CommandCopyProgram
+	config, err = LoadConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"postgres", "dba"}, config.DenylistExemptUsers)
+
+	p := &Plugin{}
+	config.Apply(p)
+	assert.Equal(t, DenylistFlag, p.DenylistAction)
+	assert.Equal(t, []string{CommandCopyProgram}, p.DenylistCommands)
+	assert.Equal(t, []string{"postgres", "dba"}, p.DenylistExemptUsers)
+}
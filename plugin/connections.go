@@ -0,0 +1,424 @@
+package plugin
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	sdkPlugin "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/spf13/cast"
+)
+
+// Connection holds the state of a client connection that must survive
+// between hook calls. All methods are safe to call on a nil Connection,
+// which behaves like a connection without state.
+type Connection struct {
+	mu sync.Mutex
+	// skipUntilSync is set after an error is returned for a message of the
+	// extended query protocol, as the client expects all the following
+	// messages to be discarded until the next Sync.
+	skipUntilSync bool
+	// session identifies the client of the connection.
+	session Session
+	// txStatus is the transaction status of the last ReadyForQuery message
+	// sent by the server.
+	txStatus byte
+	// mysqlCapabilities are the capability flags of a MySQL client, sent in
+	// the handshake response.
+	mysqlCapabilities uint32
+	// mysqlPendingPrepare is the query of the last COM_STMT_PREPARE, which
+	// is waiting for the statement id and parameter count from the server.
+	mysqlPendingPrepare *string
+	// mysqlStatements are the prepared statements of a MySQL connection,
+	// keyed by statement id.
+	mysqlStatements map[uint32]*mysqlStatement
+	// mysqlPendingExecute is the statement id of the last COM_STMT_EXECUTE,
+	// whose long data is discarded once the server responds.
+	mysqlPendingExecute *uint32
+	// mysqlServerStatus holds the status flags of the last OK or EOF packet
+	// of the server, if mysqlServerStatusKnown is set.
+	mysqlServerStatus      uint16
+	mysqlServerStatusKnown bool
+	// mysqlCommandPhase is set once the MySQL client sends a command, after
+	// which no packet of the client belongs to the connection phase.
+	mysqlCommandPhase bool
+	// pendingQuery is the query of the last request, whose latency is
+	// measured from the time it is sent to the server until the response.
+	pendingQuery *TimedQuery
+	// terminated is set once a banned client receives a fatal error, after
+	// which the connection is closed on the next message of the client.
+	terminated bool
+}
+
+func (c *Connection) SkipUntilSync() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.skipUntilSync
+}
+
+func (c *Connection) SetSkipUntilSync(skip bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.skipUntilSync = skip
+}
+
+func (c *Connection) Terminated() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.terminated
+}
+
+func (c *Connection) SetTerminated(terminated bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.terminated = terminated
+}
+
+// Session returns the session of the connection, which is empty until the
+// connection is opened.
+func (c *Connection) Session() Session {
+	if c == nil {
+		return Session{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+func (c *Connection) SetSession(session Session) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.session = session
+}
+
+// TxStatus returns the transaction status of the connection, which is idle
+// until the server reports otherwise.
+func (c *Connection) TxStatus() byte {
+	if c == nil {
+		return TxStatusIdle
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.txStatus == 0 {
+		return TxStatusIdle
+	}
+	return c.txStatus
+}
+
+func (c *Connection) SetTxStatus(status byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.txStatus = status
+}
+
+// MySQLCapabilities returns the capability flags of the MySQL client.
+func (c *Connection) MySQLCapabilities() uint32 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mysqlCapabilities
+}
+
+// SetMySQLCapabilities records the capabilities of the MySQL client.
+func (c *Connection) SetMySQLCapabilities(capabilities uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mysqlCapabilities = capabilities
+}
+
+// SetMySQLPendingPrepare records the query of a COM_STMT_PREPARE that is
+// sent to the server. A nil query clears the pending statement, e.g. when
+// the COM_STMT_PREPARE is blocked and never reaches the server.
+func (c *Connection) SetMySQLPendingPrepare(query *string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mysqlPendingPrepare = query
+}
+
+// SetMySQLPendingExecute records the statement id of a COM_STMT_EXECUTE that
+// is waiting for the response of the server. A nil id clears it, e.g. if the
+// request is blocked.
+func (c *Connection) SetMySQLPendingExecute(statementID *uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mysqlPendingExecute = statementID
+}
+
+// MySQLCommandPhase returns true once the MySQL client has sent a command.
+func (c *Connection) MySQLCommandPhase() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mysqlCommandPhase
+}
+
+func (c *Connection) SetMySQLCommandPhase() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mysqlCommandPhase = true
+}
+
+// MySQLServerStatus returns the status flags of the MySQL server, which are
+// autocommit until the server reports otherwise.
+func (c *Connection) MySQLServerStatus() uint16 {
+	if c == nil {
+		return mysqlServerStatusAutocommit
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.mysqlServerStatusKnown {
+		return mysqlServerStatusAutocommit
+	}
+	return c.mysqlServerStatus
+}
+
+// MySQLResponse tracks the state of the connection from a response of the
+// server. The long data of the executed statement is discarded, just like
+// the server does, and the pending prepared statement is registered with the
+// statement id and parameter count of the response, or the status flags of
+// the OK and EOF packets of any other response are recorded. A failed prepare
+// only clears the pending statement.
+func (c *Connection) MySQLResponse(response []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.mysqlPendingExecute != nil {
+		if statement, ok := c.mysqlStatements[*c.mysqlPendingExecute]; ok {
+			statement.longData = nil
+		}
+		c.mysqlPendingExecute = nil
+	}
+	if c.mysqlPendingPrepare == nil {
+		if status, ok := mysqlServerStatus(response); ok {
+			c.mysqlServerStatus = status
+			c.mysqlServerStatusKnown = true
+		}
+		return
+	}
+
+	query := *c.mysqlPendingPrepare
+	c.mysqlPendingPrepare = nil
+	statementID, numParams, ok := mysqlPrepareResponse(response)
+	if !ok {
+		return
+	}
+	if c.mysqlStatements == nil {
+		c.mysqlStatements = map[uint32]*mysqlStatement{}
+	}
+	c.mysqlStatements[statementID] = &mysqlStatement{query: query, numParams: numParams}
+}
+
+// MySQLStatement returns a copy of the prepared statement with the given id,
+// or nil if it is unknown.
+func (c *Connection) MySQLStatement(statementID uint32) *mysqlStatement {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statement, ok := c.mysqlStatements[statementID]
+	if !ok {
+		return nil
+	}
+	copied := *statement
+	copied.longData = maps.Clone(statement.longData)
+	return &copied
+}
+
+// AppendMySQLLongData appends the data sent with COM_STMT_SEND_LONG_DATA to
+// the value of the parameter of the prepared statement, up to
+// MaxMySQLLongDataLength bytes.
+func (c *Connection) AppendMySQLLongData(statementID uint32, param int, data []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	statement, ok := c.mysqlStatements[statementID]
+	if !ok || param >= statement.numParams {
+		return
+	}
+	if statement.longData == nil {
+		statement.longData = map[int][]byte{}
+	}
+	value := statement.longData[param]
+	data = data[:min(len(data), max(MaxMySQLLongDataLength-len(value), 0))]
+	statement.longData[param] = append(value, data...)
+}
+
+// ResetMySQLLongData discards the long data of the prepared statement, on
+// COM_STMT_RESET.
+func (c *Connection) ResetMySQLLongData(statementID uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if statement, ok := c.mysqlStatements[statementID]; ok {
+		statement.longData = nil
+	}
+}
+
+// SetMySQLStatementTypes records the parameter types of the last execution
+// of the prepared statement.
+func (c *Connection) SetMySQLStatementTypes(statementID uint32, types []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if statement, ok := c.mysqlStatements[statementID]; ok {
+		statement.types = types
+	}
+}
+
+// CloseMySQLStatement forgets the prepared statement with the given id.
+func (c *Connection) CloseMySQLStatement(statementID uint32) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.mysqlStatements, statementID)
+}
+
+// SetPendingQuery records the query of the request of the client, which is
+// timed once it is sent to the server. A nil query clears the pending query,
+// e.g. if the request has no query.
+func (c *Connection) SetPendingQuery(query *TimedQuery) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pendingQuery = query
+}
+
+// SendPendingQuery records the time the pending query is sent to the server.
+func (c *Connection) SendPendingQuery(sentAt time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pendingQuery != nil && c.pendingQuery.SentAt.IsZero() {
+		c.pendingQuery.SentAt = sentAt
+	}
+}
+
+// TakePendingQuery returns and clears the pending query if it was sent to the
+// server, so that only the first response to the query is timed.
+func (c *Connection) TakePendingQuery() *TimedQuery {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	query := c.pendingQuery
+	if query == nil || query.SentAt.IsZero() {
+		return nil
+	}
+	c.pendingQuery = nil
+	return query
+}
+
+// ConnectionTracker keeps track of the state of client connections, keyed by
+// the remote address of the client.
+type ConnectionTracker struct {
+	mu          sync.Mutex
+	connections map[string]*Connection
+}
+
+// NewConnectionTracker returns a new ConnectionTracker.
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{
+		connections: map[string]*Connection{},
+	}
+}
+
+// Get returns the connection for the given key, creating it if needed.
+func (t *ConnectionTracker) Get(key string) *Connection {
+	if t == nil || key == "" {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.connections[key]
+	if !ok {
+		conn = &Connection{}
+		t.connections[key] = conn
+	}
+	return conn
+}
+
+// Remove forgets the connection for the given key.
+func (t *ConnectionTracker) Remove(key string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.connections, key)
+}
+
+// Len returns the number of tracked connections.
+func (t *ConnectionTracker) Len() int {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.connections)
+}
+
+// connectionKey returns the remote address of the client, as passed by
+// GatewayD to the traffic and connection hooks.
+func connectionKey(req *v1.Struct) string {
+	client := cast.ToStringMap(sdkPlugin.GetAttr(req, ClientField, nil))
+	return cast.ToString(client[RemoteField])
+}
+
+// connection returns the state of the client connection of the request.
+func (p *Plugin) connection(req *v1.Struct) *Connection {
+	return p.Connections.Get(connectionKey(req))
+}
@@ -4,27 +4,197 @@ import "time"
 
 const (
 	DefaultPredictionTimeout time.Duration = 10 * time.Second
+	DefaultVerdictCacheSize  int           = 10000
+	DefaultVerdictCacheTTL   time.Duration = time.Hour
+	AllowlistSaveInterval    time.Duration = 10 * time.Second
+
+	DefaultPredictionBatchMaxWait time.Duration = 2 * time.Millisecond
+
+	DefaultCircuitBreakerFailureThreshold int           = 5
+	DefaultCircuitBreakerOpenTimeout      time.Duration = 30 * time.Second
+
+	DefaultRiskScoreHalfLife time.Duration = 10 * time.Minute
+	DefaultBanDuration       time.Duration = time.Hour
+	BanExpireInterval        time.Duration = 10 * time.Second
+	MaxPendingUnbans         int           = 1000
+
+	DefaultRecentDetectionsSize int = 100
+
+	DefaultConfigReloadInterval time.Duration = 5 * time.Second
+
+	DefaultLatencyWindowSize int           = 20
+	DefaultLatencyMinDelay   time.Duration = time.Second
+	LatencySleepTolerance    time.Duration = 500 * time.Millisecond
+	LatencySleepMatches      int           = 2
+	LatencyMinSamples        int           = 6
+	LatencyMinClusterSize    int           = 2
+	LatencyBimodalRatio      float64       = 10
+	MaxLatencyGroups         int           = 10000
+	MaxLatencyValues         int           = 32
+	MaxNormalizeQueryLength  int           = 256 << 10
+	MaxInspectedStatements   int           = 100
+	MaxMySQLLongDataLength   int           = 1 << 20
 
 	DecodedQueryField string = "decodedQuery"
 	DetectorField     string = "detector"
 	QueryField        string = "query"
+	QueriesField      string = "queries"
 	ErrorField        string = "error"
 	IsInjectionField  string = "is_injection"
 	ResponseField     string = "response"
 	ConfidenceField   string = "confidence"
+	ConfidencesField  string = "confidences"
 	TokensField       string = "tokens"
 	StringField       string = "String"
 	ResponseTypeField string = "response_type"
+	RequestField      string = "request"
+	SourceField       string = "source"
+	SyncField         string = "sync"
+	ModeField         string = "mode"
+
+	ResultField        string = "result"
+	PolicyField        string = "policy"
+	OffenderField      string = "offender"
+	BannedUntilField   string = "banned_until"
+	UnbanAction        string = "unban"
+	FailurePolicyField string = "failure_policy"
+
+	PreparedStatementField string = "prepared_statement"
+	ParameterField         string = "parameter"
+	VariantField           string = "variant"
+	NormalizedQueryField   string = "normalized_query"
+	StatementField         string = "statement"
+	StatementsField        string = "statements"
+	RuleField              string = "rule"
+	RulesField             string = "rules"
+	DeniedField            string = "denied"
+	ActionField            string = "action"
+	LatencyField           string = "latency"
+	SleepValueField        string = "sleep_value"
+	FastLatencyField       string = "fast_latency"
+	SlowLatencyField       string = "slow_latency"
+	SamplesField           string = "samples"
+
+	ClientField string = "client"
+	RemoteField string = "remote"
+
+	UserField            string = "user"
+	DatabaseField        string = "database"
+	ApplicationNameField string = "application_name"
+	ClientAddressField   string = "client_address"
+
+	QuerySource string = "query"
+	ParseSource string = "parse"
+	BindSource  string = "bind"
+
+	RawVariant        string = "raw"
+	NormalizedVariant string = "normalized"
 
 	DeepLearningModel string = "deep_learning_model"
 	Libinjection      string = "libinjection"
+	SyntaxTree        string = "syntax_tree"
+	Denylist          string = "denylist"
+	LatencyAnalysis   string = "latency_analysis"
+	// StackedQueries is the detector of the verdicts of blocked stacked queries.
+	StackedQueries string = "stacked_queries"
+
+	PostgresProtocol string = "postgres"
+	MySQLProtocol    string = "mysql"
+
+	BanScopeClient string = "client"
+	BanScopeUser   string = "user"
+
+	ReloadSuccess string = "success"
+	ReloadFailure string = "failure"
+
+	ScanFormatLines  string = "lines"
+	ScanFormatJSONL  string = "jsonl"
+	ScanFormatCSVLog string = "csvlog"
+
+	DatasetFormatJSONL string = "jsonl"
+	DatasetFormatCSV   string = "csv"
+
+	DefaultSweepStep float64 = 0.05
+
+	ScanDetected    string = "detected"
+	ScanAllowlisted string = "allowlisted"
+	ScanFailed      string = "failed"
+	ScanClean       string = "clean"
+
+	PreventMode    string = "prevent"
+	DetectOnlyMode string = "detect-only"
+
+	PredictionBackendHTTP   string = "http"
+	PredictionBackendKServe string = "kserve"
+	PredictionBackendGRPC   string = "grpc"
+	DefaultModelName        string = "sqli_model"
+	DefaultModelInput       string = "query"
+
+	RuleTautology            string = "tautology"
+	RuleUnionNullPadding     string = "union_null_padding"
+	RuleOrderByProbing       string = "order_by_probing"
+	RuleConditionalTimeDelay string = "conditional_time_delay"
+	RuleCatalogSubquery      string = "catalog_subquery"
+	RuleSleepValueLatency    string = "sleep_value_latency"
+	RuleBimodalLatency       string = "bimodal_latency"
+
+	CommandCopyProgram     string = "copy_program"
+	CommandCopyFile        string = "copy_file"
+	CommandCreateExtension string = "create_extension"
+	CommandAlterSystem     string = "alter_system"
+	CommandLoad            string = "load"
+	CommandDo              string = "do"
+
+	CombineAny string = "any"
+	CombineAll string = "all"
+
+	FailureAllow    string = "allow"
+	FailureBlock    string = "block"
+	FailureFallback string = "libinjection"
+
+	DenylistOff   string = "off"
+	DenylistBlock string = "block"
+	DenylistFlag  string = "flag"
+
+	AllowlistOff     string = "off"
+	AllowlistLearn   string = "learn"
+	AllowlistEnforce string = "enforce"
+	AllowlistFile    string = "gatewayd-plugin-sql-ids-ips-allowlist.json"
+
+	ResponseType      string = "error"
+	EmptyResponseType string = "empty"
+	ErrorSeverity     string = "EXCEPTION"
+	FatalSeverity     string = "FATAL"
+	ErrorNumber       string = "42000"
+	ErrorMessage      string = "SQL injection detected"
+	ErrorDetail       string = "Back off, you're not welcome here."
+	LogLevel          string = "error"
+	// MySQLErrorCode is ER_UNKNOWN_ERROR, as MySQL has no error code for
+	// a rejected query.
+	MySQLErrorCode uint16 = 1105
+
+	PredictPath      string = "/predict"
+	PredictBatchPath string = "/predict/batch"
+
+	// Frontend message types of the PostgreSQL wire protocol.
+	QueryMessage    byte = 'Q'
+	ParseMessage    byte = 'P'
+	BindMessage     byte = 'B'
+	DescribeMessage byte = 'D'
+	ExecuteMessage  byte = 'E'
+	CloseMessage    byte = 'C'
+	SyncMessage     byte = 'S'
+	FlushMessage    byte = 'H'
+
+	// Backend message types of the PostgreSQL wire protocol.
+	ReadyForQueryMessage byte = 'Z'
 
-	ResponseType  string = "error"
-	ErrorSeverity string = "EXCEPTION"
-	ErrorNumber   string = "42000"
-	ErrorMessage  string = "SQL injection detected"
-	ErrorDetail   string = "Back off, you're not welcome here."
-	LogLevel      string = "error"
+	// Object types of the Describe and Close messages.
+	PreparedStatementObject byte = 'S'
+	PortalObject            byte = 'P'
 
-	PredictPath string = "/predict"
+	// Transaction status indicators of the ReadyForQuery message.
+	TxStatusIdle          byte = 'I'
+	TxStatusInTransaction byte = 'T'
+	TxStatusFailed        byte = 'E'
 )
@@ -0,0 +1,187 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	pganalyze "github.com/pganalyze/pg_query_go/v6"
+	pgQuery "github.com/wasilibs/go-pgquery"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// DefaultDenylistFunctions are the functions denied by default, which
+	// delay the query, access files and large objects, connect to other
+	// databases or terminate the connections of other clients.
+	DefaultDenylistFunctions = []string{
+		"pg_sleep", "pg_sleep_for", "pg_sleep_until",
+		"lo_import", "lo_export",
+		"pg_read_file", "pg_read_binary_file", "pg_ls_dir", "pg_stat_file",
+		"dblink", "dblink_exec", "dblink_connect",
+		"pg_terminate_backend", "pg_cancel_backend",
+	}
+	// DefaultDenylistCommands are the commands denied by default, which run
+	// programs on the server, load code or change the server config. The
+	// PL/pgSQL bodies of DO are not parsed, and may build their statements
+	// dynamically, so DO is denied as a whole, as it could call any denied
+	// function.
+	DefaultDenylistCommands = []string{
+		CommandCopyProgram, CommandCreateExtension, CommandAlterSystem, CommandDo,
+	}
+	// DefaultDenylistObjects are the relations denied by default, which hold
+	// the password hashes of the roles.
+	DefaultDenylistObjects = []string{"pg_authid", "pg_shadow"}
+)
+
+// DenylistCommands are the commands that can be denied.
+var DenylistCommands = []string{
+	CommandCopyProgram,
+	CommandCopyFile,
+	CommandCreateExtension,
+	CommandAlterSystem,
+	CommandLoad,
+	CommandDo,
+}
+
+// DenylistDetector parses the query with the PostgreSQL grammar and flags the
+// statements that call a denied function, run a denied command or refer to a
+// denied relation, e.g. pg_read_file(), COPY ... PROGRAM or pg_authid, as
+// these are the primitives of attacks on PostgreSQL, whether injected or not.
+// The queries of the exempt users, e.g. DBAs, are never flagged. The denylist
+// is a policy check rather than one of the detectors of the pipeline, so that
+// neither the combination of the detectors nor the failure policy of the
+// prediction API can turn it off.
+type DenylistDetector struct {
+	// Functions and Objects are names, optionally qualified by the schema,
+	// e.g. pg_sleep or pg_catalog.pg_authid, and Commands are
+	// DenylistCommands. The names are matched ignoring the case.
+	Functions   []string
+	Commands    []string
+	Objects     []string
+	ExemptUsers []string
+	Logger      hclog.Logger
+}
+
+var _ Detector = (*DenylistDetector)(nil)
+
+func (d *DenylistDetector) Name() string {
+	return Denylist
+}
+
+func (d *DenylistDetector) Inspect(ctx context.Context, query string) (*Verdict, error) {
+	verdict := &Verdict{Detector: Denylist}
+	if session, ok := SessionFromContext(ctx); ok && slices.Contains(d.ExemptUsers, session.User) {
+		d.Logger.Trace("User is exempt from the denylist", UserField, session.User)
+		return verdict, nil
+	}
+
+	denied, err := d.Match(query)
+	if err != nil {
+		d.Logger.Trace("Failed to parse query", ErrorField, err)
+	}
+	if len(denied) > 0 {
+		verdict.Injection = true
+		verdict.Score = 1
+		verdict.Evidence = map[string]any{
+			DeniedField: denied,
+		}
+	}
+	return verdict, nil
+}
+
+// Match parses the query and returns the denied functions, commands and
+// objects of its statements, in the order they appear.
+func (d *DenylistDetector) Match(query string) ([]string, error) {
+	tree, err := pgQuery.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var denied []string
+	deny := func(entries []string, names ...string) {
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+			for _, entry := range entries {
+				if strings.EqualFold(entry, name) && !slices.Contains(denied, entry) {
+					denied = append(denied, entry)
+				}
+			}
+		}
+	}
+	for _, statement := range tree.GetStmts() {
+		walkSyntaxTree(statement.GetStmt().ProtoReflect(), nil, func(node proto.Message, _ []syntaxAncestor) {
+			switch node := node.(type) {
+			case *pganalyze.FuncCall:
+				deny(d.Functions, qualifiedNames(node.GetFuncname())...)
+			case *pganalyze.RangeVar:
+				qualified := ""
+				if node.GetSchemaname() != "" {
+					qualified = node.GetSchemaname() + "." + node.GetRelname()
+				}
+				deny(d.Objects, node.GetRelname(), qualified)
+			case *pganalyze.CopyStmt:
+				if node.GetIsProgram() {
+					deny(d.Commands, CommandCopyProgram)
+				} else if node.GetFilename() != "" {
+					deny(d.Commands, CommandCopyFile)
+				}
+			case *pganalyze.CreateExtensionStmt:
+				deny(d.Commands, CommandCreateExtension)
+			case *pganalyze.AlterSystemStmt:
+				deny(d.Commands, CommandAlterSystem)
+			case *pganalyze.LoadStmt:
+				deny(d.Commands, CommandLoad)
+			case *pganalyze.DoStmt:
+				deny(d.Commands, CommandDo)
+			}
+		})
+	}
+	return denied, nil
+}
+
+// denylist returns the denylist of the plugin, or nil if it is disabled. The
+// grammar is the grammar of PostgreSQL.
+func (p *Plugin) denylist() *DenylistDetector {
+	if p.DenylistAction == "" || p.DenylistAction == DenylistOff || p.Protocol == MySQLProtocol {
+		return nil
+	}
+	return &DenylistDetector{
+		Functions:   p.DenylistFunctions,
+		Commands:    p.DenylistCommands,
+		Objects:     p.DenylistObjects,
+		ExemptUsers: p.DenylistExemptUsers,
+		Logger:      p.Logger,
+	}
+}
+
+// checkDenylist returns the verdict of the denylist on the query, or nil if
+// the query is not denied. Bound parameters are values rather than SQL, so
+// they are never checked.
+func (p *Plugin) checkDenylist(ctx context.Context, query *clientQuery) *Verdict {
+	denylist := p.denylist()
+	if denylist == nil || query.source == BindSource {
+		return nil
+	}
+	verdict, err := denylist.Inspect(ctx, query.text)
+	if err != nil || !verdict.Injection {
+		return nil
+	}
+	return verdict
+}
+
+// qualifiedNames returns the name of a possibly qualified name, e.g. of a
+// function, and the qualified name, if it is qualified.
+func qualifiedNames(nodes []*pganalyze.Node) []string {
+	parts := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		parts = append(parts, node.GetString_().GetSval())
+	}
+	if len(parts) < 2 {
+		return parts
+	}
+	return []string{parts[len(parts)-1], strings.Join(parts, ".")}
+}
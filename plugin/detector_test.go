@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubDetector struct {
+	name      string
+	injection bool
+	err       error
+	calls     int
+}
+
+func (d *stubDetector) Name() string {
+	return d.name
+}
+
+func (d *stubDetector) Inspect(context.Context, string) (*Verdict, error) {
+	d.calls++
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &Verdict{Detector: d.name, Injection: d.injection}, nil
+}
+
+func Test_PipelineAny(t *testing.T) {
+	first := &stubDetector{name: "first"}
+	second := &stubDetector{name: "second", injection: true}
+	third := &stubDetector{name: "third", injection: true}
+	pipeline := &Pipeline{
+		Detectors: []Detector{first, second, third},
+		Logger:    hclog.NewNullLogger(),
+	}
+
+	result := pipeline.Run(context.Background(), "SELECT 1")
+	assert.True(t, result.Detected)
+	require.NotNil(t, result.Verdict())
+	assert.Equal(t, "second", result.Verdict().Detector)
+	// The pipeline stops at the first detection.
+	assert.Equal(t, 0, third.calls)
+}
+
+func Test_PipelineAll(t *testing.T) {
+	first := &stubDetector{name: "first", injection: true}
+	second := &stubDetector{name: "second"}
+	pipeline := &Pipeline{
+		Detectors:   []Detector{first, second},
+		Combination: CombineAll,
+		Logger:      hclog.NewNullLogger(),
+	}
+
+	result := pipeline.Run(context.Background(), "SELECT 1")
+	assert.False(t, result.Detected)
+	assert.Nil(t, result.Verdict())
+
+	second.injection = true
+	result = pipeline.Run(context.Background(), "SELECT 1")
+	assert.True(t, result.Detected)
+	assert.Equal(t, "first", result.Verdict().Detector)
+}
+
+func Test_PipelineDetectorError(t *testing.T) {
+	failing := &stubDetector{name: "failing", err: errors.New("unavailable")}
+	next := &stubDetector{name: "next", injection: true}
+	pipeline := &Pipeline{
+		Detectors: []Detector{failing, next},
+		Logger:    hclog.NewNullLogger(),
+	}
+
+	result := pipeline.Run(context.Background(), "SELECT 1")
+	assert.True(t, result.Detected)
+	assert.Equal(t, "next", result.Verdict().Detector)
+	require.Len(t, result.Errors, 1)
+	assert.ErrorContains(t, result.Errors[0], "failing: unavailable")
+}
+
+func Test_RegisterDetector(t *testing.T) {
+	custom := &stubDetector{name: "custom", injection: true}
+	RegisterDetector("custom", func(*Plugin) Detector { return custom })
+
+	p := &Plugin{
+		Logger:             hclog.NewNullLogger(),
+		EnableLibinjection: true,
+		Detectors:          []string{"custom", "unknown", Libinjection},
+	}
+	pipeline := p.pipeline()
+	require.Len(t, pipeline.Detectors, 2)
+	assert.Equal(t, "custom", pipeline.Detectors[0].Name())
+	assert.Equal(t, Libinjection, pipeline.Detectors[1].Name())
+}
+
+func Test_PipelineFailurePolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		detected bool
+		detector string
+		calls    int
+	}{
+		{policy: FailureAllow, detected: false, calls: 0},
+		{policy: FailureBlock, detected: true, detector: DeepLearningModel, calls: 0},
+		{policy: FailureFallback, detected: true, detector: "next", calls: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			failing := &stubDetector{name: DeepLearningModel, err: ErrCircuitOpen}
+			next := &stubDetector{name: "next", injection: true}
+			pipeline := &Pipeline{
+				Detectors:     []Detector{failing, next},
+				FailurePolicy: test.policy,
+				Logger:        hclog.NewNullLogger(),
+			}
+
+			result := pipeline.Run(context.Background(), "SELECT 1")
+			assert.Equal(t, test.detected, result.Detected)
+			if test.detected {
+				assert.Equal(t, test.detector, result.Verdict().Detector)
+			}
+			assert.Equal(t, test.calls, next.calls)
+			assert.Len(t, result.Errors, 1)
+
+			// The policy only applies to the failures of the prediction API.
+			failing.name = Libinjection
+			result = pipeline.Run(context.Background(), "SELECT 1")
+			assert.True(t, result.Detected)
+			assert.Equal(t, "next", result.Verdict().Detector)
+			assert.Len(t, result.Errors, 1)
+		})
+	}
+
+	// With CombineAll, the remaining detectors decide if another detector fails.
+	failing := &stubDetector{name: SyntaxTree, err: errors.New("failed")}
+	next := &stubDetector{name: "next", injection: true}
+	pipeline := &Pipeline{
+		Detectors:     []Detector{failing, next},
+		Combination:   CombineAll,
+		FailurePolicy: FailureAllow,
+		Logger:        hclog.NewNullLogger(),
+	}
+	result := pipeline.Run(context.Background(), "SELECT 1")
+	assert.True(t, result.Detected)
+	assert.Equal(t, 1, next.calls)
+}
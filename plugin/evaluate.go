@@ -0,0 +1,510 @@
+package plugin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cast"
+)
+
+// LabeledQuery is a query of a labeled dataset, i.e. a query that is known to
+// be an injection or not.
+type LabeledQuery struct {
+	ScanQuery
+	Injection bool
+}
+
+// labeledRecord is a query of a JSONL dataset.
+type labeledRecord struct {
+	scanRecord
+	IsInjection any `json:"is_injection"`
+}
+
+// DatasetFormatOf returns the format of a labeled dataset by its file
+// extension, defaulting to JSONL.
+func DatasetFormatOf(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return DatasetFormatCSV
+	}
+	return DatasetFormatJSONL
+}
+
+// ReadLabeledQueries reads the queries of a labeled dataset in the given format,
+// and calls fn with each query. Reading stops at the first error.
+func ReadLabeledQueries(reader io.Reader, format string, fn func(LabeledQuery) error) error {
+	switch format {
+	case DatasetFormatJSONL:
+		return readScanLines(reader, func(line int, text string) error {
+			var record labeledRecord
+			if err := json.Unmarshal([]byte(text), &record); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			query, err := record.labeledQuery(line)
+			if err != nil {
+				return err
+			}
+			return fn(query)
+		})
+	case DatasetFormatCSV:
+		return readLabeledCSV(reader, fn)
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+func (r *labeledRecord) labeledQuery(line int) (LabeledQuery, error) {
+	if r.Query == "" {
+		return LabeledQuery{}, fmt.Errorf("line %d: query is required", line)
+	}
+	injection, err := cast.ToBoolE(r.IsInjection)
+	if r.IsInjection == nil || err != nil {
+		return LabeledQuery{}, fmt.Errorf(
+			"line %d: is_injection must be a boolean, 0 or 1: %v", line, r.IsInjection)
+	}
+
+	return LabeledQuery{
+		ScanQuery: ScanQuery{
+			Line: line,
+			Text: r.Query,
+			Session: Session{
+				User:            r.User,
+				Database:        r.Database,
+				ApplicationName: r.ApplicationName,
+				ClientAddress:   r.ClientAddress,
+			},
+		},
+		Injection: injection,
+	}, nil
+}
+
+// readLabeledCSV reads a CSV dataset with a header, which names the columns
+// of the query and the label, i.e. is_injection or label, and optionally the
+// columns of the session.
+func readLabeledCSV(reader io.Reader, fn func(LabeledQuery) error) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header: %w", err)
+	}
+
+	columns := map[string]int{}
+	for idx, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = idx
+	}
+	if _, ok := columns[IsInjectionField]; !ok {
+		if idx, ok := columns["label"]; ok {
+			columns[IsInjectionField] = idx
+		}
+	}
+	for _, required := range []string{QueryField, IsInjectionField} {
+		if _, ok := columns[required]; !ok {
+			return fmt.Errorf("header must have a %s column", required)
+		}
+	}
+
+	for {
+		row, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		column := func(name string) string {
+			if idx, ok := columns[name]; ok && idx < len(row) {
+				return row[idx]
+			}
+			return ""
+		}
+		line, _ := csvReader.FieldPos(0)
+		record := labeledRecord{
+			scanRecord: scanRecord{
+				Query:           column(QueryField),
+				User:            column(UserField),
+				Database:        column(DatabaseField),
+				ApplicationName: column(ApplicationNameField),
+				ClientAddress:   column(ClientAddressField),
+			},
+			IsInjection: strings.TrimSpace(column(IsInjectionField)),
+		}
+		query, err := record.labeledQuery(line)
+		if err != nil {
+			return err
+		}
+		if err := fn(query); err != nil {
+			return err
+		}
+	}
+}
+
+// ConfusionMatrix counts the decisions on labeled queries.
+type ConfusionMatrix struct {
+	TruePositives  int `json:"true_positives"`
+	FalsePositives int `json:"false_positives"`
+	TrueNegatives  int `json:"true_negatives"`
+	FalseNegatives int `json:"false_negatives"`
+}
+
+// Add counts a decision on a query.
+func (m *ConfusionMatrix) Add(detected, injection bool) {
+	switch {
+	case detected && injection:
+		m.TruePositives++
+	case detected:
+		m.FalsePositives++
+	case injection:
+		m.FalseNegatives++
+	default:
+		m.TrueNegatives++
+	}
+}
+
+// Metrics returns the metrics of the matrix. A metric is zero if it is
+// undefined, e.g. the precision if nothing was detected.
+func (m ConfusionMatrix) Metrics() Metrics {
+	metrics := Metrics{
+		ConfusionMatrix:   m,
+		Precision:         ratio(m.TruePositives, m.TruePositives+m.FalsePositives),
+		Recall:            ratio(m.TruePositives, m.TruePositives+m.FalseNegatives),
+		Accuracy:          ratio(m.TruePositives+m.TrueNegatives, m.total()),
+		FalsePositiveRate: ratio(m.FalsePositives, m.FalsePositives+m.TrueNegatives),
+	}
+	if metrics.Precision+metrics.Recall > 0 {
+		metrics.F1 = 2 * metrics.Precision * metrics.Recall / (metrics.Precision + metrics.Recall)
+	}
+	return metrics
+}
+
+func (m ConfusionMatrix) total() int {
+	return m.TruePositives + m.FalsePositives + m.TrueNegatives + m.FalseNegatives
+}
+
+func ratio(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+// Metrics are the accuracy metrics of the decisions of a confusion matrix.
+type Metrics struct {
+	ConfusionMatrix
+	Precision         float64 `json:"precision"`
+	Recall            float64 `json:"recall"`
+	F1                float64 `json:"f1"`
+	Accuracy          float64 `json:"accuracy"`
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+}
+
+// scoreSample is the score of a detector for a labeled query.
+type scoreSample struct {
+	score     float32
+	injection bool
+}
+
+// DetectorEvaluation counts the decisions of a detector on its own, and keeps
+// its scores for the threshold sweep.
+type DetectorEvaluation struct {
+	Matrix ConfusionMatrix
+	// Errors counts the queries the detector failed to inspect, which are not
+	// counted in the matrix.
+	Errors  int
+	samples []scoreSample
+}
+
+func (e *DetectorEvaluation) add(verdict *Verdict, err error, injection bool) {
+	if err != nil {
+		e.Errors++
+		return
+	}
+	e.Matrix.Add(verdict.Injection, injection)
+	e.samples = append(e.samples, scoreSample{score: verdict.Score, injection: injection})
+}
+
+// Sweep returns the metrics of the detector if it flagged the queries with a
+// score of at least the threshold, for the thresholds from 0 to 1 in steps.
+func (e *DetectorEvaluation) Sweep(step float64) []SweepPoint {
+	if step <= 0 {
+		return nil
+	}
+
+	var points []SweepPoint
+	steps := int(math.Round(1 / step))
+	for idx := 0; idx <= steps; idx++ {
+		threshold := math.Min(math.Round(float64(idx)*step*1e6)/1e6, 1)
+		var matrix ConfusionMatrix
+		for _, sample := range e.samples {
+			// The scores are compared like the detectors compare them.
+			matrix.Add(sample.score >= float32(threshold), sample.injection)
+		}
+		points = append(points, SweepPoint{Threshold: threshold, Metrics: matrix.Metrics()})
+	}
+	return points
+}
+
+// AUC returns the area under the ROC curve of the scores, i.e. the probability
+// that an injection scores higher than a legitimate query, counting ties as
+// half. It is zero if the dataset lacks either class.
+func (e *DetectorEvaluation) AUC() float64 {
+	samples := slices.Clone(e.samples)
+	slices.SortFunc(samples, func(a, b scoreSample) int {
+		switch {
+		case a.score < b.score:
+			return -1
+		case a.score > b.score:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	// Count the pairs of legitimate queries and injections ranked correctly,
+	// group by group of equal scores.
+	var negatives, positives int
+	var correct float64
+	for start := 0; start < len(samples); {
+		end := start
+		var groupNegatives, groupPositives int
+		for ; end < len(samples) && samples[end].score == samples[start].score; end++ {
+			if samples[end].injection {
+				groupPositives++
+			} else {
+				groupNegatives++
+			}
+		}
+		correct += float64(groupPositives) * (float64(negatives) + float64(groupNegatives)/2)
+		negatives += groupNegatives
+		positives += groupPositives
+		start = end
+	}
+
+	if negatives == 0 || positives == 0 {
+		return 0
+	}
+	return correct / (float64(negatives) * float64(positives))
+}
+
+// SweepPoint is the metrics of a detector at a threshold.
+type SweepPoint struct {
+	Threshold float64 `json:"threshold"`
+	Metrics
+}
+
+// Evaluation measures the accuracy of the detectors, and of the combined
+// decision of the plugin, on a labeled dataset.
+type Evaluation struct {
+	Queries     int
+	Injections  int
+	Allowlisted int
+	// Combined counts the decisions of the plugin, i.e. of the detectors as
+	// combined and configured, including the allowlists and policies.
+	Combined  ConfusionMatrix
+	Detectors map[string]*DetectorEvaluation
+	// order is the order in which the detectors were first run.
+	order []string
+}
+
+// NewEvaluation returns an empty evaluation.
+func NewEvaluation() *Evaluation {
+	return &Evaluation{Detectors: map[string]*DetectorEvaluation{}}
+}
+
+// Add evaluates the plugin on a labeled query. Every detector inspects the
+// query on its own, even if the query is allowlisted, and the pipeline of the
+// plugin combines their verdicts, so that no detector inspects a query twice.
+// If the queries are normalized or contain several statements, a detector is
+// evaluated on the verdict of the normalized query or statement if it detects
+// only that one.
+func (e *Evaluation) Add(ctx context.Context, p *Plugin, query LabeledQuery) {
+	p = p.current()
+	ctx = WithSession(ctx, query.Session)
+	effective, _ := p.withPolicy(query.Session)
+	pipeline := effective.pipeline()
+
+	inspected := &clientQuery{source: QuerySource, text: query.Text}
+	texts := []string{query.Text}
+	// A query with more statements than can be inspected is blocked without
+	// inspecting its statements.
+	if statements := effective.statements(inspected); len(statements) > 1 &&
+		len(statements) <= MaxInspectedStatements {
+		texts = append(texts, statements...)
+	}
+	var variants []string
+	for _, text := range texts {
+		variants = append(variants, text)
+		if effective.NormalizeQueries && effective.Protocol != MySQLProtocol {
+			if normalized := effective.normalize(text); normalized != "" {
+				variants = append(variants, normalized)
+			}
+		}
+	}
+
+	replay := *pipeline
+	replay.Detectors = make([]Detector, 0, len(pipeline.Detectors))
+	for _, detector := range pipeline.Detectors {
+		replayed := &replayDetector{name: detector.Name(), verdicts: map[string]replayedVerdict{}}
+		for idx, variant := range variants {
+			verdict, err := detector.Inspect(ctx, variant)
+			replayed.verdicts[variant] = replayedVerdict{verdict: verdict, err: err}
+			if idx == 0 || (verdict != nil && verdict.Injection) {
+				replayed.verdict, replayed.err = verdict, err
+			}
+			if verdict != nil && verdict.Injection {
+				break
+			}
+		}
+		e.detector(detector.Name()).add(replayed.verdict, replayed.err, query.Injection)
+		replay.Detectors = append(replay.Detectors, replayed)
+	}
+
+	result := effective.inspect(ctx, &replay, inspected)
+	e.Queries++
+	if query.Injection {
+		e.Injections++
+	}
+	if result.Allowlisted {
+		e.Allowlisted++
+	}
+	e.Combined.Add(result.Detected, query.Injection)
+}
+
+func (e *Evaluation) detector(name string) *DetectorEvaluation {
+	evaluation, ok := e.Detectors[name]
+	if !ok {
+		evaluation = &DetectorEvaluation{}
+		e.Detectors[name] = evaluation
+		e.order = append(e.order, name)
+	}
+	return evaluation
+}
+
+// replayDetector returns the recorded verdicts of a detector for the variants
+// of a query. The verdict is the one the detector is evaluated on.
+type replayDetector struct {
+	name     string
+	verdicts map[string]replayedVerdict
+	verdict  *Verdict
+	err      error
+}
+
+type replayedVerdict struct {
+	verdict *Verdict
+	err     error
+}
+
+func (d *replayDetector) Name() string {
+	return d.name
+}
+
+func (d *replayDetector) Inspect(_ context.Context, query string) (*Verdict, error) {
+	replayed, ok := d.verdicts[query]
+	if !ok {
+		// The variant wasn't inspected, as the detector detected an earlier one.
+		return d.verdict, d.err
+	}
+	return replayed.verdict, replayed.err
+}
+
+// EvaluationReport is the outcome of an evaluation.
+type EvaluationReport struct {
+	Queries     int              `json:"queries"`
+	Injections  int              `json:"injections"`
+	Allowlisted int              `json:"allowlisted"`
+	Combined    Metrics          `json:"combined"`
+	Detectors   []DetectorReport `json:"detectors"`
+}
+
+// DetectorReport is the outcome of the evaluation of a detector.
+type DetectorReport struct {
+	Name string `json:"name"`
+	Metrics
+	Errors int          `json:"errors"`
+	AUC    float64      `json:"auc"`
+	Sweep  []SweepPoint `json:"sweep,omitempty"`
+}
+
+// Report returns the outcome of the evaluation, with a threshold sweep of the
+// given step per detector. A step of zero omits the sweeps.
+func (e *Evaluation) Report(step float64) *EvaluationReport {
+	report := &EvaluationReport{
+		Queries:     e.Queries,
+		Injections:  e.Injections,
+		Allowlisted: e.Allowlisted,
+		Combined:    e.Combined.Metrics(),
+		Detectors:   []DetectorReport{},
+	}
+	for _, name := range e.order {
+		detector := e.Detectors[name]
+		report.Detectors = append(report.Detectors, DetectorReport{
+			Name:    name,
+			Metrics: detector.Matrix.Metrics(),
+			Errors:  detector.Errors,
+			AUC:     detector.AUC(),
+			Sweep:   detector.Sweep(step),
+		})
+	}
+	return report
+}
+
+// Write writes the report as tables.
+func (r *EvaluationReport) Write(writer io.Writer) error {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Queries\t%d\n", r.Queries)
+	fmt.Fprintf(table, "Injections\t%d\n", r.Injections)
+	fmt.Fprintf(table, "Allowlisted\t%d\n", r.Allowlisted)
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(writer)
+	table = tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "Decision\tTP\tFP\tTN\tFN\tPrecision\tRecall\tF1\tAccuracy\tFPR\tErrors\tAUC")
+	writeMetricsRow(table, "combined", r.Combined)
+	fmt.Fprintln(table, "\t-\t-")
+	for _, detector := range r.Detectors {
+		writeMetricsRow(table, detector.Name, detector.Metrics)
+		fmt.Fprintf(table, "\t%d\t%.4f\n", detector.Errors, detector.AUC)
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	for _, detector := range r.Detectors {
+		if len(detector.Sweep) == 0 {
+			continue
+		}
+		fmt.Fprintf(writer, "\nThreshold sweep of %s\n", detector.Name)
+		table = tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "Threshold\tTP\tFP\tTN\tFN\tPrecision\tRecall\tF1\tAccuracy\tFPR")
+		for _, point := range detector.Sweep {
+			writeMetricsRow(table, strconv.FormatFloat(point.Threshold, 'f', 2, 64), point.Metrics)
+			fmt.Fprintln(table)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMetricsRow writes the cells of the metrics, leaving the row open.
+func writeMetricsRow(writer io.Writer, name string, metrics Metrics) {
+	fmt.Fprintf(writer, "%s\t%d\t%d\t%d\t%d\t%.4f\t%.4f\t%.4f\t%.4f\t%.4f",
+		name,
+		metrics.TruePositives, metrics.FalsePositives,
+		metrics.TrueNegatives, metrics.FalseNegatives,
+		metrics.Precision, metrics.Recall, metrics.F1,
+		metrics.Accuracy, metrics.FalsePositiveRate)
+}
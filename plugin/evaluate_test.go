@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readLabeledQueries(t *testing.T, dataset, format string) []LabeledQuery {
+	t.Helper()
+
+	var queries []LabeledQuery
+	require.NoError(t, ReadLabeledQueries(strings.NewReader(dataset), format, func(query LabeledQuery) error {
+		queries = append(queries, query)
+		return nil
+	}))
+	return queries
+}
+
+func Test_ReadLabeledQueriesJSONL(t *testing.T) {
+	queries := readLabeledQueries(t, `{"query": "SELECT 1", "is_injection": false}
+{"query": "' OR 1=1 --", "is_injection": 1, "user": "alice"}
+`, DatasetFormatJSONL)
+	require.Len(t, queries, 2)
+	assert.False(t, queries[0].Injection)
+	assert.True(t, queries[1].Injection)
+	assert.Equal(t, 2, queries[1].Line)
+	assert.Equal(t, "alice", queries[1].Session.User)
+
+	err := ReadLabeledQueries(strings.NewReader(`{"query": "SELECT 1"}`), DatasetFormatJSONL,
+		func(LabeledQuery) error { return nil })
+	require.EqualError(t, err, "line 1: is_injection must be a boolean, 0 or 1: <nil>")
+}
+
+func Test_ReadLabeledQueriesCSV(t *testing.T) {
+	queries := readLabeledQueries(t, `Query,Label
+SELECT 1,0
+"' OR 1=1 --",1
+`, DatasetFormatCSV)
+	require.Len(t, queries, 2)
+	assert.Equal(t, "SELECT 1", queries[0].Text)
+	assert.False(t, queries[0].Injection)
+	assert.Equal(t, "' OR 1=1 --", queries[1].Text)
+	assert.True(t, queries[1].Injection)
+	assert.Equal(t, 3, queries[1].Line)
+
+	err := ReadLabeledQueries(strings.NewReader("text,label\n"), DatasetFormatCSV,
+		func(LabeledQuery) error { return nil })
+	require.EqualError(t, err, "header must have a query column")
+
+	err = ReadLabeledQueries(strings.NewReader("query,label\nSELECT 1,maybe\n"), DatasetFormatCSV,
+		func(LabeledQuery) error { return nil })
+	require.EqualError(t, err, "line 2: is_injection must be a boolean, 0 or 1: maybe")
+}
+
+func Test_ConfusionMatrixMetrics(t *testing.T) {
+	matrix := ConfusionMatrix{TruePositives: 8, FalsePositives: 2, TrueNegatives: 85, FalseNegatives: 5}
+	metrics := matrix.Metrics()
+	assert.InDelta(t, 0.8, metrics.Precision, 0.0001)
+	assert.InDelta(t, 8.0/13, metrics.Recall, 0.0001)
+	assert.InDelta(t, 2*0.8*(8.0/13)/(0.8+8.0/13), metrics.F1, 0.0001)
+	assert.InDelta(t, 0.93, metrics.Accuracy, 0.0001)
+	assert.InDelta(t, 2.0/87, metrics.FalsePositiveRate, 0.0001)
+
+	assert.Equal(t, Metrics{}, ConfusionMatrix{}.Metrics())
+}
+
+func Test_DetectorEvaluationSweep(t *testing.T) {
+	evaluation := &DetectorEvaluation{}
+	for _, sample := range []struct {
+		score     float32
+		injection bool
+	}{
+		{0.1, false}, {0.4, false}, {0.7, false}, {0.6, true}, {0.9, true}, {0.7, true},
+	} {
+		evaluation.add(&Verdict{Score: sample.score, Injection: sample.score >= 0.5}, nil, sample.injection)
+	}
+	evaluation.add(nil, context.DeadlineExceeded, true)
+
+	assert.Equal(t, 1, evaluation.Errors)
+	assert.Equal(t, ConfusionMatrix{TruePositives: 3, FalsePositives: 1, TrueNegatives: 2},
+		evaluation.Matrix)
+	// 7 of the 9 pairs are ranked correctly, and one is a tie.
+	assert.InDelta(t, 7.5/9, evaluation.AUC(), 0.0001)
+
+	sweep := evaluation.Sweep(0.1)
+	require.Len(t, sweep, 11)
+	assert.InDelta(t, 0.0, sweep[0].Threshold, 0.0001)
+	assert.Equal(t, ConfusionMatrix{TruePositives: 3, FalsePositives: 3}, sweep[0].ConfusionMatrix)
+	assert.InDelta(t, 0.7, sweep[7].Threshold, 0.0001)
+	assert.Equal(t, ConfusionMatrix{TruePositives: 2, FalsePositives: 1, TrueNegatives: 2, FalseNegatives: 1},
+		sweep[7].ConfusionMatrix)
+	assert.Equal(t, ConfusionMatrix{TrueNegatives: 3, FalseNegatives: 3}, sweep[10].ConfusionMatrix)
+	assert.Nil(t, evaluation.Sweep(0))
+}
+
+func Test_EvaluationAdd(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+	failing := &stubDetector{name: "failing", err: context.DeadlineExceeded}
+	RegisterDetector("failing", func(*Plugin) Detector { return failing })
+
+	allowlist, err := NewAllowlist(AllowlistEnforce, "", 0)
+	require.NoError(t, err)
+	require.NoError(t, allowlist.Add("SELECT * FROM users WHERE id = 1 OR id = 2"))
+	p := &Plugin{
+		Logger:              hclog.NewNullLogger(),
+		Detectors:           []string{"failing", "keyword"},
+		OnPredictionFailure: FailureFallback,
+		Allowlist:           allowlist,
+	}
+
+	evaluation := NewEvaluation()
+	for _, query := range []LabeledQuery{
+		{ScanQuery: ScanQuery{Text: "SELECT 1 OR 1=1"}, Injection: true},
+		{ScanQuery: ScanQuery{Text: "SELECT * FROM users WHERE id = 3 OR id = 4"}, Injection: false},
+		{ScanQuery: ScanQuery{Text: "SELECT 1"}, Injection: true},
+	} {
+		evaluation.Add(context.Background(), p, query)
+	}
+
+	// Every detector inspects a query once, even if the pipeline replays it.
+	assert.Equal(t, 3, failing.calls)
+	assert.Equal(t, 3, evaluation.Queries)
+	assert.Equal(t, 2, evaluation.Injections)
+	assert.Equal(t, 1, evaluation.Allowlisted)
+	assert.Equal(t, ConfusionMatrix{TruePositives: 1, TrueNegatives: 1, FalseNegatives: 1},
+		evaluation.Combined)
+	// The keyword detector flags the allowlisted query on its own.
+	assert.Equal(t, ConfusionMatrix{TruePositives: 1, FalsePositives: 1, FalseNegatives: 1},
+		evaluation.Detectors["keyword"].Matrix)
+	assert.Equal(t, 3, evaluation.Detectors["failing"].Errors)
+
+	report := evaluation.Report(0.5)
+	require.Len(t, report.Detectors, 2)
+	assert.Equal(t, "failing", report.Detectors[0].Name)
+	assert.Len(t, report.Detectors[1].Sweep, 3)
+
+	var output bytes.Buffer
+	require.NoError(t, report.Write(&output))
+	assert.Contains(t, output.String(), "Threshold sweep of keyword")
+}
@@ -0,0 +1,320 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ModelInferMethod is the inference method of the gRPC API of the KServe v2
+// inference protocol.
+const ModelInferMethod = "/inference.GRPCInferenceService/ModelInfer"
+
+// Field numbers of the messages of the KServe v2 inference protocol, see
+// https://github.com/kserve/open-inference-protocol. The messages are encoded
+// by hand, as only a few of their fields are used.
+const (
+	inferRequestModelName   protowire.Number = 1
+	inferRequestInputs      protowire.Number = 5
+	inferRequestOutputs     protowire.Number = 6
+	inferResponseOutputs    protowire.Number = 5
+	inferResponseRawOutputs protowire.Number = 6
+	inferTensorName         protowire.Number = 1
+	inferTensorDatatype     protowire.Number = 2
+	inferTensorShape        protowire.Number = 3
+	inferTensorContents     protowire.Number = 5
+	inferContentsFP32       protowire.Number = 6
+	inferContentsFP64       protowire.Number = 7
+	inferContentsBytes      protowire.Number = 8
+)
+
+// ErrBackendClosed is returned for the predictions of a closed backend.
+var ErrBackendClosed = errors.New("prediction backend is closed")
+
+// KServeGRPCBackend sends the queries to the model as a BYTES input tensor of
+// shape [n, 1], using the gRPC API of the KServe v2 inference protocol. The
+// connection is opened on the first prediction, without TLS, and closed by
+// Close when the plugin shuts down.
+type KServeGRPCBackend struct {
+	Address string
+	Model   string
+	Input   string
+	Output  string
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	err    error
+	closed bool
+}
+
+var _ PredictionBackend = (*KServeGRPCBackend)(nil)
+
+func (b *KServeGRPCBackend) Predict(ctx context.Context, queries []string) ([]float32, error) {
+	conn, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	request := rawMessage(encodeInferRequest(b.Model, b.Input, b.Output, queries))
+	var response rawMessage
+	if err := conn.Invoke(ctx, ModelInferMethod, &request, &response,
+		grpc.ForceCodec(rawCodec{})); err != nil {
+		return nil, fmt.Errorf("failed to call inference API: %w", err)
+	}
+
+	outputs, err := decodeInferResponse(response)
+	if err != nil {
+		return nil, malformedResponse(err)
+	}
+	scores, err := selectOutput(outputs, b.Output)
+	if err != nil {
+		return nil, malformedResponse(err)
+	}
+	return scores, nil
+}
+
+// connect returns the connection, which is opened on the first call.
+func (b *KServeGRPCBackend) connect() (*grpc.ClientConn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBackendClosed
+	}
+	if b.conn == nil && b.err == nil {
+		b.conn, b.err = grpc.NewClient(b.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client: %w", b.err)
+	}
+	return b.conn, nil
+}
+
+// Close closes the connection, if it was opened. The predictions that follow
+// fail with ErrBackendClosed.
+func (b *KServeGRPCBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.conn == nil {
+		return nil
+	}
+	conn := b.conn
+	b.conn = nil
+	return conn.Close()
+}
+
+// rawMessage is an encoded protobuf message, which is sent and received as is
+// by the rawCodec.
+type rawMessage []byte
+
+// rawCodec passes the encoded messages through. It is named proto, so that
+// the content type of the requests is the one of protobuf messages.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	message, ok := v.(*rawMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type: %T", v)
+	}
+	return *message, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	message, ok := v.(*rawMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message type: %T", v)
+	}
+	// The buffer of the data may be reused after the call.
+	*message = append((*message)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// encodeInferRequest encodes the ModelInferRequest of the queries.
+func encodeInferRequest(model, input, output string, queries []string) []byte {
+	var contents []byte
+	for _, query := range queries {
+		contents = protowire.AppendTag(contents, inferContentsBytes, protowire.BytesType)
+		contents = protowire.AppendString(contents, query)
+	}
+	shape := protowire.AppendVarint(protowire.AppendVarint(nil, uint64(len(queries))), 1)
+
+	var tensor []byte
+	tensor = appendField(tensor, inferTensorName, []byte(input))
+	tensor = appendField(tensor, inferTensorDatatype, []byte("BYTES"))
+	tensor = appendField(tensor, inferTensorShape, shape)
+	tensor = appendField(tensor, inferTensorContents, contents)
+
+	var request []byte
+	request = appendField(request, inferRequestModelName, []byte(model))
+	request = appendField(request, inferRequestInputs, tensor)
+	if output != "" {
+		request = appendField(request, inferRequestOutputs,
+			appendField(nil, inferTensorName, []byte(output)))
+	}
+	return request
+}
+
+// appendField appends a length-delimited field, i.e. a string, bytes, packed
+// repeated numbers or a message.
+func appendField(b []byte, num protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
+
+// decodeInferResponse decodes the output tensors of the ModelInferResponse.
+// The scores are read from the contents of the tensors, or from the raw output
+// contents, which some servers, e.g. Triton, use instead.
+func decodeInferResponse(data []byte) ([]inferOutput, error) {
+	var outputs []inferOutput
+	var datatypes []string
+	var raw [][]byte
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case inferResponseOutputs:
+			output, datatype, err := decodeInferTensor(value)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, output)
+			datatypes = append(datatypes, datatype)
+		case inferResponseRawOutputs:
+			raw = append(raw, value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range outputs {
+		if outputs[idx].Scores != nil || idx >= len(raw) {
+			continue
+		}
+		if outputs[idx].Scores, err = decodeRawScores(raw[idx], datatypes[idx]); err != nil {
+			return nil, fmt.Errorf("output %s: %w", outputs[idx].Name, err)
+		}
+	}
+	return outputs, nil
+}
+
+// decodeInferTensor decodes the name, datatype and numeric contents of an
+// output tensor.
+func decodeInferTensor(data []byte) (inferOutput, string, error) {
+	var output inferOutput
+	var datatype string
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == inferTensorName && typ == protowire.BytesType:
+			output.Name = string(value)
+		case num == inferTensorDatatype && typ == protowire.BytesType:
+			datatype = string(value)
+		case num == inferTensorContents && typ == protowire.BytesType:
+			return walkFields(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				switch num {
+				case inferContentsFP32:
+					return decodeFixed(value, typ, protowire.Fixed32Type, func(v uint64) {
+						output.Scores = append(output.Scores, math.Float32frombits(uint32(v)))
+					})
+				case inferContentsFP64:
+					return decodeFixed(value, typ, protowire.Fixed64Type, func(v uint64) {
+						output.Scores = append(output.Scores, float32(math.Float64frombits(v)))
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return output, datatype, err
+}
+
+// decodeRawScores decodes the little-endian scores of a raw output.
+func decodeRawScores(data []byte, datatype string) ([]float32, error) {
+	var size int
+	switch datatype {
+	case "FP32":
+		size = 4
+	case "FP64":
+		size = 8
+	default:
+		return nil, fmt.Errorf("unsupported output datatype: %s", datatype)
+	}
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("raw output of %d bytes is not a multiple of %d", len(data), size)
+	}
+
+	scores := make([]float32, 0, len(data)/size)
+	for offset := 0; offset < len(data); offset += size {
+		if size == 4 {
+			scores = append(scores, math.Float32frombits(binary.LittleEndian.Uint32(data[offset:])))
+		} else {
+			scores = append(scores, float32(math.Float64frombits(binary.LittleEndian.Uint64(data[offset:]))))
+		}
+	}
+	return scores, nil
+}
+
+// walkFields calls fn with the number, type and value of every field of the
+// message. The value of length-delimited fields is without the length prefix.
+func walkFields(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		value := data[:n]
+		if typ == protowire.BytesType {
+			value, _ = protowire.ConsumeBytes(value)
+		}
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// decodeFixed decodes a repeated fixed-size number field, which is either
+// packed or a single value, which are decoded alike.
+func decodeFixed(value []byte, typ, fixed protowire.Type, fn func(uint64)) error {
+	if typ != fixed && typ != protowire.BytesType {
+		return errors.New("invalid wire type of numeric contents")
+	}
+	for len(value) > 0 {
+		var v uint64
+		var n int
+		if fixed == protowire.Fixed32Type {
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(value)
+			v = uint64(v32)
+		} else {
+			v, n = protowire.ConsumeFixed64(value)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		fn(v)
+		value = value[n:]
+	}
+	return nil
+}
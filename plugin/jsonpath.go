@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONPath is a path to a value of a JSON document, e.g. "outputs[0][0]" or
+// "$.predictions[*].score". A path starts at the document, or "$", and has
+// object keys separated by dots, array indexes, and [*] to get the values of
+// all the items of an array.
+type JSONPath []pathSegment
+
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// ParseJSONPath parses the path. An empty path returns nil, and "$" returns
+// an empty path to the document itself.
+func ParseJSONPath(path string) (JSONPath, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	rest := path
+	if strings.HasPrefix(rest, "$") {
+		rest = rest[1:]
+	} else if !strings.HasPrefix(rest, "[") {
+		rest = "." + rest
+	}
+
+	parsed := JSONPath{}
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end == -1 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("path has an empty key: %q", path)
+			}
+			parsed = append(parsed, pathSegment{key: rest[:end]})
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("path has an unclosed bracket: %q", path)
+			}
+			if rest[1:end] == "*" {
+				parsed = append(parsed, pathSegment{wildcard: true})
+			} else {
+				index, err := strconv.Atoi(rest[1:end])
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("path has an invalid index: %q", path)
+				}
+				parsed = append(parsed, pathSegment{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path has an invalid segment: %q", path)
+		}
+	}
+	return parsed, nil
+}
+
+func (path JSONPath) String() string {
+	var builder strings.Builder
+	builder.WriteString("$")
+	for _, segment := range path {
+		switch {
+		case segment.wildcard:
+			builder.WriteString("[*]")
+		case segment.isIndex:
+			fmt.Fprintf(&builder, "[%d]", segment.index)
+		default:
+			builder.WriteString("." + segment.key)
+		}
+	}
+	return builder.String()
+}
+
+// Resolve returns the value at the path of the document, as decoded by
+// encoding/json. The values of a wildcard are returned as an array.
+func (path JSONPath) Resolve(document any) (any, error) {
+	value := document
+	for idx, segment := range path {
+		switch {
+		case segment.wildcard:
+			items, ok := value.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s is not an array", path[:idx])
+			}
+			values := make([]any, 0, len(items))
+			for _, item := range items {
+				resolved, err := path[idx+1:].Resolve(item)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path[:idx+1], err)
+				}
+				values = append(values, resolved)
+			}
+			return values, nil
+		case segment.isIndex:
+			items, ok := value.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%s is not an array", path[:idx])
+			}
+			if segment.index >= len(items) {
+				return nil, fmt.Errorf("%s is missing", path[:idx+1])
+			}
+			value = items[segment.index]
+		default:
+			object, ok := value.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s is not an object", path[:idx])
+			}
+			if value, ok = object[segment.key]; !ok {
+				return nil, fmt.Errorf("%s is missing", path[:idx+1])
+			}
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseJSONPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"confidence":            "$.confidence",
+		"$.outputs[0][0]":       "$.outputs[0][0]",
+		"[*].score":             "$[*].score",
+		"$":                     "$",
+		"predictions[*][1].p.q": "$.predictions[*][1].p.q",
+	} {
+		parsed, err := ParseJSONPath(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, expected, parsed.String())
+	}
+
+	parsed, err := ParseJSONPath("")
+	require.NoError(t, err)
+	assert.Nil(t, parsed)
+
+	for path, expected := range map[string]string{
+		"outputs..score": `path has an empty key: "outputs..score"`,
+		"outputs[0":      `path has an unclosed bracket: "outputs[0"`,
+		"outputs[-1]":    `path has an invalid index: "outputs[-1]"`,
+		"$confidence":    `path has an invalid segment: "$confidence"`,
+	} {
+		_, err := ParseJSONPath(path)
+		require.EqualError(t, err, expected)
+	}
+}
+
+func Test_JSONPathResolve(t *testing.T) {
+	var document any
+	require.NoError(t, json.Unmarshal(
+		[]byte(`{"outputs": [[0.9]], "predictions": [{"score": 0.1}, {"score": 0.8}]}`), &document))
+
+	resolve := func(path string) (any, error) {
+		parsed, err := ParseJSONPath(path)
+		require.NoError(t, err)
+		return parsed.Resolve(document)
+	}
+
+	value, err := resolve("outputs[0][0]")
+	require.NoError(t, err)
+	assert.InDelta(t, 0.9, value, 0.0001)
+
+	value, err = resolve("predictions[*].score")
+	require.NoError(t, err)
+	assert.Equal(t, []any{0.1, 0.8}, value)
+
+	_, err = resolve("confidence")
+	require.EqualError(t, err, "$.confidence is missing")
+	_, err = resolve("outputs[1]")
+	require.EqualError(t, err, "$.outputs[1] is missing")
+	_, err = resolve("outputs.score")
+	require.EqualError(t, err, "$.outputs is not an object")
+	_, err = resolve("predictions[*].label")
+	require.EqualError(t, err, "$.predictions[*]: $.label is missing")
+}
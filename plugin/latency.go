@@ -0,0 +1,292 @@
+package plugin
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+var (
+	// numberPattern matches the numbers of a query, which may be the delays
+	// of sleep-style payloads, e.g. pg_sleep(5) or SLEEP(5), but not the
+	// digits of identifiers and parameters, e.g. t2, users_v3 or $1.
+	numberPattern = regexp.MustCompile(`(?:^|[^\w$.])(\d+(?:\.\d+)?)\b`)
+	// literalPattern matches the strings and numbers of a query, which are
+	// replaced to get the shape of a query that can't be fingerprinted.
+	literalPattern = regexp.MustCompile(`'(?:[^']|'')*'|"(?:[^"]|"")*"|\b\d+(?:\.\d+)?\b`)
+)
+
+// maxSleepValue is the highest number of a query, in seconds, that is
+// considered the delay of a sleep.
+const maxSleepValue = 3600
+
+// TimedQuery is a query of the client, whose latency is measured from the
+// time it is sent to the server until the server responds.
+type TimedQuery struct {
+	// Query is the SQL of the query, for the audit trail.
+	Query string
+	// Shape identifies the structurally similar queries, i.e. the queries
+	// that only differ in their constants.
+	Shape string
+	// Values are the numbers of the query and its parameters.
+	Values []float64
+	// SentAt is zero until the query is sent to the server.
+	SentAt time.Time
+}
+
+// newTimedQuery returns the timed query of a request, or nil if the request
+// has no query, e.g. a Bind message of numeric parameters only. The shape of
+// a prepared statement that is executed without its SQL is its name.
+func newTimedQuery(protocol string, queries []*clientQuery) *TimedQuery {
+	timed := &TimedQuery{}
+	for _, query := range queries {
+		switch {
+		case query.source != BindSource && timed.Query == "":
+			timed.Query = query.text
+			timed.Shape = queryShape(protocol, query.text)
+		case query.source == BindSource && timed.Shape == "":
+			timed.Shape = "prepared:" + cast.ToString(query.fields[PreparedStatementField])
+		}
+		for _, match := range numberPattern.FindAllStringSubmatch(query.text, MaxLatencyValues) {
+			value, err := strconv.ParseFloat(match[1], 64)
+			if err == nil && !slices.Contains(timed.Values, value) && len(timed.Values) < MaxLatencyValues {
+				timed.Values = append(timed.Values, value)
+			}
+		}
+	}
+	if timed.Shape == "" {
+		return nil
+	}
+	return timed
+}
+
+// queryShape returns the fingerprint of a PostgreSQL query, which ignores the
+// constants and comments, or the query with its strings and numbers replaced.
+func queryShape(protocol, query string) string {
+	if protocol != MySQLProtocol {
+		if fingerprint, err := pgQuery.Fingerprint(query); err == nil {
+			return fingerprint
+		}
+	}
+	return literalPattern.ReplaceAllString(normalizeWhitespace(query), "?")
+}
+
+// normalizeWhitespace collapses all whitespace into single spaces, as ORMs
+// and query builders often generate the same query with different layouts.
+func normalizeWhitespace(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// LatencyAnomaly is the latency of a client's queries that reveals a
+// time-based blind injection.
+type LatencyAnomaly struct {
+	// Rule is either RuleSleepValueLatency or RuleBimodalLatency.
+	Rule    string
+	Latency time.Duration
+	// Value is the number of the query that matches the latency in seconds,
+	// for RuleSleepValueLatency.
+	Value float64
+	// Fast is the slowest latency of the fast queries and Slow the fastest
+	// latency of the slow queries, for RuleBimodalLatency.
+	Fast, Slow time.Duration
+	// Samples is the number of latencies of the structurally similar queries.
+	Samples int
+}
+
+// LatencyAnalyzer keeps the recent latencies of the structurally similar
+// queries of each client, and flags the clients whose latencies track their
+// input, which is how time-based blind injections extract data: the query is
+// delayed depending on a condition. A client is flagged if either
+//
+//   - the latency of a usually fast query matches a number of the query in
+//     seconds, e.g. the delay of pg_sleep(5), at least twice, or
+//   - the latencies of the query are bimodal: some are fast, and others are
+//     slower than the min delay and many times slower than the fast ones.
+//
+// The latencies of a client are forgotten once the client is flagged, so that
+// it is flagged again only on new evidence. The number of tracked queries is
+// bounded, evicting the least recently used ones.
+type LatencyAnalyzer struct {
+	mu         sync.Mutex
+	windowSize int
+	minDelay   time.Duration
+	groups     map[[sha256.Size]byte]*list.Element
+	lru        *list.List
+}
+
+type latencyGroup struct {
+	key     [sha256.Size]byte
+	samples []latencySample
+}
+
+type latencySample struct {
+	latency time.Duration
+	values  []float64
+}
+
+// NewLatencyAnalyzer returns a new LatencyAnalyzer that keeps the given number
+// of recent latencies per query, and considers latencies from the min delay
+// on as delayed.
+func NewLatencyAnalyzer(windowSize int, minDelay time.Duration) *LatencyAnalyzer {
+	return &LatencyAnalyzer{
+		windowSize: windowSize,
+		minDelay:   minDelay,
+		groups:     map[[sha256.Size]byte]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+// Record adds the latency of the query of the session, and returns the
+// anomaly if the latencies of the structurally similar queries of the client
+// reveal a time-based blind injection.
+func (a *LatencyAnalyzer) Record(session Session, query *TimedQuery, latency time.Duration) *LatencyAnomaly {
+	if a == nil || query == nil {
+		return nil
+	}
+
+	client := session.ClientAddress
+	if addr, ok := clientIP(session.ClientAddress); ok {
+		client = addr.String()
+	}
+	key := sha256.Sum256([]byte(client + "\x00" + session.User + "\x00" + query.Shape))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	group := a.group(key)
+	group.samples = append(group.samples, latencySample{latency: latency, values: query.Values})
+	if len(group.samples) > a.windowSize {
+		group.samples = slices.Delete(group.samples, 0, len(group.samples)-a.windowSize)
+	}
+
+	anomaly := a.sleepValue(group.samples)
+	if anomaly == nil {
+		anomaly = a.bimodal(group.samples)
+	}
+	if anomaly != nil {
+		anomaly.Samples = len(group.samples)
+		group.samples = nil
+	}
+	return anomaly
+}
+
+// group returns the group of the key, creating it and evicting the least
+// recently used group if needed.
+func (a *LatencyAnalyzer) group(key [sha256.Size]byte) *latencyGroup {
+	if element, ok := a.groups[key]; ok {
+		a.lru.MoveToFront(element)
+		return element.Value.(*latencyGroup)
+	}
+
+	group := &latencyGroup{key: key}
+	a.groups[key] = a.lru.PushFront(group)
+	for a.lru.Len() > MaxLatencyGroups {
+		oldest := a.lru.Back()
+		a.lru.Remove(oldest)
+		delete(a.groups, oldest.Value.(*latencyGroup).key)
+	}
+	return group
+}
+
+// sleepValue returns an anomaly if the latency of the last sample matches one
+// of its numbers, and so did the latency of an earlier sample, while the query
+// is usually fast.
+func (a *LatencyAnalyzer) sleepValue(samples []latencySample) *LatencyAnomaly {
+	last := samples[len(samples)-1]
+	value, ok := a.matchingValue(last)
+	if !ok {
+		return nil
+	}
+
+	matches, fast := 0, false
+	for _, sample := range samples {
+		if _, ok := a.matchingValue(sample); ok {
+			matches++
+		}
+		if sample.latency < a.minDelay {
+			fast = true
+		}
+	}
+	if matches < LatencySleepMatches || !fast {
+		return nil
+	}
+	return &LatencyAnomaly{Rule: RuleSleepValueLatency, Latency: last.latency, Value: value}
+}
+
+// matchingValue returns the number of the sample that matches its latency in
+// seconds, as a delay of that many seconds takes at least as long, plus the
+// time it takes to run the query and send the response.
+func (a *LatencyAnalyzer) matchingValue(sample latencySample) (float64, bool) {
+	for _, value := range sample.values {
+		if value > maxSleepValue {
+			continue
+		}
+		delay := time.Duration(value * float64(time.Second))
+		if delay < a.minDelay {
+			continue
+		}
+		tolerance := max(LatencySleepTolerance, delay/5)
+		if sample.latency >= delay-delay/20 && sample.latency <= delay+tolerance {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
+// bimodal returns an anomaly if the latencies split into fast and slow ones,
+// with at least LatencyMinClusterSize of each, where the slow ones are delayed
+// and LatencyBimodalRatio times slower than the fast ones, and the latency of
+// the last sample is one of the slow ones.
+func (a *LatencyAnalyzer) bimodal(samples []latencySample) *LatencyAnomaly {
+	if len(samples) < LatencyMinSamples {
+		return nil
+	}
+
+	latencies := make([]time.Duration, 0, len(samples))
+	for _, sample := range samples {
+		latencies = append(latencies, sample.latency)
+	}
+	slices.Sort(latencies)
+
+	// The split is at the largest gap between the sorted latencies.
+	split, ratio := 0, 0.0
+	for idx := LatencyMinClusterSize; idx <= len(latencies)-LatencyMinClusterSize; idx++ {
+		fast, slow := latencies[idx-1], latencies[idx]
+		if gap := float64(slow) / float64(max(fast, time.Microsecond)); gap > ratio {
+			split, ratio = idx, gap
+		}
+	}
+	if split == 0 || ratio < LatencyBimodalRatio || latencies[split] < a.minDelay {
+		return nil
+	}
+
+	last := samples[len(samples)-1].latency
+	if last < latencies[split] {
+		return nil
+	}
+	return &LatencyAnomaly{
+		Rule:    RuleBimodalLatency,
+		Latency: last,
+		Fast:    latencies[split-1],
+		Slow:    latencies[split],
+	}
+}
+
+// Len returns the number of tracked queries.
+func (a *LatencyAnalyzer) Len() int {
+	if a == nil {
+		return 0
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lru.Len()
+}
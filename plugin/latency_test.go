@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_newTimedQuery(t *testing.T) {
+	first := newTimedQuery(PostgresProtocol, []*clientQuery{
+		{source: QuerySource, text: "SELECT * FROM users WHERE id = 1 AND pg_sleep(5) IS NULL"},
+	})
+	require.NotNil(t, first)
+	assert.Equal(t, []float64{1, 5}, first.Values)
+	assert.True(t, first.SentAt.IsZero())
+
+	// Queries that only differ in their constants have the same shape.
+	second := newTimedQuery(PostgresProtocol, []*clientQuery{
+		{source: QuerySource, text: "select * from users where id = 2 and pg_sleep(0) is null"},
+	})
+	require.NotNil(t, second)
+	assert.Equal(t, first.Shape, second.Shape)
+	other := newTimedQuery(PostgresProtocol, []*clientQuery{{source: QuerySource, text: "SELECT * FROM orders"}})
+	assert.NotEqual(t, first.Shape, other.Shape)
+
+	mysql := newTimedQuery(MySQLProtocol, []*clientQuery{
+		{source: QuerySource, text: "SELECT * FROM users WHERE name = 'a' AND SLEEP(5)"},
+	})
+	require.NotNil(t, mysql)
+	assert.Equal(t, "SELECT * FROM users WHERE name = ? AND SLEEP(?)", mysql.Shape)
+
+	// A prepared statement executed without its SQL is identified by its name.
+	bind := newTimedQuery(PostgresProtocol, []*clientQuery{{
+		source: BindSource,
+		text:   "1 AND pg_sleep(3)",
+		fields: map[string]any{PreparedStatementField: "users_by_id"},
+	}})
+	require.NotNil(t, bind)
+	assert.Equal(t, "prepared:users_by_id", bind.Shape)
+	assert.Empty(t, bind.Query)
+	assert.Equal(t, []float64{1, 3}, bind.Values)
+
+	// The digits of identifiers and parameters are not numbers.
+	identifiers := newTimedQuery(PostgresProtocol, []*clientQuery{
+		{source: ParseSource, text: "SELECT * FROM users_v3 t2 WHERE t2.id = $1 AND t2.x = 1.5 AND pg_sleep('4')"},
+	})
+	require.NotNil(t, identifiers)
+	assert.Equal(t, []float64{1.5, 4}, identifiers.Values)
+
+	assert.Nil(t, newTimedQuery(PostgresProtocol, nil))
+}
+
+// recordLatencies records the latencies of the query and returns the last
+// anomaly.
+func recordLatencies(
+	analyzer *LatencyAnalyzer, session Session, query *TimedQuery, latencies ...time.Duration,
+) *LatencyAnomaly {
+	var anomaly *LatencyAnomaly
+	for _, latency := range latencies {
+		anomaly = analyzer.Record(session, query, latency)
+	}
+	return anomaly
+}
+
+func Test_LatencyAnalyzerSleepValue(t *testing.T) {
+	analyzer := NewLatencyAnalyzer(DefaultLatencyWindowSize, time.Second)
+	session := Session{ClientAddress: "10.0.0.1:5000", User: "app"}
+	fast := &TimedQuery{Shape: "users", Values: []float64{1, 0}}
+	slow := &TimedQuery{Shape: "users", Values: []float64{1, 5}}
+
+	assert.Nil(t, recordLatencies(analyzer, session, fast, 3*time.Millisecond, 4*time.Millisecond))
+	// A single match is not enough.
+	assert.Nil(t, analyzer.Record(session, slow, 5100*time.Millisecond))
+	assert.Nil(t, analyzer.Record(session, fast, 2*time.Millisecond))
+
+	anomaly := analyzer.Record(session, slow, 5020*time.Millisecond)
+	require.NotNil(t, anomaly)
+	assert.Equal(t, RuleSleepValueLatency, anomaly.Rule)
+	assert.InDelta(t, 5, anomaly.Value, 0)
+	assert.Equal(t, 5020*time.Millisecond, anomaly.Latency)
+	assert.Equal(t, 5, anomaly.Samples)
+
+	// The latencies are forgotten once the client is flagged.
+	assert.Nil(t, analyzer.Record(session, slow, 5020*time.Millisecond))
+}
+
+func Test_LatencyAnalyzerBimodal(t *testing.T) {
+	analyzer := NewLatencyAnalyzer(DefaultLatencyWindowSize, time.Second)
+	session := Session{ClientAddress: "10.0.0.1:5000", User: "app"}
+	query := &TimedQuery{Shape: "users", Values: []float64{1}}
+
+	assert.Nil(t, recordLatencies(analyzer, session, query,
+		4*time.Millisecond, 5*time.Millisecond, 2*time.Second, 6*time.Millisecond, 3*time.Millisecond))
+	anomaly := analyzer.Record(session, query, 2100*time.Millisecond)
+	require.NotNil(t, anomaly)
+	assert.Equal(t, RuleBimodalLatency, anomaly.Rule)
+	assert.Equal(t, 6*time.Millisecond, anomaly.Fast)
+	assert.Equal(t, 2*time.Second, anomaly.Slow)
+	assert.Equal(t, 6, anomaly.Samples)
+}
+
+func Test_LatencyAnalyzerNoAnomaly(t *testing.T) {
+	analyzer := NewLatencyAnalyzer(DefaultLatencyWindowSize, time.Second)
+	session := Session{ClientAddress: "10.0.0.1:5000", User: "app"}
+
+	// A query that is always slow, even if it matches one of its numbers.
+	report := &TimedQuery{Shape: "report", Values: []float64{5}}
+	assert.Nil(t, recordLatencies(analyzer, session, report,
+		5*time.Second, 5100*time.Millisecond, 5200*time.Millisecond, 5*time.Second, 5*time.Second, 5*time.Second))
+
+	// The jitter of a fast query.
+	jitter := &TimedQuery{Shape: "jitter", Values: []float64{1}}
+	assert.Nil(t, recordLatencies(analyzer, session, jitter,
+		time.Millisecond, 80*time.Millisecond, time.Millisecond, 90*time.Millisecond,
+		time.Millisecond, 85*time.Millisecond, time.Millisecond, 95*time.Millisecond))
+
+	// The latencies of other clients and queries are analyzed apart.
+	query := &TimedQuery{Shape: "users", Values: []float64{5}}
+	assert.Nil(t, recordLatencies(analyzer, session, query, time.Millisecond, 5*time.Second))
+	assert.Nil(t, analyzer.Record(Session{ClientAddress: "10.0.0.2:5000", User: "app"}, query, 5*time.Second))
+	assert.Nil(t, analyzer.Record(session, &TimedQuery{Shape: "orders", Values: []float64{5}}, 5*time.Second))
+	// The port of the client address is ignored.
+	assert.NotNil(t, analyzer.Record(Session{ClientAddress: "10.0.0.1:6000", User: "app"}, query, 5*time.Second))
+	assert.Equal(t, 5, analyzer.Len())
+
+	var nilAnalyzer *LatencyAnalyzer
+	assert.Nil(t, nilAnalyzer.Record(session, query, time.Second))
+	assert.Equal(t, 0, nilAnalyzer.Len())
+}
+
+func Test_OnTrafficToServerLatency(t *testing.T) {
+	p := &Plugin{
+		Logger:           hclog.NewNullLogger(),
+		Detectors:        []string{SyntaxTree},
+		Connections:      NewConnectionTracker(),
+		Latency:          NewLatencyAnalyzer(DefaultLatencyWindowSize, time.Second),
+		RecentDetections: NewDetectionLog(10),
+	}
+
+	// roundTrip sends the query to the server, which responds after the
+	// latency, and returns the response.
+	roundTrip := func(query string, latency time.Duration) *v1.Struct {
+		req := newTrafficRequest(t, encodeMessages(t, &pgproto3.Query{String: query}))
+		_, err := p.OnTrafficFromClient(context.Background(), req)
+		require.NoError(t, err)
+		_, err = p.OnTrafficToServer(context.Background(), req)
+		require.NoError(t, err)
+
+		conn := p.connection(req)
+		require.NotNil(t, conn.pendingQuery)
+		conn.pendingQuery.SentAt = time.Now().Add(-latency)
+		resp, err := p.OnTrafficFromServer(context.Background(), newServerResponse(t,
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+			&pgproto3.ReadyForQuery{TxStatus: 'I'},
+		))
+		require.NoError(t, err)
+		assert.Nil(t, conn.TakePendingQuery())
+		return resp
+	}
+
+	roundTrip("SELECT pg_sleep(0)", 0)
+	resp := roundTrip("SELECT pg_sleep(3)", 3*time.Second)
+	assert.Empty(t, p.RecentDetections.Recent())
+	assert.Nil(t, resp.Fields[sdkAct.Signals])
+	resp = roundTrip("SELECT pg_sleep(3)", 3*time.Second)
+
+	records := p.RecentDetections.Recent()
+	require.Len(t, records, 1)
+	fields := records[0].Fields
+	assert.Equal(t, LatencyAnalysis, fields[DetectorField])
+	assert.Equal(t, RuleSleepValueLatency, fields[RuleField])
+	assert.Equal(t, "SELECT pg_sleep(3)", fields[QueryField])
+	assert.InDelta(t, 3, fields[SleepValueField], 0)
+	assert.InDelta(t, 3, fields[LatencyField], 0.1)
+	assert.Equal(t, 3, fields[SamplesField])
+
+	// The detection is logged to the audit trail.
+	signals := resp.Fields[sdkAct.Signals].GetListValue().AsSlice()
+	require.Len(t, signals, 1)
+	metadata := signals[0].(map[string]any)["metadata"].(map[string]any)
+	assert.Equal(t, LatencyAnalysis, metadata[DetectorField])
+	assert.Equal(t, RuleSleepValueLatency, metadata[RuleField])
+
+	// In detect-only mode, the detected queries pass through, so they are
+	// timed as well.
+	p.Mode = DetectOnlyMode
+	p.Detectors = []string{"keyword"}
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+	roundTrip("SELECT * FROM users WHERE id = 1 OR pg_sleep(2) IS NULL", 2*time.Second)
+}
+
+func Test_LoadConfigLatency(t *testing.T) {
+	config, err := LoadConfig(defaultConfig())
+	require.NoError(t, err)
+	assert.False(t, config.LatencyAnalysis)
+	assert.Equal(t, DefaultLatencyWindowSize, config.LatencyWindowSize)
+	assert.Equal(t, DefaultLatencyMinDelay, config.LatencyMinDelay)
+
+	cfg := defaultConfig()
+	cfg["latencyAnalysis"] = "true"
+	cfg["latencyWindowSize"] = "3"
+	cfg["latencyMinDelay"] = "0"
+	_, err = LoadConfig(cfg)
+	require.EqualError(t, err,
+		"latencyWindowSize must be at least 6 if the latency analysis is enabled: 3\n"+
+			"latencyMinDelay must be positive if the latency analysis is enabled")
+
+	cfg["latencyWindowSize"] = "10"
+	cfg["latencyMinDelay"] = "500"
+	config, err = LoadConfig(cfg)
+	require.NoError(t, err)
+	p := &Plugin{}
+	config.Apply(p)
+	require.NotNil(t, p.Latency)
+	assert.Equal(t, 500*time.Millisecond, p.Latency.minDelay)
+}
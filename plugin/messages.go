@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gatewayd-io/gatewayd-plugin-sdk/databases/postgres"
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// clientQuery is a piece of SQL extracted from a client message that should
+// be inspected by the detectors.
+type clientQuery struct {
+	// source is the type of the message the SQL was extracted from.
+	source string
+	text   string
+	// fields are added to the audit trail if the query is blocked.
+	fields map[string]any
+}
+
+// clientRequest holds the queries of all the messages in a client request.
+// A single request may contain multiple messages, e.g. Parse, Bind, Describe,
+// Execute and Sync are usually sent together by the extended query protocol.
+type clientRequest struct {
+	queries []*clientQuery
+	// messages are all the messages in the request, in order.
+	messages []clientMessage
+	// session is the session announced by a startup message in the request.
+	session *Session
+	// mysqlPrepare is the query of a MySQL COM_STMT_PREPARE in the request.
+	mysqlPrepare *string
+	// mysqlExecute is the statement id of a MySQL COM_STMT_EXECUTE in the
+	// request.
+	mysqlExecute *uint32
+}
+
+// clientMessage is the type of a frontend message, and the object type for
+// Describe and Close messages.
+type clientMessage struct {
+	kind       byte
+	objectType byte
+}
+
+// isExtended returns true if the request contains messages of the extended
+// query protocol and no simple Query message.
+func (r *clientRequest) isExtended() bool {
+	if len(r.messages) == 0 {
+		return false
+	}
+	for _, message := range r.messages {
+		if message.kind == QueryMessage {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSync returns true if the request contains a Sync message.
+func (r *clientRequest) hasSync() bool {
+	for _, message := range r.messages {
+		if message.kind == SyncMessage {
+			return true
+		}
+	}
+	return false
+}
+
+// syncMessageLength is the length of a Sync message, including its type.
+const syncMessageLength = 5
+
+// fromFirstSync returns the messages of the request from the first Sync
+// message on, or nil if there is no Sync message.
+func fromFirstSync(request []byte) []byte {
+	for offset := 0; len(request)-offset >= syncMessageLength; {
+		if request[offset] == SyncMessage {
+			return request[offset:]
+		}
+		offset += 1 + int(binary.BigEndian.Uint32(request[offset+1:offset+5]))
+	}
+	return nil
+}
+
+// decodeClientRequest decodes all the frontend messages in the request and
+// extracts the SQL of Query and Parse messages and the string parameter values
+// of Bind messages, in text or binary format.
+func decodeClientRequest(request []byte) *clientRequest {
+	decoded := &clientRequest{}
+	if postgres.IsPostgresStartupMessage(request) {
+		decoded.session = postgresStartupSession(request)
+		return decoded
+	}
+
+	backend := pgproto3.NewBackend(bytes.NewReader(request), nil)
+	for {
+		message, err := backend.Receive()
+		if err != nil {
+			return decoded
+		}
+
+		switch message := message.(type) {
+		case *pgproto3.Query:
+			decoded.messages = append(decoded.messages, clientMessage{kind: QueryMessage})
+			decoded.queries = append(decoded.queries, &clientQuery{
+				source: QuerySource,
+				text:   message.String,
+			})
+		case *pgproto3.Parse:
+			decoded.messages = append(decoded.messages, clientMessage{kind: ParseMessage})
+			decoded.queries = append(decoded.queries, &clientQuery{
+				source: ParseSource,
+				text:   message.Query,
+				fields: map[string]any{
+					PreparedStatementField: message.Name,
+				},
+			})
+		case *pgproto3.Bind:
+			decoded.messages = append(decoded.messages, clientMessage{kind: BindMessage})
+			decoded.queries = append(decoded.queries, bindParameters(message)...)
+		case *pgproto3.Describe:
+			decoded.messages = append(decoded.messages, clientMessage{
+				kind: DescribeMessage, objectType: message.ObjectType,
+			})
+		case *pgproto3.Close:
+			decoded.messages = append(decoded.messages, clientMessage{
+				kind: CloseMessage, objectType: message.ObjectType,
+			})
+		case *pgproto3.Execute:
+			decoded.messages = append(decoded.messages, clientMessage{kind: ExecuteMessage})
+		case *pgproto3.Sync:
+			decoded.messages = append(decoded.messages, clientMessage{kind: SyncMessage})
+		case *pgproto3.Flush:
+			decoded.messages = append(decoded.messages, clientMessage{kind: FlushMessage})
+		}
+	}
+}
+
+// bindParameters returns the parameter values of a Bind message that may
+// carry an injection payload. NULLs and numbers are skipped. The binary format
+// of text and varchar is the raw UTF-8 string, so binary parameters are
+// inspected as well, unless they are the fixed-width encoding of a number.
+func bindParameters(bind *pgproto3.Bind) []*clientQuery {
+	queries := []*clientQuery{}
+	for idx, param := range bind.Parameters {
+		if param == nil || (!isTextParameter(bind, idx) && !isBinaryText(param)) {
+			continue
+		}
+
+		value := string(param)
+		if value == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			continue
+		}
+
+		queries = append(queries, &clientQuery{
+			source: BindSource,
+			text:   value,
+			fields: map[string]any{
+				PreparedStatementField: bind.PreparedStatement,
+				ParameterField:         idx,
+			},
+		})
+	}
+	return queries
+}
+
+// isTextParameter checks the format code of the parameter. A single format
+// code applies to all parameters and no format codes means text format.
+func isTextParameter(bind *pgproto3.Bind, idx int) bool {
+	switch len(bind.ParameterFormatCodes) {
+	case 0:
+		return true
+	case 1:
+		return bind.ParameterFormatCodes[0] == pgproto3.TextFormat
+	default:
+		return idx < len(bind.ParameterFormatCodes) &&
+			bind.ParameterFormatCodes[idx] == pgproto3.TextFormat
+	}
+}
+
+// isBinaryText returns true if the binary parameter value is a string, i.e.
+// valid UTF-8 without control characters other than whitespace. The binary
+// encodings of integers, floats and other numbers have zero bytes or invalid
+// UTF-8 sequences, except for rare values that are harmless to inspect.
+func isBinaryText(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// readyForQueryStatus returns the transaction status of the ReadyForQuery
+// message at the end of the server response, if there is one. ReadyForQuery
+// is always the last message the server sends for a query cycle, and large
+// responses are split into multiple chunks, so only the end of the response
+// is checked.
+func readyForQueryStatus(response []byte) (byte, bool) {
+	const readyForQueryLength = 6
+	if len(response) < readyForQueryLength {
+		return 0, false
+	}
+
+	message := response[len(response)-readyForQueryLength:]
+	if message[0] != ReadyForQueryMessage || binary.BigEndian.Uint32(message[1:5]) != 5 {
+		return 0, false
+	}
+
+	switch status := message[5]; status {
+	case TxStatusIdle, TxStatusInTransaction, TxStatusFailed:
+		return status, true
+	default:
+		return 0, false
+	}
+}
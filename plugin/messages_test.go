@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeMessages(t *testing.T, messages ...pgproto3.FrontendMessage) []byte {
+	t.Helper()
+
+	var request []byte
+	for _, message := range messages {
+		var err error
+		request, err = message.Encode(request)
+		require.NoError(t, err)
+	}
+	return request
+}
+
+func Test_decodeClientRequest(t *testing.T) {
+	request := encodeMessages(t,
+		&pgproto3.Parse{Name: "stmt", Query: "SELECT * FROM users WHERE name = $1 AND id = $2"},
+		&pgproto3.Bind{
+			PreparedStatement: "stmt",
+			Parameters:        [][]byte{[]byte("' OR '1'='1"), []byte("42"), nil},
+		},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+
+	decoded := decodeClientRequest(request)
+	require.Len(t, decoded.queries, 2)
+	assert.Equal(t, ParseSource, decoded.queries[0].source)
+	assert.Equal(t, "SELECT * FROM users WHERE name = $1 AND id = $2", decoded.queries[0].text)
+	assert.Equal(t, "stmt", decoded.queries[0].fields[PreparedStatementField])
+	// Numbers and NULLs are skipped.
+	assert.Equal(t, BindSource, decoded.queries[1].source)
+	assert.Equal(t, "' OR '1'='1", decoded.queries[1].text)
+	assert.Equal(t, 0, decoded.queries[1].fields[ParameterField])
+}
+
+func Test_decodeClientRequestBinaryParameters(t *testing.T) {
+	request := encodeMessages(t,
+		&pgproto3.Bind{
+			ParameterFormatCodes: []int16{pgproto3.BinaryFormat, pgproto3.TextFormat},
+			Parameters:           [][]byte{[]byte("' OR 1=1 --"), []byte("1; DROP TABLE users")},
+		},
+	)
+
+	// The binary format of text is the raw string.
+	decoded := decodeClientRequest(request)
+	require.Len(t, decoded.queries, 2)
+	assert.Equal(t, "' OR 1=1 --", decoded.queries[0].text)
+	assert.Equal(t, 0, decoded.queries[0].fields[ParameterField])
+	assert.Equal(t, "1; DROP TABLE users", decoded.queries[1].text)
+	assert.Equal(t, 1, decoded.queries[1].fields[ParameterField])
+
+	// The binary encodings of numbers are skipped.
+	request = encodeMessages(t,
+		&pgproto3.Bind{
+			ParameterFormatCodes: []int16{pgproto3.BinaryFormat},
+			Parameters: [][]byte{
+				binary.BigEndian.AppendUint32(nil, 42),
+				binary.BigEndian.AppendUint64(nil, math.Float64bits(3.5)),
+				{0xff, 0xfe, 0x01, 0x02},
+				[]byte("admin' --\n"),
+			},
+		},
+	)
+	decoded = decodeClientRequest(request)
+	require.Len(t, decoded.queries, 1)
+	assert.Equal(t, "admin' --\n", decoded.queries[0].text)
+	assert.Equal(t, 3, decoded.queries[0].fields[ParameterField])
+}
+
+func Test_decodeClientRequestStartupMessage(t *testing.T) {
+	request := encodeMessages(t, &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+
+	decoded := decodeClientRequest(request)
+	assert.Empty(t, decoded.queries)
+}
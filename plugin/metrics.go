@@ -20,14 +20,80 @@ var (
 		Name:      "on_traffic_from_client_total",
 		Help:      "The total number of calls to the onTrafficFromClient method",
 	})
+	OnTrafficToServer = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "on_traffic_to_server_total",
+		Help:      "The total number of calls to the onTrafficToServer method",
+	})
+	OnTrafficFromServer = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "on_traffic_from_server_total",
+		Help:      "The total number of calls to the onTrafficFromServer method",
+	})
+	OnOpened = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "on_opened_total",
+		Help:      "The total number of calls to the onOpened method",
+	})
+	OnClosed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "on_closed_total",
+		Help:      "The total number of calls to the onClosed method",
+	})
 	Detections = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metrics.Namespace,
 		Name:      "detections_total",
 		Help:      "The total number of malicious requests detected",
-	}, []string{"detector"})
+	}, []string{"detector", "database", "user"})
 	Preventions = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: metrics.Namespace,
 		Name:      "preventions_total",
 		Help:      "The total number of malicious requests prevented",
-	}, []string{"response_type"})
+	}, []string{"response_type", "database", "user"})
+	CacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "verdict_cache_hits_total",
+		Help:      "The total number of queries whose verdict was found in the cache",
+	}, []string{"detector"})
+	CacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "verdict_cache_misses_total",
+		Help:      "The total number of queries whose verdict was not found in the cache",
+	}, []string{"detector"})
+	Allowlisted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "allowlisted_total",
+		Help:      "The total number of queries that skipped the detectors by the allowlist",
+	})
+	PredictionCircuitBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "prediction_circuit_breaker_state",
+		Help:      "The state of the prediction API circuit breaker: 0 closed, 1 half-open, 2 open",
+	})
+	PredictionCircuitBreakerRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "prediction_circuit_breaker_rejections_total",
+		Help:      "The total number of predictions rejected by the open circuit breaker",
+	})
+	PredictionBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metrics.Namespace,
+		Name:      "prediction_batch_size",
+		Help:      "The number of queries per batched request to the prediction API",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	})
+	MalformedPredictionResponses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "prediction_malformed_responses_total",
+		Help:      "The total number of prediction API responses without a valid score for every query",
+	})
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "config_reloads_total",
+		Help:      "The total number of config file reloads by result",
+	}, []string{"result"})
+	ActiveBans = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "active_bans",
+		Help:      "The number of client addresses and users that are currently banned",
+	})
 )
@@ -1,6 +1,9 @@
 package plugin
 
 import (
+	"strconv"
+	"strings"
+
 	sdkConfig "github.com/gatewayd-io/gatewayd-plugin-sdk/config"
 	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
 	goplugin "github.com/hashicorp/go-plugin"
@@ -36,11 +39,162 @@ var (
 			"metricsUnixDomainSocket": sdkConfig.GetEnv(
 				"METRICS_UNIX_DOMAIN_SOCKET", "/tmp/gatewayd-plugin-sql-ids-ips.sock"),
 			"metricsEndpoint": sdkConfig.GetEnv("METRICS_ENDPOINT", "/metrics"),
+
+			// The admin API is served via HTTP over the Unix domain socket, and
+			// keeps the given number of recent detections.
+			"adminEnabled": sdkConfig.GetEnv("ADMIN_ENABLED", "false"),
+			"adminUnixDomainSocket": sdkConfig.GetEnv(
+				"ADMIN_UNIX_DOMAIN_SOCKET", "/tmp/gatewayd-plugin-sql-ids-ips-admin.sock"),
+			"recentDetectionsSize": sdkConfig.GetEnv(
+				"RECENT_DETECTIONS_SIZE", strconv.Itoa(DefaultRecentDetectionsSize)),
+
+			// The wire protocol of the database.
+			// Possible values: postgres or mysql
+			"protocol": sdkConfig.GetEnv("PROTOCOL", PostgresProtocol),
+
+			// Possible values: prevent or detect-only
+			// detect-only: Detections are logged and counted, but never blocked.
+			"mode": sdkConfig.GetEnv("MODE", PreventMode),
+
+			// The protocol of the prediction API.
+			// Possible values: http, kserve or grpc
+			// http: The JSON API of the prediction API.
+			// kserve: The REST API of the KServe v2 inference protocol.
+			// grpc: The gRPC API of the KServe v2 inference protocol, at host:port.
+			"predictionBackend": sdkConfig.GetEnv("PREDICTION_BACKEND", PredictionBackendHTTP),
 			"predictionAPIAddress": sdkConfig.GetEnv(
 				"PREDICTION_API_ADDRESS", "http://localhost:8000"),
+			// The model, its BYTES input tensor and its output tensor of the
+			// KServe v2 backends. An empty output uses the first output.
+			"predictionModelName":   sdkConfig.GetEnv("PREDICTION_MODEL_NAME", DefaultModelName),
+			"predictionModelInput":  sdkConfig.GetEnv("PREDICTION_MODEL_INPUT", DefaultModelInput),
+			"predictionModelOutput": sdkConfig.GetEnv("PREDICTION_MODEL_OUTPUT", ""),
+			// The JSON paths of the scores in the responses of the predict and
+			// batch endpoints of the http backend, e.g. outputs[0][0], and "$"
+			// for the whole response. Nested arrays are flattened, and a missing
+			// or non-numeric score is a prediction failure.
+			"predictionScorePath":      sdkConfig.GetEnv("PREDICTION_SCORE_PATH", ConfidenceField),
+			"predictionBatchScorePath": sdkConfig.GetEnv("PREDICTION_BATCH_SCORE_PATH", ConfidencesField),
+			// The optional JSON paths of the labels of the scores, e.g. label and
+			// [*].label. If set, the score is the confidence of the label, and
+			// the confidence of an injection is one minus the score if the label
+			// is not the injection label, ignoring the case.
+			"predictionLabelPath":      sdkConfig.GetEnv("PREDICTION_LABEL_PATH", ""),
+			"predictionBatchLabelPath": sdkConfig.GetEnv("PREDICTION_BATCH_LABEL_PATH", ""),
+			"predictionInjectionLabel": sdkConfig.GetEnv("PREDICTION_INJECTION_LABEL", "injection"),
+			// The timeout of the prediction API in seconds.
+			"predictionTimeout": sdkConfig.GetEnv(
+				"PREDICTION_TIMEOUT", strconv.Itoa(int(DefaultPredictionTimeout.Seconds()))),
+			// Batch the predictions of concurrent queries into a single request
+			// of up to the batch size, which waits for up to the max wait in
+			// milliseconds for more queries. A batch size of 0 or 1 disables it.
+			"predictionBatchSize": sdkConfig.GetEnv("PREDICTION_BATCH_SIZE", "0"),
+			"predictionBatchMaxWait": sdkConfig.GetEnv(
+				"PREDICTION_BATCH_MAX_WAIT",
+				strconv.Itoa(int(DefaultPredictionBatchMaxWait.Milliseconds()))),
 			"threshold":                  sdkConfig.GetEnv("THRESHOLD", "0.8"),
 			"enableLibinjection":         sdkConfig.GetEnv("ENABLE_LIBINJECTION", "true"),
 			"libinjectionPermissiveMode": sdkConfig.GetEnv("LIBINJECTION_MODE", "true"),
+			// Inspect the normalized PostgreSQL query as well, if the raw query is
+			// clean, to detect queries obfuscated with comments, escape strings,
+			// CHR() and the like.
+			"normalizeQueries": sdkConfig.GetEnv("NORMALIZE_QUERIES", "false"),
+			// The statements of a PostgreSQL simple query with several statements
+			// are inspected one by one. Block such stacked queries right away, for
+			// applications that never send them.
+			"blockStackedQueries": sdkConfig.GetEnv("BLOCK_STACKED_QUERIES", "false"),
+
+			// What to do if the prediction API fails or the circuit breaker is open.
+			// Possible values: allow, block or libinjection (fall back to libinjection)
+			"onPredictionFailure": sdkConfig.GetEnv("ON_PREDICTION_FAILURE", FailureFallback),
+			// The circuit breaker opens after the given number of consecutive
+			// failures of the prediction API, and probes the API again after
+			// the open timeout in seconds. Zero failures disables the breaker.
+			"circuitBreakerFailureThreshold": sdkConfig.GetEnv(
+				"CIRCUIT_BREAKER_FAILURE_THRESHOLD",
+				strconv.Itoa(DefaultCircuitBreakerFailureThreshold)),
+			"circuitBreakerOpenTimeout": sdkConfig.GetEnv(
+				"CIRCUIT_BREAKER_OPEN_TIMEOUT",
+				strconv.Itoa(int(DefaultCircuitBreakerOpenTimeout.Seconds()))),
+
+			// Ordered, comma-separated list of detectors to run on each query.
+			// Possible values: deep_learning_model, libinjection, syntax_tree
+			"detectors": sdkConfig.GetEnv("DETECTORS", DeepLearningModel+","+Libinjection),
+			// Possible values: any (block if any detector flags the query)
+			// or all (block only if all detectors flag the query)
+			"detectorCombination": sdkConfig.GetEnv("DETECTOR_COMBINATION", CombineAny),
+
+			// The denylist denies the statements that call the functions, run the
+			// commands or refer to the relations of the lists, unless the user is
+			// exempt, regardless of the detectors. Functions and relations may be
+			// qualified by the schema.
+			// Possible actions: off, block (block the statements, unless in
+			// detect-only mode) or flag (log the statements and let them pass)
+			// Possible commands: copy_program, copy_file, create_extension,
+			// alter_system, load and do
+			"denylistAction":    sdkConfig.GetEnv("DENYLIST_ACTION", DenylistOff),
+			"denylistFunctions": sdkConfig.GetEnv("DENYLIST_FUNCTIONS", strings.Join(DefaultDenylistFunctions, ",")),
+			"denylistCommands":  sdkConfig.GetEnv("DENYLIST_COMMANDS", strings.Join(DefaultDenylistCommands, ",")),
+			"denylistObjects":   sdkConfig.GetEnv("DENYLIST_OBJECTS", strings.Join(DefaultDenylistObjects, ",")),
+			// Comma-separated list of users, e.g. DBAs, exempt from the denylist.
+			"denylistExemptUsers": sdkConfig.GetEnv("DENYLIST_EXEMPT_USERS", ""),
+
+			// Measure the latency of the queries, and flag the clients whose
+			// structurally similar queries are either fast or delayed, or are
+			// delayed by as many seconds as a number of the query, which reveals
+			// time-based blind injections. The latencies of the last queries of
+			// the window size are analyzed, and latencies from the min delay in
+			// milliseconds on are considered delayed.
+			"latencyAnalysis": sdkConfig.GetEnv("LATENCY_ANALYSIS", "false"),
+			"latencyWindowSize": sdkConfig.GetEnv(
+				"LATENCY_WINDOW_SIZE", strconv.Itoa(DefaultLatencyWindowSize)),
+			"latencyMinDelay": sdkConfig.GetEnv(
+				"LATENCY_MIN_DELAY", strconv.Itoa(int(DefaultLatencyMinDelay.Milliseconds()))),
+
+			// Cache the scores of the prediction API for repeated queries.
+			// Setting the size to zero disables the cache. The TTL is in seconds.
+			"verdictCacheSize": sdkConfig.GetEnv(
+				"VERDICT_CACHE_SIZE", strconv.Itoa(DefaultVerdictCacheSize)),
+			"verdictCacheTTL": sdkConfig.GetEnv(
+				"VERDICT_CACHE_TTL", strconv.Itoa(int(DefaultVerdictCacheTTL.Seconds()))),
+
+			// Possible values: off, learn or enforce
+			// learn: Record the fingerprints of the clean queries into the allowlist file.
+			// enforce: Queries with allowlisted fingerprints skip the detectors.
+			"allowlistMode": sdkConfig.GetEnv("ALLOWLIST_MODE", AllowlistOff),
+			"allowlistFile": sdkConfig.GetEnv("ALLOWLIST_FILE", AllowlistFile),
+			// The learning period in seconds, after which the allowlist switches
+			// to enforce mode. Zero means learning until the mode is changed.
+			"learningPeriod": sdkConfig.GetEnv("LEARNING_PERIOD", "0"),
+
+			// A YAML file of detection settings, allowlisted queries and policies,
+			// which override the settings of the plugin. The file is checked for
+			// changes at the reload interval in seconds, and an invalid file is
+			// rejected, so that the previous settings stay in effect.
+			"configFile": sdkConfig.GetEnv("CONFIG_FILE", ""),
+			"configReloadInterval": sdkConfig.GetEnv(
+				"CONFIG_RELOAD_INTERVAL",
+				strconv.Itoa(int(DefaultConfigReloadInterval.Seconds()))),
+
+			// A YAML file of policies that override the detection and response
+			// settings for clients matched by database, user, application name
+			// or client CIDR. The first matching policy applies.
+			"policyFile": sdkConfig.GetEnv("POLICY_FILE", ""),
+
+			// Ban a client after repeated detections: every detection adds one to
+			// the risk score of the client, which halves every half-life in seconds.
+			// Once the score reaches the ban score, all queries of the client are
+			// blocked for the ban duration in seconds. Zero disables the bans.
+			// Possible scopes: client (address), user or both, comma-separated.
+			"banScore": sdkConfig.GetEnv("BAN_SCORE", "0"),
+			"riskScoreHalfLife": sdkConfig.GetEnv(
+				"RISK_SCORE_HALF_LIFE", strconv.Itoa(int(DefaultRiskScoreHalfLife.Seconds()))),
+			"banDuration": sdkConfig.GetEnv(
+				"BAN_DURATION", strconv.Itoa(int(DefaultBanDuration.Seconds()))),
+			"banScope": sdkConfig.GetEnv("BAN_SCOPE", BanScopeClient),
+			// Send a fatal error to banned PostgreSQL clients, which makes them
+			// close the connection, or close it on their next message.
+			"terminateBannedConnections": sdkConfig.GetEnv("TERMINATE_BANNED_CONNECTIONS", "false"),
 
 			// Possible values: error or empty
 			"responseType": sdkConfig.GetEnv("RESPONSE_TYPE", ResponseType),
@@ -49,10 +203,19 @@ var (
 			"errorMessage": sdkConfig.GetEnv("ERROR_MESSAGE", ErrorMessage),
 
 			// Response type: error
-			// Possible severity values: DEBUG, LOG, INFO, NOTICE, WARNING, and EXCEPTION
+			// Possible severity values: DEBUG, LOG, INFO, NOTICE, WARNING, ERROR, and EXCEPTION
+			// The error number is the SQLSTATE of the error, e.g. 42000.
 			"errorSeverity": sdkConfig.GetEnv("ERROR_SEVERITY", ErrorSeverity),
 			"errorNumber":   sdkConfig.GetEnv("ERROR_NUMBER", ErrorNumber),
 			"errorDetail":   sdkConfig.GetEnv("ERROR_DETAIL", ErrorDetail),
+			// The error code of the MySQL error response. The error number
+			// is used as the SQL state.
+			"mysqlErrorCode": sdkConfig.GetEnv(
+				"MYSQL_ERROR_CODE", strconv.Itoa(int(MySQLErrorCode))),
+
+			// Abort the transaction of the client if a query is blocked
+			// inside a transaction block, by raising the error on the server.
+			"abortTransactionOnBlock": sdkConfig.GetEnv("ABORT_TRANSACTION_ON_BLOCK", "false"),
 
 			// Log an audit trail
 			"logLevel": sdkConfig.GetEnv("LOG_LEVEL", LogLevel),
@@ -61,7 +224,11 @@ var (
 			// Converting HookName to int32 is required because the plugin
 			// framework doesn't support enums.	See:
 			// https://github.com/gatewayd-io/gatewayd-plugin-sdk/issues/3
+			int32(v1.HookName_HOOK_NAME_ON_OPENED),
 			int32(v1.HookName_HOOK_NAME_ON_TRAFFIC_FROM_CLIENT),
+			int32(v1.HookName_HOOK_NAME_ON_TRAFFIC_TO_SERVER),
+			int32(v1.HookName_HOOK_NAME_ON_TRAFFIC_FROM_SERVER),
+			int32(v1.HookName_HOOK_NAME_ON_CLOSED),
 		},
 		"tags":       []interface{}{"plugin", "sql", "ids", "ips", "security", "waf"},
 		"categories": []interface{}{"plugin", "enterprise"},
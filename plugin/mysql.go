@@ -0,0 +1,647 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strconv"
+)
+
+// Commands of the MySQL client/server protocol.
+const (
+	mysqlComQuery            byte = 0x03
+	mysqlComStmtPrepare      byte = 0x16
+	mysqlComStmtExecute      byte = 0x17
+	mysqlComStmtSendLongData byte = 0x18
+	mysqlComStmtClose        byte = 0x19
+	mysqlComStmtReset        byte = 0x1a
+)
+
+// Packet headers and flags of the MySQL client/server protocol.
+const (
+	mysqlHeaderLength                       = 4
+	mysqlMaxPayloadLength                   = 1<<24 - 1
+	mysqlOKPacket                    byte   = 0x00
+	mysqlEOFPacket                   byte   = 0xfe
+	mysqlEOFPacketLength                    = 5
+	mysqlErrPacket                   byte   = 0xff
+	mysqlClientConnectWithDB         uint32 = 1 << 3
+	mysqlClientProtocol41            uint32 = 1 << 9
+	mysqlClientSecureConnection      uint32 = 1 << 15
+	mysqlClientPluginAuth            uint32 = 1 << 19
+	mysqlClientConnectAttrs          uint32 = 1 << 20
+	mysqlClientPluginAuthLenencData  uint32 = 1 << 21
+	mysqlClientQueryAttributes       uint32 = 1 << 27
+	mysqlParameterCountAvailable     byte   = 0x08
+	mysqlServerStatusInTrans         uint16 = 0x0001
+	mysqlServerStatusAutocommit      uint16 = 0x0002
+	mysqlServerStatusInTransReadonly uint16 = 0x2000
+	mysqlHandshakeResponseMinLength         = 32
+	// The connection attribute that is the equivalent of application_name.
+	mysqlProgramNameAttribute = "program_name"
+)
+
+// Column types of the MySQL binary protocol.
+const (
+	mysqlTypeDecimal    byte = 0x00
+	mysqlTypeTiny       byte = 0x01
+	mysqlTypeShort      byte = 0x02
+	mysqlTypeLong       byte = 0x03
+	mysqlTypeFloat      byte = 0x04
+	mysqlTypeDouble     byte = 0x05
+	mysqlTypeNull       byte = 0x06
+	mysqlTypeTimestamp  byte = 0x07
+	mysqlTypeLongLong   byte = 0x08
+	mysqlTypeInt24      byte = 0x09
+	mysqlTypeDate       byte = 0x0a
+	mysqlTypeTime       byte = 0x0b
+	mysqlTypeDateTime   byte = 0x0c
+	mysqlTypeYear       byte = 0x0d
+	mysqlTypeVarchar    byte = 0x0f
+	mysqlTypeBit        byte = 0x10
+	mysqlTypeJSON       byte = 0xf5
+	mysqlTypeNewDecimal byte = 0xf6
+	mysqlTypeEnum       byte = 0xf7
+	mysqlTypeSet        byte = 0xf8
+	mysqlTypeTinyBlob   byte = 0xf9
+	mysqlTypeMediumBlob byte = 0xfa
+	mysqlTypeLongBlob   byte = 0xfb
+	mysqlTypeBlob       byte = 0xfc
+	mysqlTypeVarString  byte = 0xfd
+	mysqlTypeString     byte = 0xfe
+	mysqlTypeGeometry   byte = 0xff
+)
+
+var errMySQLMalformedPacket = errors.New("malformed MySQL packet")
+
+// mysqlPacket is a packet of the MySQL client/server protocol.
+type mysqlPacket struct {
+	sequence byte
+	payload  []byte
+}
+
+// mysqlStatement is a prepared statement of a MySQL connection.
+type mysqlStatement struct {
+	query     string
+	numParams int
+	// types are the parameter types of the last execution, which are only
+	// sent by the client when they change.
+	types []byte
+	// longData are the parameter values sent with COM_STMT_SEND_LONG_DATA
+	// since the last execution, keyed by parameter index.
+	longData map[int][]byte
+}
+
+// readMySQLPackets splits the data into MySQL packets. A payload of the
+// maximum length continues in the next packet, so the payloads of such
+// packets are joined into a single packet with the sequence id of the first
+// one. An incomplete packet at the end is dropped.
+func readMySQLPackets(data []byte) []mysqlPacket {
+	packets := []mysqlPacket{}
+	var continued *mysqlPacket
+	for len(data) >= mysqlHeaderLength {
+		length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		if len(data) < mysqlHeaderLength+length {
+			break
+		}
+		payload := data[mysqlHeaderLength : mysqlHeaderLength+length]
+		if continued == nil {
+			continued = &mysqlPacket{sequence: data[3], payload: payload}
+		} else {
+			// The payload is copied, as it must not overwrite the data.
+			continued.payload = append(slices.Clip(continued.payload), payload...)
+		}
+		data = data[mysqlHeaderLength+length:]
+
+		if length < mysqlMaxPayloadLength {
+			packets = append(packets, *continued)
+			continued = nil
+		}
+	}
+	return packets
+}
+
+// writeMySQLPacket appends a packet with the given sequence id to the buffer.
+func writeMySQLPacket(buf []byte, sequence byte, payload []byte) []byte {
+	length := len(payload)
+	buf = append(buf, byte(length), byte(length>>8), byte(length>>16), sequence)
+	return append(buf, payload...)
+}
+
+// decodeMySQLRequest extracts the SQL of COM_QUERY and COM_STMT_PREPARE and
+// the string parameter values of COM_STMT_EXECUTE from the request, including
+// the values sent with COM_STMT_SEND_LONG_DATA. Packets of the connection
+// phase are used to learn the capabilities of the client.
+func decodeMySQLRequest(request []byte, conn *Connection) *clientRequest {
+	decoded := &clientRequest{}
+	for _, packet := range readMySQLPackets(request) {
+		if len(packet.payload) == 0 {
+			continue
+		}
+
+		// Commands always start a new sequence, so a packet with a non-zero
+		// sequence id belongs to the connection phase, unless the client has
+		// already sent a command.
+		if packet.sequence != 0 {
+			if conn.MySQLCommandPhase() {
+				continue
+			}
+			if capabilities, session, ok := mysqlHandshakeResponse(packet.payload); ok {
+				conn.SetMySQLCapabilities(capabilities)
+				if session != nil {
+					decoded.session = session
+				}
+			}
+			continue
+		}
+
+		conn.SetMySQLCommandPhase()
+		body := packet.payload[1:]
+
+		switch packet.payload[0] {
+		case mysqlComQuery:
+			query, err := mysqlQueryText(body, conn.MySQLCapabilities())
+			if err != nil {
+				continue
+			}
+			decoded.queries = append(decoded.queries, &clientQuery{
+				source: QuerySource,
+				text:   query,
+			})
+		case mysqlComStmtPrepare:
+			query := string(body)
+			decoded.mysqlPrepare = &query
+			decoded.queries = append(decoded.queries, &clientQuery{
+				source: ParseSource,
+				text:   string(body),
+			})
+		case mysqlComStmtExecute:
+			if len(body) >= 4 {
+				statementID := binary.LittleEndian.Uint32(body)
+				decoded.mysqlExecute = &statementID
+			}
+			decoded.queries = append(decoded.queries, mysqlExecuteParameters(body, conn)...)
+		case mysqlComStmtSendLongData:
+			// statement id (4), parameter id (2), data
+			if len(body) >= 6 {
+				conn.AppendMySQLLongData(binary.LittleEndian.Uint32(body),
+					int(binary.LittleEndian.Uint16(body[4:])), body[6:])
+			}
+		case mysqlComStmtReset:
+			if len(body) >= 4 {
+				conn.ResetMySQLLongData(binary.LittleEndian.Uint32(body))
+			}
+		case mysqlComStmtClose:
+			if len(body) >= 4 {
+				conn.CloseMySQLStatement(binary.LittleEndian.Uint32(body))
+			}
+		}
+	}
+	return decoded
+}
+
+// mysqlHandshakeResponse returns the capabilities of the client and the
+// session from the handshake response. An SSL request only contains the
+// capabilities, so the session is nil.
+func mysqlHandshakeResponse(payload []byte) (uint32, *Session, bool) {
+	if len(payload) < mysqlHandshakeResponseMinLength {
+		return 0, nil, false
+	}
+	capabilities := binary.LittleEndian.Uint32(payload)
+	if capabilities&mysqlClientProtocol41 == 0 {
+		return 0, nil, false
+	}
+	if len(payload) == mysqlHandshakeResponseMinLength {
+		return capabilities, nil, true
+	}
+
+	// Skip the capabilities, max packet size, character set and filler.
+	reader := &mysqlReader{data: payload, pos: mysqlHandshakeResponseMinLength}
+	user, err := reader.nullTerminatedString()
+	if err != nil {
+		return 0, nil, false
+	}
+	session := &Session{User: string(user)}
+
+	switch {
+	case capabilities&mysqlClientPluginAuthLenencData != 0:
+		_, err = reader.lengthEncodedString()
+	case capabilities&mysqlClientSecureConnection != 0:
+		var length byte
+		if length, err = reader.byte(); err == nil {
+			_, err = reader.bytes(int(length))
+		}
+	default:
+		_, err = reader.nullTerminatedString()
+	}
+	if err != nil {
+		return capabilities, session, true
+	}
+
+	if capabilities&mysqlClientConnectWithDB != 0 {
+		database, err := reader.nullTerminatedString()
+		if err != nil {
+			return capabilities, session, true
+		}
+		session.Database = string(database)
+	}
+	if capabilities&mysqlClientPluginAuth != 0 {
+		if _, err := reader.nullTerminatedString(); err != nil {
+			return capabilities, session, true
+		}
+	}
+	if capabilities&mysqlClientConnectAttrs != 0 {
+		length, err := reader.lengthEncodedInt()
+		if err != nil {
+			return capabilities, session, true
+		}
+		attributes, err := reader.bytes(int(length))
+		if err != nil {
+			return capabilities, session, true
+		}
+
+		attributeReader := &mysqlReader{data: attributes}
+		for len(attributeReader.rest()) > 0 {
+			key, err := attributeReader.lengthEncodedString()
+			if err != nil {
+				break
+			}
+			value, err := attributeReader.lengthEncodedString()
+			if err != nil {
+				break
+			}
+			if string(key) == mysqlProgramNameAttribute {
+				session.ApplicationName = string(value)
+			}
+		}
+	}
+
+	return capabilities, session, true
+}
+
+// mysqlCommandPacket returns the first command packet of the request.
+func mysqlCommandPacket(request []byte) (mysqlPacket, bool) {
+	for _, packet := range readMySQLPackets(request) {
+		if packet.sequence == 0 && len(packet.payload) > 0 {
+			return packet, true
+		}
+	}
+	return mysqlPacket{}, false
+}
+
+// mysqlQueryText returns the query of a COM_QUERY, skipping the query
+// attributes if the client supports them.
+func mysqlQueryText(body []byte, capabilities uint32) (string, error) {
+	if capabilities&mysqlClientQueryAttributes == 0 {
+		return string(body), nil
+	}
+
+	reader := &mysqlReader{data: body}
+	count, err := reader.lengthEncodedInt()
+	if err != nil {
+		return "", err
+	}
+	// The parameter set count is always 1.
+	if _, err := reader.lengthEncodedInt(); err != nil {
+		return "", err
+	}
+	if count > 0 {
+		if _, err := reader.parameters(int(count), nil, true, nil); err != nil {
+			return "", err
+		}
+	}
+	return string(reader.rest()), nil
+}
+
+// mysqlExecuteParameters returns the string parameter values of a
+// COM_STMT_EXECUTE, and the values sent with COM_STMT_SEND_LONG_DATA, which
+// are not part of the packet. The number of parameters of the statement is
+// learned from the response of the server to COM_STMT_PREPARE.
+func mysqlExecuteParameters(body []byte, conn *Connection) []*clientQuery {
+	reader := &mysqlReader{data: body}
+	statementID, err := reader.uint32()
+	if err != nil {
+		return nil
+	}
+	flags, err := reader.byte()
+	if err != nil {
+		return nil
+	}
+	// The iteration count is always 1.
+	if _, err := reader.uint32(); err != nil {
+		return nil
+	}
+
+	statement := conn.MySQLStatement(statementID)
+	if statement == nil {
+		return nil
+	}
+
+	numParams := statement.numParams
+	queryAttributes := conn.MySQLCapabilities()&mysqlClientQueryAttributes != 0
+	if queryAttributes && flags&mysqlParameterCountAvailable != 0 {
+		count, err := reader.lengthEncodedInt()
+		if err != nil {
+			return nil
+		}
+		numParams = int(count)
+	}
+	if numParams == 0 {
+		return nil
+	}
+
+	values, err := reader.parameters(numParams, statement.types, queryAttributes, statement.longData)
+	if err != nil {
+		return nil
+	}
+	conn.SetMySQLStatementTypes(statementID, reader.types)
+
+	queries := []*clientQuery{}
+	for idx, value := range values {
+		if value == nil || *value == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(*value, 64); err == nil {
+			continue
+		}
+		queries = append(queries, &clientQuery{
+			source: BindSource,
+			text:   *value,
+			fields: map[string]any{
+				PreparedStatementField: statement.query,
+				ParameterField:         idx,
+			},
+		})
+	}
+	return queries
+}
+
+// mysqlPrepareResponse returns the statement id and the number of parameters
+// from the response of the server to COM_STMT_PREPARE.
+func mysqlPrepareResponse(response []byte) (uint32, int, bool) {
+	packets := readMySQLPackets(response)
+	if len(packets) == 0 {
+		return 0, 0, false
+	}
+
+	payload := packets[0].payload
+	// status (1), statement id (4), columns (2), params (2), reserved (1)
+	if len(payload) < 10 || payload[0] != mysqlOKPacket {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint32(payload[1:5]),
+		int(binary.LittleEndian.Uint16(payload[7:9])),
+		true
+}
+
+// mysqlServerStatus returns the status flags of the last OK or EOF packet of
+// a response of the server. A packet that starts with 0x00 is only an OK
+// packet if it is the first packet of the response, as the rows of a result
+// set may start with 0x00 too, whereas a packet that starts with 0xfe is
+// always either an EOF packet or the OK packet that ends a result set.
+func mysqlServerStatus(response []byte) (uint16, bool) {
+	var status uint16
+	var found bool
+	for _, packet := range readMySQLPackets(response) {
+		payload := packet.payload
+		if len(payload) == 0 {
+			continue
+		}
+
+		switch {
+		case payload[0] == mysqlEOFPacket && len(payload) == mysqlEOFPacketLength:
+			// header, warnings and status flags
+			status, found = binary.LittleEndian.Uint16(payload[3:]), true
+		case payload[0] == mysqlEOFPacket && len(payload) < mysqlMaxPayloadLength,
+			payload[0] == mysqlOKPacket && packet.sequence == 1:
+			// header, affected rows, last insert id and status flags
+			reader := &mysqlReader{data: payload, pos: 1}
+			if _, err := reader.lengthEncodedInt(); err != nil {
+				continue
+			}
+			if _, err := reader.lengthEncodedInt(); err != nil {
+				continue
+			}
+			flags, err := reader.bytes(2)
+			if err != nil {
+				continue
+			}
+			status, found = binary.LittleEndian.Uint16(flags), true
+		}
+	}
+	return status, found
+}
+
+// mysqlErrorResponse creates an ERR_Packet in reply to the client packet
+// with the given sequence id. The SQL state is only sent to clients with the
+// CLIENT_PROTOCOL_41 capability. The capabilities are unknown if the
+// connection was opened before the plugin was loaded, in which case the
+// client is assumed to have it, like all current clients.
+func mysqlErrorResponse(sequence byte, capabilities uint32, code uint16, sqlState, message string) []byte {
+	payload := []byte{mysqlErrPacket, byte(code), byte(code >> 8)}
+	if capabilities == 0 || capabilities&mysqlClientProtocol41 != 0 {
+		// The SQL state is always 5 characters long.
+		state := []byte("HY000")
+		copy(state, sqlState)
+		payload = append(payload, '#')
+		payload = append(payload, state...)
+	}
+	payload = append(payload, message...)
+	return writeMySQLPacket(nil, sequence+1, payload)
+}
+
+// mysqlOKResponse creates an OK_Packet in reply to the client packet
+// with the given sequence id, which reports the transaction flags of the
+// status of the server.
+func mysqlOKResponse(sequence byte, serverStatus uint16) []byte {
+	status := serverStatus &
+		(mysqlServerStatusInTrans | mysqlServerStatusAutocommit | mysqlServerStatusInTransReadonly)
+	// header, affected rows, last insert id, status flags and warnings
+	payload := []byte{
+		mysqlOKPacket, 0, 0,
+		byte(status), byte(status >> 8),
+		0, 0,
+	}
+	return writeMySQLPacket(nil, sequence+1, payload)
+}
+
+// mysqlReader reads the data types of the MySQL protocol.
+type mysqlReader struct {
+	data []byte
+	pos  int
+	// types are the parameter types read by parameters.
+	types []byte
+}
+
+func (r *mysqlReader) byte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, errMySQLMalformedPacket
+	}
+	r.pos++
+	return r.data[r.pos-1], nil
+}
+
+func (r *mysqlReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errMySQLMalformedPacket
+	}
+	r.pos += n
+	return r.data[r.pos-n : r.pos], nil
+}
+
+func (r *mysqlReader) uint32() (uint32, error) {
+	data, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func (r *mysqlReader) rest() []byte {
+	return r.data[r.pos:]
+}
+
+func (r *mysqlReader) nullTerminatedString() ([]byte, error) {
+	end := bytes.IndexByte(r.data[r.pos:], 0)
+	if end < 0 {
+		return nil, errMySQLMalformedPacket
+	}
+	value := r.data[r.pos : r.pos+end]
+	r.pos += end + 1
+	return value, nil
+}
+
+func (r *mysqlReader) lengthEncodedInt() (uint64, error) {
+	first, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	switch first {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	default:
+		return uint64(first), nil
+	}
+
+	data, err := r.bytes(size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for i := size - 1; i >= 0; i-- {
+		value = value<<8 | uint64(data[i])
+	}
+	return value, nil
+}
+
+func (r *mysqlReader) lengthEncodedString() ([]byte, error) {
+	length, err := r.lengthEncodedInt()
+	if err != nil {
+		return nil, err
+	}
+	return r.bytes(int(length))
+}
+
+// parameters reads the parameters of the binary protocol: the NULL bitmap,
+// the new-params-bound flag, the types (and names with query attributes),
+// and the values. The values of string types are returned, and the values
+// of other types and NULLs are returned as nil. The values of the parameters
+// with long data are not part of the packet, so the long data is returned.
+func (r *mysqlReader) parameters(
+	count int, types []byte, names bool, longData map[int][]byte,
+) ([]*string, error) {
+	nullBitmap, err := r.bytes((count + 7) / 8)
+	if err != nil {
+		return nil, err
+	}
+
+	newParamsBound, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if newParamsBound == 1 {
+		types = make([]byte, 0, 2*count)
+		for range count {
+			paramType, err := r.bytes(2)
+			if err != nil {
+				return nil, err
+			}
+			types = append(types, paramType...)
+			if names {
+				if _, err := r.lengthEncodedString(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(types) != 2*count {
+		return nil, errMySQLMalformedPacket
+	}
+	r.types = types
+
+	values := make([]*string, count)
+	for idx := range count {
+		if data, ok := longData[idx]; ok {
+			text := string(data)
+			values[idx] = &text
+			continue
+		}
+		if nullBitmap[idx/8]&(1<<(idx%8)) != 0 {
+			continue
+		}
+
+		value, isString, err := r.value(types[2*idx])
+		if err != nil {
+			return nil, err
+		}
+		if isString {
+			text := string(value)
+			values[idx] = &text
+		}
+	}
+	return values, nil
+}
+
+// value reads a value of the given type of the binary protocol.
+func (r *mysqlReader) value(paramType byte) ([]byte, bool, error) {
+	switch paramType {
+	case mysqlTypeNull:
+		return nil, false, nil
+	case mysqlTypeTiny:
+		value, err := r.bytes(1)
+		return value, false, err
+	case mysqlTypeShort, mysqlTypeYear:
+		value, err := r.bytes(2)
+		return value, false, err
+	case mysqlTypeLong, mysqlTypeInt24, mysqlTypeFloat:
+		value, err := r.bytes(4)
+		return value, false, err
+	case mysqlTypeLongLong, mysqlTypeDouble:
+		value, err := r.bytes(8)
+		return value, false, err
+	case mysqlTypeDate, mysqlTypeDateTime, mysqlTypeTimestamp, mysqlTypeTime:
+		length, err := r.byte()
+		if err != nil {
+			return nil, false, err
+		}
+		value, err := r.bytes(int(length))
+		return value, false, err
+	case mysqlTypeDecimal, mysqlTypeNewDecimal, mysqlTypeBit, mysqlTypeGeometry:
+		value, err := r.lengthEncodedString()
+		return value, false, err
+	case mysqlTypeVarchar, mysqlTypeJSON, mysqlTypeEnum, mysqlTypeSet,
+		mysqlTypeTinyBlob, mysqlTypeMediumBlob, mysqlTypeLongBlob, mysqlTypeBlob,
+		mysqlTypeVarString, mysqlTypeString:
+		value, err := r.lengthEncodedString()
+		return value, true, err
+	default:
+		return nil, false, errMySQLMalformedPacket
+	}
+}
@@ -0,0 +1,314 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mysqlCommand encodes a MySQL command packet.
+func mysqlCommand(command byte, body []byte) []byte {
+	return writeMySQLPacket(nil, 0, append([]byte{command}, body...))
+}
+
+// mysqlLengthEncodedString encodes a short length-encoded string.
+func mysqlLengthEncodedString(value string) []byte {
+	return append([]byte{byte(len(value))}, value...)
+}
+
+func Test_decodeMySQLRequestQuery(t *testing.T) {
+	request := decodeMySQLRequest(
+		mysqlCommand(mysqlComQuery, []byte("SELECT * FROM users WHERE id = 1")), nil)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, QuerySource, request.queries[0].source)
+	assert.Equal(t, "SELECT * FROM users WHERE id = 1", request.queries[0].text)
+	assert.Nil(t, request.mysqlPrepare)
+}
+
+func Test_decodeMySQLRequestQueryAttributes(t *testing.T) {
+	conn := &Connection{}
+
+	// The handshake response announces the capabilities of the client.
+	handshake := make([]byte, mysqlHandshakeResponseMinLength)
+	binary.LittleEndian.PutUint32(handshake, mysqlClientProtocol41|mysqlClientQueryAttributes)
+	decodeMySQLRequest(writeMySQLPacket(nil, 1, append(handshake, "root\x00"...)), conn)
+	assert.Equal(t, mysqlClientProtocol41|mysqlClientQueryAttributes, conn.MySQLCapabilities())
+
+	// No attributes.
+	request := decodeMySQLRequest(
+		mysqlCommand(mysqlComQuery, append([]byte{0, 1}, "SELECT 1"...)), conn)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, "SELECT 1", request.queries[0].text)
+
+	// A single string attribute.
+	body := []byte{1, 1, 0, 1, mysqlTypeString, 0}
+	body = append(body, mysqlLengthEncodedString("trace")...)
+	body = append(body, mysqlLengthEncodedString("abc")...)
+	body = append(body, "SELECT 2"...)
+	request = decodeMySQLRequest(mysqlCommand(mysqlComQuery, body), conn)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, "SELECT 2", request.queries[0].text)
+}
+
+func Test_decodeMySQLRequestPreparedStatement(t *testing.T) {
+	conn := &Connection{}
+
+	request := decodeMySQLRequest(
+		mysqlCommand(mysqlComStmtPrepare, []byte("SELECT * FROM users WHERE name = ? AND id = ?")), conn)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, ParseSource, request.queries[0].source)
+	require.NotNil(t, request.mysqlPrepare)
+	conn.SetMySQLPendingPrepare(request.mysqlPrepare)
+
+	// COM_STMT_PREPARE_OK with statement id 7, no columns and 2 parameters.
+	conn.MySQLResponse(writeMySQLPacket(nil, 1, []byte{0, 7, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0}))
+	statement := conn.MySQLStatement(7)
+	require.NotNil(t, statement)
+	assert.Equal(t, 2, statement.numParams)
+
+	// COM_STMT_EXECUTE with a string and an integer parameter.
+	body := []byte{7, 0, 0, 0, 0, 1, 0, 0, 0}
+	body = append(body, 0, 1, mysqlTypeVarString, 0, mysqlTypeLong, 0)
+	body = append(body, mysqlLengthEncodedString("' OR 1=1 --")...)
+	body = append(body, 42, 0, 0, 0)
+	request = decodeMySQLRequest(mysqlCommand(mysqlComStmtExecute, body), conn)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, BindSource, request.queries[0].source)
+	assert.Equal(t, "' OR 1=1 --", request.queries[0].text)
+	assert.Equal(t, map[string]any{
+		PreparedStatementField: "SELECT * FROM users WHERE name = ? AND id = ?",
+		ParameterField:         0,
+	}, request.queries[0].fields)
+
+	// The types are not sent again if they did not change.
+	body = []byte{7, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0}
+	body = append(body, mysqlLengthEncodedString("admin' --")...)
+	body = append(body, 1, 0, 0, 0)
+	request = decodeMySQLRequest(mysqlCommand(mysqlComStmtExecute, body), conn)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, "admin' --", request.queries[0].text)
+
+	decodeMySQLRequest(mysqlCommand(mysqlComStmtClose, []byte{7, 0, 0, 0}), conn)
+	assert.Nil(t, conn.MySQLStatement(7))
+}
+
+func Test_prepareResponseMySQL(t *testing.T) {
+	p := &Plugin{
+		Logger:         hclog.NewNullLogger(),
+		Protocol:       MySQLProtocol,
+		ResponseType:   ResponseType,
+		ErrorMessage:   ErrorMessage,
+		ErrorNumber:    ErrorNumber,
+		MySQLErrorCode: MySQLErrorCode,
+		Connections:    NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, mysqlCommand(mysqlComQuery, []byte("SELECT 1 OR 1=1")))
+	resp := p.prepareResponse(req, map[string]any{})
+	packets := readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, byte(1), packets[0].sequence)
+	assert.Equal(t,
+		append([]byte{mysqlErrPacket, 0x51, 0x04, '#'}, "42000"+ErrorMessage...),
+		packets[0].payload)
+
+	// An empty response is an OK packet, except for prepared statements.
+	p.ResponseType = "empty"
+	resp = p.prepareResponse(req, map[string]any{})
+	packets = readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, mysqlOKPacket, packets[0].payload[0])
+
+	req = newTrafficRequest(t, mysqlCommand(mysqlComStmtPrepare, []byte("SELECT 1 OR 1=1")))
+	resp = p.prepareResponse(req, map[string]any{})
+	packets = readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, mysqlErrPacket, packets[0].payload[0])
+
+	// The SQL state is only sent to clients of the protocol 4.1.
+	p.ResponseType = ResponseType
+	p.connection(req).SetMySQLCapabilities(mysqlClientProtocol41)
+	resp = p.prepareResponse(req, map[string]any{})
+	packets = readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t,
+		append([]byte{mysqlErrPacket, 0x51, 0x04, '#'}, "42000"+ErrorMessage...),
+		packets[0].payload)
+
+	p.connection(req).SetMySQLCapabilities(mysqlClientSecureConnection)
+	resp = p.prepareResponse(req, map[string]any{})
+	packets = readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, append([]byte{mysqlErrPacket, 0x51, 0x04}, ErrorMessage...), packets[0].payload)
+}
+
+// keywordDetector flags the queries that contain the keyword.
+type keywordDetector struct {
+	keyword string
+}
+
+func (d *keywordDetector) Name() string {
+	return "keyword"
+}
+
+func (d *keywordDetector) Inspect(_ context.Context, query string) (*Verdict, error) {
+	return &Verdict{Detector: d.Name(), Injection: strings.Contains(query, d.keyword)}, nil
+}
+
+func Test_OnTrafficFromClientMySQL(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+
+	p := &Plugin{
+		Logger:         hclog.NewNullLogger(),
+		Protocol:       MySQLProtocol,
+		Detectors:      []string{"keyword"},
+		ResponseType:   ResponseType,
+		ErrorMessage:   ErrorMessage,
+		ErrorNumber:    ErrorNumber,
+		MySQLErrorCode: MySQLErrorCode,
+		Connections:    NewConnectionTracker(),
+	}
+
+	// A safe prepared statement is registered when the server responds.
+	req := newTrafficRequest(t, mysqlCommand(mysqlComStmtPrepare, []byte("SELECT * FROM users WHERE name = ?")))
+	resp, err := p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.Nil(t, resp.Fields[ResponseField])
+
+	serverResp := newTrafficRequest(t, nil)
+	serverResp.Fields[ResponseField] = v1.NewBytesValue(
+		writeMySQLPacket(nil, 1, []byte{0, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0}))
+	_, err = p.OnTrafficFromServer(context.Background(), serverResp)
+	require.NoError(t, err)
+	require.NotNil(t, p.connection(req).MySQLStatement(1))
+
+	// The injection is in the parameter of the statement.
+	body := []byte{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, mysqlTypeVarString, 0}
+	body = append(body, mysqlLengthEncodedString("x' OR 1=1 --")...)
+	req = newTrafficRequest(t, mysqlCommand(mysqlComStmtExecute, body))
+	resp, err = p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	packets := readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, mysqlErrPacket, packets[0].payload[0])
+}
+
+func Test_decodeMySQLRequestLongData(t *testing.T) {
+	conn := &Connection{}
+	conn.SetMySQLPendingPrepare(new(string))
+	conn.MySQLResponse(writeMySQLPacket(nil, 1, []byte{0, 7, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0}))
+
+	// The string parameter is sent in two COM_STMT_SEND_LONG_DATA packets.
+	request := decodeMySQLRequest(append(
+		mysqlCommand(mysqlComStmtSendLongData, append([]byte{7, 0, 0, 0, 0, 0}, "x' OR "...)),
+		mysqlCommand(mysqlComStmtSendLongData, append([]byte{7, 0, 0, 0, 0, 0}, "1=1 --"...))...,
+	), conn)
+	assert.Empty(t, request.queries)
+
+	// COM_STMT_EXECUTE only contains the integer parameter.
+	body := []byte{7, 0, 0, 0, 0, 1, 0, 0, 0}
+	body = append(body, 0, 1, mysqlTypeBlob, 0, mysqlTypeLong, 0)
+	body = append(body, 42, 0, 0, 0)
+	request = decodeMySQLRequest(mysqlCommand(mysqlComStmtExecute, body), conn)
+	require.Len(t, request.queries, 1)
+	assert.Equal(t, "x' OR 1=1 --", request.queries[0].text)
+	assert.Equal(t, 0, request.queries[0].fields[ParameterField])
+	require.NotNil(t, request.mysqlExecute)
+	assert.Equal(t, uint32(7), *request.mysqlExecute)
+
+	// The long data is kept until the server executes the statement.
+	conn.SetMySQLPendingExecute(request.mysqlExecute)
+	conn.MySQLResponse(writeMySQLPacket(nil, 1, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0}))
+	assert.Empty(t, conn.MySQLStatement(7).longData)
+
+	decodeMySQLRequest(
+		mysqlCommand(mysqlComStmtSendLongData, append([]byte{7, 0, 0, 0, 0, 0}, "data"...)), conn)
+	assert.Len(t, conn.MySQLStatement(7).longData, 1)
+	decodeMySQLRequest(mysqlCommand(mysqlComStmtReset, []byte{7, 0, 0, 0}), conn)
+	assert.Empty(t, conn.MySQLStatement(7).longData)
+}
+
+func Test_readMySQLPacketsMultiPacketPayload(t *testing.T) {
+	conn := &Connection{}
+	payload := append([]byte{mysqlComQuery}, "SELECT '"...)
+	payload = append(payload, strings.Repeat("a", mysqlMaxPayloadLength-len(payload))...)
+	continuation := []byte("' OR 1=1")
+
+	request := writeMySQLPacket(nil, 0, payload)
+	request = writeMySQLPacket(request, 1, continuation)
+	packets := readMySQLPackets(request)
+	require.Len(t, packets, 1)
+	assert.Equal(t, byte(0), packets[0].sequence)
+	assert.Len(t, packets[0].payload, mysqlMaxPayloadLength+len(continuation))
+
+	decoded := decodeMySQLRequest(request, conn)
+	require.Len(t, decoded.queries, 1)
+	assert.True(t, strings.HasSuffix(decoded.queries[0].text, "' OR 1=1"))
+
+	// Once the client has sent a command, packets with a non-zero sequence id
+	// are not handshake packets.
+	handshake := make([]byte, mysqlHandshakeResponseMinLength)
+	binary.LittleEndian.PutUint32(handshake, mysqlClientProtocol41|mysqlClientQueryAttributes)
+	decodeMySQLRequest(writeMySQLPacket(nil, 1, append(handshake, "root\x00"...)), conn)
+	assert.Zero(t, conn.MySQLCapabilities())
+}
+
+func Test_mysqlServerStatus(t *testing.T) {
+	// An OK packet with in transaction and autocommit.
+	status, ok := mysqlServerStatus(writeMySQLPacket(nil, 1, []byte{mysqlOKPacket, 0, 0, 3, 0, 0, 0}))
+	assert.True(t, ok)
+	assert.Equal(t, uint16(3), status)
+
+	// A result set, whose row starts with 0x00, ends with an EOF packet.
+	response := writeMySQLPacket(nil, 1, []byte{1})
+	response = writeMySQLPacket(response, 2, []byte{mysqlEOFPacket, 0, 0, 1, 0})
+	response = writeMySQLPacket(response, 3, []byte{0, 0, 0, 0, 0, 0, 0})
+	response = writeMySQLPacket(response, 4, []byte{mysqlEOFPacket, 0, 0, 0x01, 0x20})
+	status, ok = mysqlServerStatus(response)
+	assert.True(t, ok)
+	assert.Equal(t, mysqlServerStatusInTrans|mysqlServerStatusInTransReadonly, status)
+
+	// Or with an OK packet that starts with 0xfe.
+	status, ok = mysqlServerStatus(
+		writeMySQLPacket(nil, 5, []byte{mysqlEOFPacket, 0, 0, 0, 0, 0, 0}))
+	assert.True(t, ok)
+	assert.Zero(t, status)
+
+	_, ok = mysqlServerStatus(writeMySQLPacket(nil, 2, []byte{0, 0, 0, 0, 0, 0, 0}))
+	assert.False(t, ok)
+}
+
+func Test_prepareResponseMySQLServerStatus(t *testing.T) {
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		Protocol:     MySQLProtocol,
+		ResponseType: "empty",
+		Connections:  NewConnectionTracker(),
+	}
+	req := newTrafficRequest(t, mysqlCommand(mysqlComQuery, []byte("SELECT 1 OR 1=1")))
+
+	// The server is in autocommit mode until it reports otherwise.
+	resp := p.prepareResponse(req, map[string]any{})
+	packets := readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, []byte{mysqlOKPacket, 0, 0, 2, 0, 0, 0}, packets[0].payload)
+
+	// The response to BEGIN reports the transaction, and the status flags
+	// other than the transaction flags are not reported.
+	serverResp := newTrafficRequest(t, nil)
+	serverResp.Fields[ResponseField] = v1.NewBytesValue(
+		writeMySQLPacket(nil, 1, []byte{mysqlOKPacket, 0, 0, 0x0b, 0, 0, 0}))
+	_, err := p.OnTrafficFromServer(context.Background(), serverResp)
+	require.NoError(t, err)
+
+	resp = p.prepareResponse(req, map[string]any{})
+	packets = readMySQLPackets(resp.Fields[ResponseField].GetBytesValue())
+	require.Len(t, packets, 1)
+	assert.Equal(t, []byte{mysqlOKPacket, 0, 0, 3, 0, 0, 0}, packets[0].payload)
+}
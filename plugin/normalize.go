@@ -0,0 +1,340 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	pganalyze "github.com/pganalyze/pg_query_go/v6"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+// ErrQueryTooLong is returned for queries that are too long to normalize.
+var ErrQueryTooLong = errors.New("query is too long to normalize")
+
+// normToken is a token of a normalized query. String constants keep their
+// value, so that they can be concatenated and quoted the standard way.
+type normToken struct {
+	text     string
+	str      bool
+	value    string
+	function string
+	// builder accumulates the value of a string that is being concatenated.
+	builder *strings.Builder
+}
+
+// NormalizeQuery canonicalizes the forms of a PostgreSQL query that change
+// the verdicts of the detectors without changing the meaning of the query:
+// comments are dropped, whitespace is collapsed, reserved keywords are
+// uppercased and unquoted identifiers lowercased, dollar-quoted, escape and Unicode escape
+// strings are decoded into standard strings, and strings built with CHR(),
+// CONCAT() or || from constants are folded into one string. An error is
+// returned if the query can't be scanned, e.g. due to an unterminated string,
+// or is longer than MaxNormalizeQueryLength.
+func NormalizeQuery(query string) (string, error) {
+	if len(query) > MaxNormalizeQueryLength {
+		return "", fmt.Errorf("%w: %d bytes", ErrQueryTooLong, len(query))
+	}
+
+	scanned, err := pgQuery.Scan(query)
+	if err != nil {
+		return "", err
+	}
+
+	tokens := make([]normToken, 0, len(scanned.Tokens))
+	for idx := 0; idx < len(scanned.Tokens); idx++ {
+		token := scanned.Tokens[idx]
+		text := query[token.Start:token.End]
+		switch {
+		case token.Token == pganalyze.Token_C_COMMENT || token.Token == pganalyze.Token_SQL_COMMENT:
+			continue
+		case token.Token == pganalyze.Token_SCONST:
+			if value, ok := decodeString(text); ok {
+				tokens = append(tokens, normToken{str: true, value: value})
+				continue
+			}
+		case token.Token == pganalyze.Token_USCONST:
+			// The escape character of the string may be set by a UESCAPE clause.
+			escape := '\\'
+			if idx+2 < len(scanned.Tokens) && scanned.Tokens[idx+1].Token == pganalyze.Token_UESCAPE {
+				clause := scanned.Tokens[idx+2]
+				value, ok := decodeString(query[clause.Start:clause.End])
+				if ok && utf8.RuneCountInString(value) == 1 {
+					escape, _ = utf8.DecodeRuneInString(value)
+					idx += 2
+				}
+			}
+			if value, ok := decodeUnicodeString(text, escape); ok {
+				tokens = append(tokens, normToken{str: true, value: value})
+				continue
+			}
+		case token.KeywordKind == pganalyze.KeywordKind_UNRESERVED_KEYWORD:
+			// Unreserved keywords are mostly used as identifiers, e.g. name.
+			text = strings.ToLower(text)
+		case token.KeywordKind != pganalyze.KeywordKind_NO_KEYWORD:
+			text = strings.ToUpper(text)
+		case token.Token == pganalyze.Token_IDENT && !strings.HasPrefix(text, `"`):
+			text = strings.ToLower(text)
+			// Unquoted identifiers may be function names, which are folded.
+			tokens = append(tokens, normToken{text: text, function: text})
+			continue
+		}
+		tokens = append(tokens, normToken{text: text})
+	}
+
+	return joinTokens(foldStrings(tokens)), nil
+}
+
+// foldStrings folds the CHR() calls of a constant, CONCAT() calls of strings
+// and concatenations of strings into strings, in one pass from left to right.
+// Each token is appended to the output, after which the tail of the output is
+// folded as long as it ends with a foldable expression, so that the folded
+// strings are folded further, e.g. CONCAT(CHR(49), '=') || '1'.
+func foldStrings(tokens []normToken) []normToken {
+	folded := make([]normToken, 0, len(tokens))
+	for _, token := range tokens {
+		folded = append(folded, token)
+		for {
+			var ok bool
+			if folded, ok = foldTail(folded); !ok {
+				break
+			}
+		}
+	}
+	return folded
+}
+
+// foldTail folds the expression at the end of the tokens, if any, and returns
+// true if it did. The strings of a concatenation are appended to a builder, so
+// that a long concatenation is folded in linear time.
+func foldTail(tokens []normToken) ([]normToken, bool) {
+	last := len(tokens) - 1
+	switch {
+	case last >= 2 && tokens[last].str && tokens[last-1].text == "||" && tokens[last-2].str:
+		left := &tokens[last-2]
+		if left.builder == nil {
+			left.builder = &strings.Builder{}
+			left.builder.WriteString(left.value)
+		}
+		left.builder.WriteString(tokens[last].value)
+		left.value = left.builder.String()
+		return tokens[:last-1], true
+	case last >= 3 && tokens[last].text == ")" && tokens[last-2].text == "(" &&
+		tokens[last-3].function == "chr":
+		code, err := strconv.ParseInt(tokens[last-1].text, 10, 32)
+		if err != nil || code <= 0 || !utf8.ValidRune(rune(code)) {
+			return tokens, false
+		}
+		return append(tokens[:last-3], normToken{str: true, value: string(rune(code))}), true
+	case last >= 3 && tokens[last].text == ")":
+		// The arguments must be strings separated by commas.
+		start := last - 1
+		for start >= 2 && tokens[start].str && tokens[start-1].text == "," {
+			start -= 2
+		}
+		if start < 2 || !tokens[start].str || tokens[start-1].text != "(" || tokens[start-2].function != "concat" {
+			return tokens, false
+		}
+		var value strings.Builder
+		for idx := start; idx < last; idx += 2 {
+			value.WriteString(tokens[idx].value)
+		}
+		return append(tokens[:start-2], normToken{str: true, value: value.String()}), true
+	}
+	return tokens, false
+}
+
+// joinTokens joins the tokens with single spaces, except around punctuation
+// and between function names and their arguments.
+func joinTokens(tokens []normToken) string {
+	var builder strings.Builder
+	var previous normToken
+	for idx, token := range tokens {
+		text := token.text
+		if token.str {
+			text = "'" + strings.ReplaceAll(token.value, "'", "''") + "'"
+		}
+		call := previous.function != "" && text == "("
+		if idx > 0 && !call && !noSpaceAfter(previous.text) && !noSpaceBefore(text) {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(text)
+		previous = token
+	}
+	return builder.String()
+}
+
+func noSpaceBefore(text string) bool {
+	switch text {
+	case ",", ")", ".", ";", "::", "[", "]":
+		return true
+	}
+	return false
+}
+
+func noSpaceAfter(text string) bool {
+	switch text {
+	case "(", ".", "::", "[":
+		return true
+	}
+	return false
+}
+
+// decodeString returns the value of a standard, escape or dollar-quoted string
+// constant, or false if the constant has another form, e.g. a national string.
+func decodeString(text string) (string, bool) {
+	switch {
+	case strings.HasPrefix(text, "$"):
+		end := strings.Index(text[1:], "$")
+		if end == -1 {
+			return "", false
+		}
+		tag := text[:end+2]
+		if len(text) < 2*len(tag) || !strings.HasSuffix(text, tag) {
+			return "", false
+		}
+		return text[len(tag) : len(text)-len(tag)], true
+	case strings.HasPrefix(text, "'"):
+		return decodeQuoted(text, nil)
+	case strings.HasPrefix(text, "E'") || strings.HasPrefix(text, "e'"):
+		return decodeQuoted(text[1:], decodeEscape)
+	}
+	return "", false
+}
+
+// decodeUnicodeString returns the value of a Unicode escape string constant,
+// i.e. U&'...', with the given escape character.
+func decodeUnicodeString(text string, escape rune) (string, bool) {
+	if len(text) < 3 || !strings.EqualFold(text[:2], "U&") {
+		return "", false
+	}
+	value, ok := decodeQuoted(text[2:], nil)
+	if !ok {
+		return "", false
+	}
+
+	var builder strings.Builder
+	for rest := value; rest != ""; {
+		char, size := utf8.DecodeRuneInString(rest)
+		rest = rest[size:]
+		if char != escape {
+			builder.WriteRune(char)
+			continue
+		}
+
+		digits := 4
+		switch {
+		case strings.HasPrefix(rest, string(escape)):
+			builder.WriteRune(escape)
+			rest = rest[len(string(escape)):]
+			continue
+		case strings.HasPrefix(rest, "+"):
+			digits = 6
+			rest = rest[1:]
+		}
+		if len(rest) < digits {
+			return "", false
+		}
+		code, err := strconv.ParseUint(rest[:digits], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return "", false
+		}
+		builder.WriteRune(rune(code))
+		rest = rest[digits:]
+	}
+	return builder.String(), true
+}
+
+// decodeQuoted returns the value of a quoted string, including the strings
+// that continue it after whitespace with a newline. Doubled quotes are single
+// quotes, and the backslash escapes are decoded by the escape function, if any.
+func decodeQuoted(text string, escape func(text string) (string, int)) (string, bool) {
+	var builder strings.Builder
+	idx := 1
+	for idx < len(text) {
+		switch {
+		case text[idx] == '\\' && escape != nil:
+			value, size := escape(text[idx:])
+			builder.WriteString(value)
+			idx += size
+		case text[idx] == '\'' && idx+1 < len(text) && text[idx+1] == '\'':
+			builder.WriteByte('\'')
+			idx += 2
+		case text[idx] == '\'':
+			// The string ends, or continues after whitespace.
+			next := idx + 1
+			for next < len(text) && strings.ContainsRune(" \t\r\n\f", rune(text[next])) {
+				next++
+			}
+			if next == len(text) {
+				return builder.String(), true
+			}
+			if text[next] != '\'' {
+				return "", false
+			}
+			idx = next + 1
+		default:
+			builder.WriteByte(text[idx])
+			idx++
+		}
+	}
+	return "", false
+}
+
+// decodeEscape decodes the backslash escape at the start of the text of an
+// escape string, and returns its value and length.
+func decodeEscape(text string) (string, int) {
+	if len(text) < 2 {
+		return text, len(text)
+	}
+	switch text[1] {
+	case 'b':
+		return "\b", 2
+	case 'f':
+		return "\f", 2
+	case 'n':
+		return "\n", 2
+	case 'r':
+		return "\r", 2
+	case 't':
+		return "\t", 2
+	case 'x':
+		if size := hexDigits(text[2:], 2); size > 0 {
+			value, _ := strconv.ParseUint(text[2:2+size], 16, 8)
+			return string([]byte{byte(value)}), 2 + size
+		}
+	case 'u', 'U':
+		digits := 4
+		if text[1] == 'U' {
+			digits = 8
+		}
+		if hexDigits(text[2:], digits) == digits {
+			code, _ := strconv.ParseUint(text[2:2+digits], 16, 32)
+			if utf8.ValidRune(rune(code)) {
+				return string(rune(code)), 2 + digits
+			}
+		}
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		size := 1
+		for size < 3 && 1+size < len(text) && text[1+size] >= '0' && text[1+size] <= '7' {
+			size++
+		}
+		value, _ := strconv.ParseUint(text[1:1+size], 8, 16)
+		return string([]byte{byte(value)}), 1 + size
+	}
+	// Any other character stands for itself.
+	_, size := utf8.DecodeRuneInString(text[1:])
+	return text[1 : 1+size], 1 + size
+}
+
+// hexDigits returns the number of hex digits at the start of the text, up to
+// the max.
+func hexDigits(text string, limit int) int {
+	count := 0
+	for count < limit && count < len(text) && strings.ContainsRune("0123456789abcdefABCDEF", rune(text[count])) {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NormalizeQuery(t *testing.T) {
+	for query, expected := range map[string]string{
+		// Comments, including nested ones, whitespace and case.
+		"SeLeCt /* a /* b */ c */ *\n\tFROM  Users -- comment\nWHERE Id=1": "SELECT * FROM users WHERE id = 1",
+		// Quoted identifiers keep their case, and unreserved keywords are identifiers.
+		`select "Name", name from t`: `SELECT "Name", name FROM t`,
+		// Dollar-quoted, escape and Unicode escape strings.
+		"SELECT $tag$it's$tag$, E'\\x61dm\\151n\\'s', U&'d\\0061t\\+000061'": "SELECT 'it''s', 'admin''s', 'data'",
+		"SELECT U&'d!0061t' UESCAPE '!'":                                     "SELECT 'dat'",
+		"SELECT 'a'\n  'b', e'\\u00e9\\t'":                                   "SELECT 'ab', 'é\t'",
+		// Strings built with CHR(), CONCAT() and ||.
+		"SELECT * FROM t WHERE a = '' OR CHR(49)||chr(61)||Chr(49) = concat('1', '=', '1')": "SELECT * FROM t WHERE a = '' OR '1=1' = '1=1'",
+		// Folded strings are folded further.
+		"SELECT concat(chr(39), 'a') || chr(39) || 'b', x || 'c' || 'd'": "SELECT '''a''b', x || 'cd'",
+		// Calls with other arguments are left as is.
+		"SELECT concat(name, 'x'), chr(id), $1::text, a[1]": "SELECT concat(name, 'x'), chr(id), $1::text, a[1]",
+	} {
+		normalized, err := NormalizeQuery(query)
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, normalized, query)
+	}
+
+	_, err := NormalizeQuery("SELECT * FROM users WHERE name = '' OR 1=1 --'x")
+	require.NoError(t, err)
+	_, err = NormalizeQuery("SELECT * FROM users WHERE name = 'admin")
+	require.Error(t, err)
+
+	// Long concatenations are folded in one pass, and queries that are too
+	// long are not normalized.
+	concatenations := (MaxNormalizeQueryLength - 10) / 5
+	normalized, err := NormalizeQuery("SELECT 'a'" + strings.Repeat("||'a'", concatenations))
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT '"+strings.Repeat("a", concatenations+1)+"'", normalized)
+	_, err = NormalizeQuery("SELECT '" + strings.Repeat("a", MaxNormalizeQueryLength) + "'")
+	require.ErrorIs(t, err, ErrQueryTooLong)
+}
+
+func Test_InspectNormalized(t *testing.T) {
+	pipeline := &Pipeline{
+		Detectors: []Detector{&keywordDetector{keyword: "'1' = '1'"}},
+		Logger:    hclog.NewNullLogger(),
+	}
+	p := &Plugin{Logger: hclog.NewNullLogger(), NormalizeQueries: true}
+	query := &clientQuery{source: QuerySource, text: "SELECT * FROM t WHERE a = '' OR chr(49) = E'\\x31'"}
+
+	result := p.inspect(context.Background(), pipeline, query)
+	assert.True(t, result.Detected)
+	assert.Equal(t, NormalizedVariant, result.Variant)
+	assert.Equal(t, "SELECT * FROM t WHERE a = '' OR '1' = '1'", result.NormalizedQuery)
+
+	// The raw query is reported if it is detected as is.
+	result = p.inspect(context.Background(), pipeline, &clientQuery{text: "SELECT 1 WHERE '1' = '1'"})
+	assert.True(t, result.Detected)
+	assert.Equal(t, RawVariant, result.Variant)
+	assert.Empty(t, result.NormalizedQuery)
+
+	result = p.inspect(context.Background(), pipeline, &clientQuery{text: "SELECT chr(50) = '1'"})
+	assert.False(t, result.Detected)
+	assert.Empty(t, result.Variant)
+
+	// The queries are not normalized if disabled, or for MySQL.
+	for _, plugin := range []*Plugin{
+		{Logger: hclog.NewNullLogger()},
+		{Logger: hclog.NewNullLogger(), NormalizeQueries: true, Protocol: MySQLProtocol},
+	} {
+		result = plugin.inspect(context.Background(), pipeline, query)
+		assert.False(t, result.Detected)
+	}
+}
+
+func Test_EvaluationAddNormalized(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "'1' = '1'"} })
+	p := &Plugin{
+		Logger:           hclog.NewNullLogger(),
+		Detectors:        []string{"keyword"},
+		NormalizeQueries: true,
+	}
+
+	evaluation := NewEvaluation()
+	evaluation.Add(context.Background(), p, LabeledQuery{
+		ScanQuery: ScanQuery{Text: "SELECT 1 WHERE '' = '' OR chr(49) = E'\\x31'"},
+		Injection: true,
+	})
+	assert.Equal(t, ConfusionMatrix{TruePositives: 1}, evaluation.Combined)
+	assert.Equal(t, ConfusionMatrix{TruePositives: 1}, evaluation.Detectors["keyword"].Matrix)
+}
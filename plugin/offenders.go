@@ -0,0 +1,246 @@
+package plugin
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OffenderTracker keeps a risk score per client address and user, which is
+// increased by one on each detection and decays exponentially with the given
+// half-life. Once the score of a client reaches the ban score, all queries of
+// the client are blocked for the ban duration, so that an attacker cannot
+// keep probing payloads until one of them passes.
+type OffenderTracker struct {
+	mu          sync.Mutex
+	scopes      []string
+	banScore    float64
+	halfLife    time.Duration
+	banDuration time.Duration
+	scores      map[string]*riskScore
+	bans        map[string]time.Time
+	// unbans are the lifted bans that are not yet in the audit trail.
+	unbans []Ban
+	now    func() time.Time
+}
+
+// minRiskScore is the score below which a client is forgotten.
+const minRiskScore = 0.01
+
+type riskScore struct {
+	value     float64
+	updatedAt time.Time
+}
+
+// Ban is an active ban of a client address or user.
+type Ban struct {
+	// Offender is the banned client, e.g. client:10.0.0.1 or user:alice.
+	Offender string    `json:"offender"`
+	Until    time.Time `json:"until"`
+}
+
+// NewOffenderTracker returns a new OffenderTracker that tracks the clients by
+// the given scopes, i.e. BanScopeClient and BanScopeUser.
+func NewOffenderTracker(
+	scopes []string, banScore float64, halfLife, banDuration time.Duration,
+) *OffenderTracker {
+	return &OffenderTracker{
+		scopes:      scopes,
+		banScore:    banScore,
+		halfLife:    halfLife,
+		banDuration: banDuration,
+		scores:      map[string]*riskScore{},
+		bans:        map[string]time.Time{},
+		now:         time.Now,
+	}
+}
+
+// offenders returns the keys of the session in the tracked scopes.
+func (t *OffenderTracker) offenders(session Session) []string {
+	offenders := []string{}
+	for _, scope := range t.scopes {
+		switch scope {
+		case BanScopeClient:
+			if addr, ok := clientIP(session.ClientAddress); ok {
+				offenders = append(offenders, BanScopeClient+":"+addr.String())
+			}
+		case BanScopeUser:
+			if session.User != "" {
+				offenders = append(offenders, BanScopeUser+":"+session.User)
+			}
+		}
+	}
+	return offenders
+}
+
+// Banned returns the active ban of the session, if any.
+func (t *OffenderTracker) Banned(session Session) (Ban, bool) {
+	if t == nil {
+		return Ban{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for _, offender := range t.offenders(session) {
+		if until, ok := t.bans[offender]; ok && now.Before(until) {
+			return Ban{Offender: offender, Until: until}, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Record increases the risk score of the session after a detection, and
+// returns the bans that were caused by it.
+func (t *OffenderTracker) Record(session Session) []Ban {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var bans []Ban
+	for _, offender := range t.offenders(session) {
+		score, ok := t.scores[offender]
+		if !ok {
+			score = &riskScore{}
+			t.scores[offender] = score
+		}
+		score.value = t.decay(score, now) + 1
+		score.updatedAt = now
+
+		if score.value < t.banScore {
+			continue
+		}
+		if until, ok := t.bans[offender]; ok && now.Before(until) {
+			continue
+		}
+
+		until := now.Add(t.banDuration)
+		t.bans[offender] = until
+		// The client starts with a clean slate after the ban.
+		delete(t.scores, offender)
+		bans = append(bans, Ban{Offender: offender, Until: until})
+	}
+	ActiveBans.Set(float64(len(t.bans)))
+	return bans
+}
+
+// Ban bans the offender for the ban duration, e.g. client:10.0.0.1 or
+// user:alice.
+func (t *OffenderTracker) Ban(offender string) Ban {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until := t.now().Add(t.banDuration)
+	t.bans[offender] = until
+	ActiveBans.Set(float64(len(t.bans)))
+	return Ban{Offender: offender, Until: until}
+}
+
+// Unban lifts the ban of the offender and resets its risk score, and returns
+// false if it was not banned.
+func (t *OffenderTracker) Unban(offender string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.bans[offender]
+	delete(t.bans, offender)
+	delete(t.scores, offender)
+	ActiveBans.Set(float64(len(t.bans)))
+	if ok {
+		t.addUnban(Ban{Offender: offender, Until: until})
+	}
+	return ok
+}
+
+// addUnban keeps the lifted ban until it is logged to the audit trail, and
+// drops the oldest lifted bans beyond MaxPendingUnbans.
+func (t *OffenderTracker) addUnban(ban Ban) {
+	t.unbans = append(t.unbans, ban)
+	if len(t.unbans) > MaxPendingUnbans {
+		t.unbans = t.unbans[len(t.unbans)-MaxPendingUnbans:]
+	}
+}
+
+// TakeUnbans returns the bans lifted since the last call, which are logged to
+// the audit trail with the next request, as the bans are lifted in the
+// background.
+func (t *OffenderTracker) TakeUnbans() []Ban {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unbans := t.unbans
+	t.unbans = nil
+	return unbans
+}
+
+// Bans returns the active bans.
+func (t *OffenderTracker) Bans() []Ban {
+	if t == nil {
+		return []Ban{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	bans := []Ban{}
+	for offender, until := range t.bans {
+		if now.Before(until) {
+			bans = append(bans, Ban{Offender: offender, Until: until})
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int {
+		return strings.Compare(a.Offender, b.Offender)
+	})
+	return bans
+}
+
+// Expire lifts the expired bans and forgets the scores that have decayed to
+// almost nothing, and returns the lifted bans.
+func (t *OffenderTracker) Expire() []Ban {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var expired []Ban
+	for offender, until := range t.bans {
+		if !now.Before(until) {
+			delete(t.bans, offender)
+			expired = append(expired, Ban{Offender: offender, Until: until})
+			t.addUnban(Ban{Offender: offender, Until: until})
+		}
+	}
+	for offender, score := range t.scores {
+		if t.decay(score, now) < minRiskScore {
+			delete(t.scores, offender)
+		}
+	}
+	ActiveBans.Set(float64(len(t.bans)))
+	return expired
+}
+
+// ExpirePeriodically lifts the expired bans at the given interval and calls
+// onUnban for each of them.
+func (t *OffenderTracker) ExpirePeriodically(interval time.Duration, onUnban func(Ban)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, ban := range t.Expire() {
+			onUnban(ban)
+		}
+	}
+}
+
+// decay returns the score decayed until now.
+func (t *OffenderTracker) decay(score *riskScore, now time.Time) float64 {
+	if t.halfLife <= 0 {
+		return score.value
+	}
+	elapsed := now.Sub(score.updatedAt)
+	return score.value * math.Pow(0.5, elapsed.Seconds()/t.halfLife.Seconds())
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_OffenderTracker(t *testing.T) {
+	now := time.Now()
+	tracker := NewOffenderTracker([]string{BanScopeClient}, 3, time.Minute, time.Hour)
+	tracker.now = func() time.Time { return now }
+	session := Session{User: "alice", ClientAddress: "10.0.0.1:5432"}
+
+	assert.Empty(t, tracker.Record(session))
+	assert.Empty(t, tracker.Record(session))
+
+	// The score halves after the half-life, so the third detection is not enough.
+	now = now.Add(time.Minute)
+	assert.Empty(t, tracker.Record(session))
+	_, banned := tracker.Banned(session)
+	assert.False(t, banned)
+
+	bans := tracker.Record(session)
+	require.Len(t, bans, 1)
+	assert.Equal(t, "client:10.0.0.1", bans[0].Offender)
+	assert.Equal(t, now.Add(time.Hour), bans[0].Until)
+
+	// Other connections of the same client are banned too.
+	ban, banned := tracker.Banned(Session{ClientAddress: "10.0.0.1:6543"})
+	assert.True(t, banned)
+	assert.Equal(t, "client:10.0.0.1", ban.Offender)
+	_, banned = tracker.Banned(Session{User: "alice", ClientAddress: "10.0.0.2:5432"})
+	assert.False(t, banned)
+
+	// The ban is lifted after the ban duration.
+	now = now.Add(time.Hour)
+	_, banned = tracker.Banned(session)
+	assert.False(t, banned)
+	expired := tracker.Expire()
+	require.Len(t, expired, 1)
+	assert.Equal(t, "client:10.0.0.1", expired[0].Offender)
+	assert.Empty(t, tracker.scores)
+
+	// The lifted bans are kept for the audit trail until they are taken.
+	tracker.Ban("user:alice")
+	assert.True(t, tracker.Unban("user:alice"))
+	assert.False(t, tracker.Unban("user:alice"))
+	unbans := tracker.TakeUnbans()
+	require.Len(t, unbans, 2)
+	assert.Equal(t, "client:10.0.0.1", unbans[0].Offender)
+	assert.Equal(t, "user:alice", unbans[1].Offender)
+	assert.Empty(t, tracker.TakeUnbans())
+}
+
+func Test_OffenderTrackerUserScope(t *testing.T) {
+	tracker := NewOffenderTracker([]string{BanScopeClient, BanScopeUser}, 1, time.Minute, time.Hour)
+
+	bans := tracker.Record(Session{User: "alice", ClientAddress: "10.0.0.1:5432"})
+	require.Len(t, bans, 2)
+
+	ban, banned := tracker.Banned(Session{User: "alice", ClientAddress: "10.0.0.2:5432"})
+	assert.True(t, banned)
+	assert.Equal(t, "user:alice", ban.Offender)
+
+	var nilTracker *OffenderTracker
+	_, banned = nilTracker.Banned(Session{User: "alice"})
+	assert.False(t, banned)
+	assert.Nil(t, nilTracker.Record(Session{User: "alice"}))
+	assert.Nil(t, nilTracker.TakeUnbans())
+}
+
+func Test_OnTrafficFromClientBannedClient(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		Detectors:    []string{"keyword"},
+		ResponseType: ResponseType,
+		Connections:  NewConnectionTracker(),
+		Offenders:    NewOffenderTracker([]string{BanScopeClient}, 1, time.Minute, time.Hour),
+	}
+
+	resp, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"})))
+	require.NoError(t, err)
+	assert.NotNil(t, resp.Fields[ResponseField])
+	assert.Len(t, p.Offenders.bans, 1)
+
+	// A harmless query of the banned client is blocked as well.
+	resp, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT 1"})))
+	require.NoError(t, err)
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ErrorResponse{},
+		&pgproto3.ReadyForQuery{},
+	}, decodeResponse(t, resp.Fields[ResponseField].GetBytesValue()))
+
+	// With terminate banned connections, the client gets a fatal error.
+	p.TerminateBannedConnections = true
+	resp, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT 1"})))
+	require.NoError(t, err)
+	messages := decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{&pgproto3.ErrorResponse{}}, messages)
+
+	// The connection is closed if the client ignores the fatal error.
+	_, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT 1"})))
+	require.ErrorIs(t, err, ErrConnectionTerminated)
+}
+
+func Test_OnTrafficFromClientUnbans(t *testing.T) {
+	p := &Plugin{
+		Logger:      hclog.NewNullLogger(),
+		Detectors:   []string{SyntaxTree},
+		Connections: NewConnectionTracker(),
+		Offenders:   NewOffenderTracker([]string{BanScopeClient}, 1, time.Minute, time.Hour),
+	}
+	ban := p.Offenders.Ban("client:10.0.0.1")
+	require.True(t, p.Offenders.Unban(ban.Offender))
+
+	// The lifted ban is logged to the audit trail with the next request.
+	resp, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT 1"})))
+	require.NoError(t, err)
+	assert.Nil(t, resp.Fields[ResponseField])
+	signals := resp.Fields[sdkAct.Signals].GetListValue().AsSlice()
+	require.Len(t, signals, 1)
+	metadata := signals[0].(map[string]any)["metadata"].(map[string]any)
+	assert.Equal(t, "Client unbanned", metadata["message"])
+	assert.Equal(t, UnbanAction, metadata[ActionField])
+	assert.Equal(t, "client:10.0.0.1", metadata[OffenderField])
+	assert.Equal(t, ban.Until.Format(time.RFC3339), metadata[BannedUntilField])
+
+	// The unbans are only logged once.
+	resp, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT 1"})))
+	require.NoError(t, err)
+	assert.Nil(t, resp.Fields[sdkAct.Signals])
+}
@@ -2,21 +2,14 @@ package plugin
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"io"
 	"time"
 
-	"github.com/carlmjohnson/requests"
-	"github.com/corazawaf/libinjection-go"
-	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
 	"github.com/gatewayd-io/gatewayd-plugin-sdk/databases/postgres"
-	sdkPlugin "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin"
 	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
 	"github.com/hashicorp/go-hclog"
 	goplugin "github.com/hashicorp/go-plugin"
-	"github.com/jackc/pgx/v5/pgproto3"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/spf13/cast"
 	"google.golang.org/grpc"
 )
 
@@ -25,17 +18,45 @@ type Plugin struct {
 	v1.GatewayDPluginServiceServer
 
 	Logger                     hclog.Logger
+	Protocol                   string
+	Mode                       string
 	Threshold                  float32
 	EnableLibinjection         bool
 	LibinjectionPermissiveMode bool
+	NormalizeQueries           bool
+	BlockStackedQueries        bool
 	PredictionAPIAddress       string
 	ResponseType               string
 	ErrorMessage               string
 	ErrorSeverity              string
 	ErrorNumber                string
 	ErrorDetail                string
+	MySQLErrorCode             uint16
 	LogLevel                   string
 	PredictionTimeout          time.Duration
+	Detectors                  []string
+	DetectorCombination        string
+	DenylistFunctions          []string
+	DenylistCommands           []string
+	DenylistObjects            []string
+	DenylistExemptUsers        []string
+	DenylistAction             string
+	OnPredictionFailure        string
+	AbortTransactionOnBlock    bool
+	Connections                *ConnectionTracker
+	Cache                      *VerdictCache
+	Allowlist                  *Allowlist
+	Breaker                    *CircuitBreaker
+	Backend                    PredictionBackend
+	Batcher                    *PredictionBatcher
+	Policies                   []*Policy
+	Offenders                  *OffenderTracker
+	TerminateBannedConnections bool
+	ModeSwitch                 *ModeSwitch
+	RecentDetections           *DetectionLog
+	ConfigFile                 *ConfigFile
+	StaticAllowlist            *Allowlist
+	Latency                    *LatencyAnalyzer
 }
 
 type InjectionDetectionPlugin struct {
@@ -79,160 +100,401 @@ func (p *Plugin) GetPluginConfig(ctx context.Context, _ *v1.Struct) (*v1.Struct,
 // or a response.
 func (p *Plugin) OnTrafficFromClient(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
 	OnTrafficFromClient.Inc()
-	// Handle the client message.
-	req, err := postgres.HandleClientMessage(req, p.Logger)
-	if err != nil {
-		p.Logger.Debug("Failed to handle client message", ErrorField, err)
-		return req, err
+	// The settings of the config file apply, as of the time of the request.
+	p = p.current()
+
+	conn := p.connection(req)
+	if conn.Terminated() {
+		p.Logger.Debug("Closing the connection of a banned client")
+		return req, ErrConnectionTerminated
 	}
+	p.logUnbans(req)
+
+	var request *clientRequest
+	if p.Protocol == MySQLProtocol {
+		// Extract the queries from all the packets in the request.
+		request = decodeMySQLRequest(req.Fields[RequestField].GetBytesValue(), conn)
+		// The prepared statement is registered when the server responds,
+		// unless the request is blocked.
+		conn.SetMySQLPendingPrepare(request.mysqlPrepare)
+		conn.SetMySQLPendingExecute(request.mysqlExecute)
+	} else {
+		// Handle the client message.
+		var err error
+		req, err = postgres.HandleClientMessage(req, p.Logger)
+		if err != nil {
+			p.Logger.Debug("Failed to handle client message", ErrorField, err)
+			return req, err
+		}
 
-	// Get the query from the request.
-	query := cast.ToString(sdkPlugin.GetAttr(req, QueryField, ""))
-	if query == "" {
+		// Extract the queries from all the messages in the request.
+		request = decodeClientRequest(req.Fields[RequestField].GetBytesValue())
+		if conn.SkipUntilSync() {
+			remaining := fromFirstSync(req.Fields[RequestField].GetBytesValue())
+			if len(remaining) <= syncMessageLength {
+				return p.discardUntilSync(req, request, conn), nil
+			}
+			// The messages after Sync are inspected like any other request.
+			request = p.discardBeforeSync(req, remaining, conn)
+		}
+	}
+	if request.session != nil {
+		request.session.ClientAddress = connectionKey(req)
+		conn.SetSession(*request.session)
+	}
+	if len(request.queries) == 0 {
 		p.Logger.Debug("Failed to get query from request, possibly not a SQL query request")
 		return req, nil
 	}
-	p.Logger.Trace("Query", QueryField, query)
 
-	// Decode the query.
-	decodedQuery, err := base64.StdEncoding.DecodeString(query)
-	if err != nil {
-		return req, err
+	session := conn.Session()
+	if session.ClientAddress == "" {
+		// The connection was opened before the plugin was loaded.
+		session.ClientAddress = connectionKey(req)
 	}
-	p.Logger.Trace("Decoded Query", DecodedQueryField, decodedQuery)
+	ctx = WithSession(ctx, session)
 
-	// Unmarshal query into a map.
-	var queryMap map[string]any
-	if err := json.Unmarshal(decodedQuery, &queryMap); err != nil {
-		p.Logger.Error("Failed to unmarshal query", ErrorField, err)
-		return req, nil
-	}
-	queryString := cast.ToString(queryMap[StringField])
+	// The settings of the policy that matches the client apply.
+	effective, policy := p.withPolicy(session)
 
-	timeout := p.PredictionTimeout
-	if timeout == 0 {
-		timeout = DefaultPredictionTimeout
+	if ban, ok := p.Offenders.Banned(session); ok {
+		p.Logger.Warn("Blocked query of banned client", OffenderField, ban.Offender)
+		fields := session.Fields()
+		fields[OffenderField] = ban.Offender
+		fields[BannedUntilField] = ban.Until.Format(time.RFC3339)
+		resp := effective.banResponse(req, fields)
+		if effective.mode() == DetectOnlyMode {
+			// The query passes through, so it is timed as well.
+			p.timeRequest(conn, request)
+		}
+		return resp, nil
 	}
-	reqCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
 
-	var output map[string]any
-	err = requests.
-		URL(p.PredictionAPIAddress).
-		Path(PredictPath).
-		BodyJSON(map[string]any{
-			QueryField: queryString,
-		}).
-		ToJSON(&output).
-		Fetch(reqCtx)
-	if err != nil {
-		p.Logger.Error("Failed to make POST request", ErrorField, err)
-		if p.isSQLi(queryString) && !p.LibinjectionPermissiveMode {
-			return p.prepareResponse(
-				req,
-				map[string]any{
-					QueryField:    queryString,
-					DetectorField: Libinjection,
-					ErrorField:    "Failed to make POST request to tokenizer API",
-				},
-			), nil
+	pipeline := effective.pipeline()
+	for _, query := range request.queries {
+		result := effective.inspect(ctx, pipeline, query)
+		verdict := result.Verdict()
+		flagged := verdict == nil && result.Flagged != nil
+		if flagged {
+			verdict = result.Flagged
+		}
+		if verdict == nil {
+			continue
 		}
-		return req, nil
-	}
 
-	confidence := cast.ToFloat32(output[ConfidenceField])
-	p.Logger.Trace("Deep learning model prediction", ConfidenceField, confidence)
-
-	// Check the prediction against the threshold,
-	// otherwise check if the query is an SQL injection using libinjection.
-	injection := p.isSQLi(queryString)
-	if confidence >= p.Threshold {
-		if p.EnableLibinjection && !injection {
-			p.Logger.Debug("False positive detected", DetectorField, Libinjection)
-		}
-
-		Detections.With(map[string]string{DetectorField: DeepLearningModel}).Inc()
-		p.Logger.Warn(p.ErrorMessage, ConfidenceField, confidence, DetectorField, DeepLearningModel)
-		return p.prepareResponse(
-			req,
-			map[string]any{
-				QueryField:      queryString,
-				ConfidenceField: confidence,
-				DetectorField:   DeepLearningModel,
-			},
-		), nil
-	} else if p.EnableLibinjection && injection && !p.LibinjectionPermissiveMode {
-		Detections.With(map[string]string{DetectorField: Libinjection}).Inc()
-		p.Logger.Warn(p.ErrorMessage, DetectorField, Libinjection)
-		return p.prepareResponse(
-			req,
-			map[string]any{
-				QueryField:    queryString,
-				DetectorField: Libinjection,
-			},
-		), nil
-	} else {
-		p.Logger.Trace("No SQL injection detected")
+		Detections.With(map[string]string{
+			DetectorField: verdict.Detector,
+			DatabaseField: session.Database,
+			UserField:     session.User,
+		}).Inc()
+		p.Logger.Warn(
+			effective.ErrorMessage,
+			DetectorField, verdict.Detector,
+			ConfidenceField, verdict.Score,
+			SourceField, query.source,
+			UserField, session.User,
+			DatabaseField, session.Database,
+			ClientAddressField, session.ClientAddress,
+		)
+
+		fields := session.Fields()
+		fields[QueryField] = query.text
+		fields[DetectorField] = verdict.Detector
+		fields[SourceField] = query.source
+		for key, value := range query.fields {
+			fields[key] = value
+		}
+		for key, value := range verdict.Evidence {
+			fields[key] = value
+		}
+		if result.Variant != "" {
+			fields[VariantField] = result.Variant
+		}
+		if result.NormalizedQuery != "" {
+			fields[NormalizedQueryField] = result.NormalizedQuery
+		}
+		if result.Statement != "" {
+			fields[StatementField] = result.Statement
+		}
+		if policy != nil {
+			fields[PolicyField] = policy.Name
+		}
+		if len(result.Errors) > 0 {
+			fields[ErrorField] = errors.Join(result.Errors...).Error()
+		}
+		if flagged {
+			// The query is denied, but the denylist only flags it, so the
+			// remaining queries of the request are still inspected, and the
+			// flag doesn't count towards the ban of the client.
+			fields[ActionField] = DenylistFlag
+			req = effective.logDetection(req, fields)
+			p.RecentDetections.Add(fields)
+			continue
+		}
+
+		for _, ban := range p.Offenders.Record(session) {
+			p.Logger.Warn("Client banned", OffenderField, ban.Offender, BannedUntilField, ban.Until)
+			fields[OffenderField] = ban.Offender
+			fields[BannedUntilField] = ban.Until.Format(time.RFC3339)
+		}
+
+		resp := effective.prepareResponse(req, fields)
+		p.RecentDetections.Add(fields)
+		if effective.mode() == DetectOnlyMode {
+			// The query passes through, so it is timed as well.
+			p.timeRequest(conn, request)
+		}
+		return resp, nil
 	}
 
+	p.Logger.Trace("No SQL injection detected")
+	p.timeRequest(conn, request)
 	return req, nil
 }
 
-func (p *Plugin) isSQLi(query string) bool {
-	// Check if libinjection is enabled.
-	if !p.EnableLibinjection {
-		return false
+// timeRequest records the query of a request that passes through, which is
+// timed once it is sent to the server, if the latency analysis is enabled. A
+// request without a query, e.g. the Sync of a previous request, keeps the
+// pending query.
+func (p *Plugin) timeRequest(conn *Connection, request *clientRequest) {
+	if p.Latency == nil {
+		return
+	}
+	if query := newTimedQuery(p.Protocol, request.queries); query != nil {
+		conn.SetPendingQuery(query)
+	}
+}
+
+// inspect checks the query against the denylist, and then inspects it with the
+// detectors. A denied query is detected right away if the denylist blocks,
+// regardless of the allowlist and the detectors, and is flagged otherwise,
+// unless the detectors detect it.
+func (p *Plugin) inspect(ctx context.Context, pipeline *Pipeline, query *clientQuery) *Result {
+	denied := p.checkDenylist(ctx, query)
+	if denied != nil && p.DenylistAction == DenylistBlock {
+		return &Result{Detected: true, Verdicts: []*Verdict{denied}}
 	}
 
-	// Check if the query is an SQL injection using libinjection.
-	injection, _ := libinjection.IsSQLi(query)
-	if injection {
-		p.Logger.Warn(p.ErrorMessage, DetectorField, Libinjection)
+	result := p.inspectQuery(ctx, pipeline, query)
+	if denied != nil && !result.Detected {
+		result.Flagged = denied
 	}
-	p.Logger.Trace("SQLInjection", IsInjectionField, cast.ToString(injection))
-	return injection
+	return result
 }
 
-func (p *Plugin) prepareResponse(req *v1.Struct, fields map[string]any) *v1.Struct {
-	Preventions.With(prometheus.Labels{ResponseTypeField: p.ResponseType}).Inc()
+// inspectQuery runs the detectors of the pipeline on the query, unless the query is
+// allowlisted, in which case nothing is detected. If a simple Query message
+// contains several statements, each statement is inspected as well, unless
+// the query is detected, or the query is blocked right away if stacked
+// queries are blocked or if it has more statements than can be inspected.
+// The allowlist only learns the queries that all the detectors inspected and
+// found clean.
+func (p *Plugin) inspectQuery(ctx context.Context, pipeline *Pipeline, query *clientQuery) *Result {
+	p.Logger.Trace("Query", SourceField, query.source, QueryField, query.text)
 
-	var encapsulatedResponse []byte
+	// Bound parameters are user input, so they are never allowlisted.
+	if query.source != BindSource && p.allowed(query.text) {
+		Allowlisted.Inc()
+		p.Logger.Trace("Query is allowlisted", SourceField, query.source)
+		return &Result{Allowlisted: true}
+	}
 
-	if p.ResponseType == "error" {
-		// Create a PostgreSQL error response.
-		encapsulatedResponse = postgres.ErrorResponse(
-			p.ErrorMessage,
-			p.ErrorSeverity,
-			p.ErrorNumber,
-			p.ErrorDetail,
-		)
-	} else {
-		// Create a PostgreSQL empty query response.
-		var encErr error
-		encapsulatedResponse, encErr = (&pgproto3.EmptyQueryResponse{}).Encode(nil)
-		if encErr != nil {
-			p.Logger.Error("Failed to encode empty query response", ErrorField, encErr)
-			return req
+	statements := p.statements(query)
+	if len(statements) > 1 && (p.BlockStackedQueries || len(statements) > MaxInspectedStatements) {
+		return &Result{
+			Detected: true,
+			Verdicts: []*Verdict{{
+				Detector:  StackedQueries,
+				Injection: true,
+				Score:     1,
+				Evidence: map[string]any{
+					StatementsField: len(statements),
+				},
+			}},
+		}
+	}
+
+	result := p.detect(ctx, pipeline, query.text)
+	if result.Detected {
+		return result
+	}
+	if len(statements) > 1 {
+		for _, statement := range statements {
+			statementResult := p.detect(ctx, pipeline, statement)
+			if statementResult.Detected {
+				statementResult.Statement = statement
+				return statementResult
+			}
+			result.Errors = append(result.Errors, statementResult.Errors...)
 		}
 	}
+	if len(result.Errors) == 0 && query.source != BindSource {
+		p.Allowlist.Learn(query.text)
+	}
+	return result
+}
 
-	response, encErr := (&pgproto3.ReadyForQuery{TxStatus: 'I'}).Encode(encapsulatedResponse)
-	if encErr != nil {
-		p.Logger.Error("Failed to encode ready for query response", ErrorField, encErr)
-		return req
+// detect runs the detectors of the pipeline on the query. If the queries are
+// normalized, the normalized query is inspected as well, unless the raw query
+// is detected, and the result tells which of them was detected.
+func (p *Plugin) detect(ctx context.Context, pipeline *Pipeline, query string) *Result {
+	result := pipeline.Run(ctx, query)
+	if !p.NormalizeQueries || p.Protocol == MySQLProtocol {
+		return result
+	}
+	if result.Detected {
+		result.Variant = RawVariant
+		return result
 	}
 
-	signals, err := v1.NewList([]any{
-		sdkAct.Terminate().ToMap(),
-		sdkAct.Log(p.LogLevel, p.ErrorMessage, fields).ToMap(),
-	})
+	// The normalized query is only inspected if the raw query is clean.
+	normalized := p.normalize(query)
+	if normalized == "" {
+		return result
+	}
+	normalizedResult := pipeline.Run(ctx, normalized)
+	if !normalizedResult.Detected {
+		return result
+	}
+	normalizedResult.Variant = NormalizedVariant
+	normalizedResult.NormalizedQuery = normalized
+	return normalizedResult
+}
+
+// normalize returns the normalized query, or an empty string if the query
+// can't be normalized or is already normal.
+func (p *Plugin) normalize(query string) string {
+	normalized, err := NormalizeQuery(query)
 	if err != nil {
-		p.Logger.Error("Failed to create signals", ErrorField, err)
-		return req
+		p.Logger.Trace("Failed to normalize query", ErrorField, err)
+		return ""
+	}
+	if normalized == query {
+		return ""
+	}
+	return normalized
+}
+
+// OnTrafficToServer is called when a request is sent by GatewayD to the server.
+// The time the query of the request is sent is recorded, to measure its latency.
+func (p *Plugin) OnTrafficToServer(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
+	OnTrafficToServer.Inc()
+	if p.Latency != nil {
+		p.connection(req).SendPendingQuery(time.Now())
 	}
 
-	// Create a response to send back to the client.
-	req.Fields[sdkAct.Signals] = v1.NewListValue(signals)
-	req.Fields[ResponseField] = v1.NewBytesValue(response)
-	return req
+	return req, nil
+}
+
+// OnTrafficFromServer is called when a response is received by GatewayD from the server.
+// The transaction status of the connection is tracked, so that the response to a blocked
+// query reports the same status as the server would. For MySQL, the prepared statements
+// are tracked instead, as their parameters can only be decoded with the parameter count.
+// The latency of the query is measured until the ReadyForQuery message for PostgreSQL,
+// as the server may send the first messages before the query is executed, and until the
+// first response for MySQL.
+func (p *Plugin) OnTrafficFromServer(ctx context.Context, resp *v1.Struct) (*v1.Struct, error) {
+	OnTrafficFromServer.Inc()
+
+	conn := p.connection(resp)
+	if p.Protocol == MySQLProtocol {
+		conn.MySQLResponse(resp.Fields[ResponseField].GetBytesValue())
+		p.timeResponse(resp, conn)
+		return resp, nil
+	}
+
+	if status, ok := readyForQueryStatus(resp.Fields[ResponseField].GetBytesValue()); ok {
+		conn.SetTxStatus(status)
+		p.timeResponse(resp, conn)
+	}
+
+	return resp, nil
+}
+
+// timeResponse records the latency of the pending query of the connection, and
+// reports the client if its latencies reveal a time-based blind injection to
+// the audit trail of the response. The query has already been executed, so it
+// can't be blocked, but the client is recorded as an offender, so that it may
+// be banned.
+func (p *Plugin) timeResponse(resp *v1.Struct, conn *Connection) {
+	query := conn.TakePendingQuery()
+	if p.Latency == nil || query == nil {
+		return
+	}
+
+	session := conn.Session()
+	if session.ClientAddress == "" {
+		// The connection was opened before the plugin was loaded.
+		session.ClientAddress = connectionKey(resp)
+	}
+	anomaly := p.Latency.Record(session, query, time.Since(query.SentAt))
+	if anomaly == nil {
+		return
+	}
+
+	Detections.With(map[string]string{
+		DetectorField: LatencyAnalysis,
+		DatabaseField: session.Database,
+		UserField:     session.User,
+	}).Inc()
+	p.Logger.Warn(
+		"Time-based blind SQL injection detected",
+		DetectorField, LatencyAnalysis,
+		RuleField, anomaly.Rule,
+		LatencyField, anomaly.Latency,
+		UserField, session.User,
+		DatabaseField, session.Database,
+		ClientAddressField, session.ClientAddress,
+	)
+
+	fields := session.Fields()
+	fields[QueryField] = query.Query
+	fields[DetectorField] = LatencyAnalysis
+	fields[RuleField] = anomaly.Rule
+	fields[LatencyField] = anomaly.Latency.Seconds()
+	fields[SamplesField] = anomaly.Samples
+	switch anomaly.Rule {
+	case RuleSleepValueLatency:
+		fields[SleepValueField] = anomaly.Value
+	case RuleBimodalLatency:
+		fields[FastLatencyField] = anomaly.Fast.Seconds()
+		fields[SlowLatencyField] = anomaly.Slow.Seconds()
+	}
+	for _, ban := range p.Offenders.Record(session) {
+		p.Logger.Warn("Client banned", OffenderField, ban.Offender, BannedUntilField, ban.Until)
+		fields[OffenderField] = ban.Offender
+		fields[BannedUntilField] = ban.Until.Format(time.RFC3339)
+	}
+	p.logDetection(resp, fields)
+	p.RecentDetections.Add(fields)
+}
+
+// OnOpened is called when a client connection is opened. The connection is
+// tracked from the start, so that the client address is known even if the
+// client never sends a startup message that the plugin can decode.
+func (p *Plugin) OnOpened(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
+	OnOpened.Inc()
+	if key := connectionKey(req); key != "" {
+		p.Connections.Get(key).SetSession(Session{ClientAddress: key})
+	}
+
+	return req, nil
+}
+
+// OnClosed is called when a client connection is closed. The state of the
+// connection is dropped.
+func (p *Plugin) OnClosed(ctx context.Context, req *v1.Struct) (*v1.Struct, error) {
+	OnClosed.Inc()
+	p.Connections.Remove(connectionKey(req))
+
+	return req, nil
+}
+
+// Close releases the resources of the plugin when it shuts down, i.e. the
+// connection of the prediction backend, if it has one.
+func (p *Plugin) Close() error {
+	if closer, ok := p.Backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
@@ -15,24 +16,29 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func Test_isSQLi(t *testing.T) {
-	p := &Plugin{
-		EnableLibinjection: true,
-		Logger:             hclog.NewNullLogger(),
+func Test_LibinjectionDetector(t *testing.T) {
+	d := &LibinjectionDetector{
+		Logger: hclog.NewNullLogger(),
 	}
 	// This is a false positive, since the query is not an SQL injection.
-	assert.True(t, p.isSQLi("SELECT * FROM users WHERE id = 1"))
+	verdict, err := d.Inspect(context.Background(), "SELECT * FROM users WHERE id = 1")
+	require.NoError(t, err)
+	assert.True(t, verdict.Injection)
 	// This is an SQL injection.
-	assert.True(t, p.isSQLi("SELECT * FROM users WHERE id = 1 OR 1=1"))
+	verdict, err = d.Inspect(context.Background(), "SELECT * FROM users WHERE id = 1 OR 1=1")
+	require.NoError(t, err)
+	assert.True(t, verdict.Injection)
 }
 
-func Test_isSQLiDisabled(t *testing.T) {
+func Test_LibinjectionDetectorDisabled(t *testing.T) {
 	p := &Plugin{
 		EnableLibinjection: false,
 		Logger:             hclog.NewNullLogger(),
 	}
 	// This is an SQL injection, but the libinjection is disabled.
-	assert.False(t, p.isSQLi("SELECT * FROM users WHERE id = 1 OR 1=1"))
+	for _, detector := range p.pipeline().Detectors {
+		assert.NotEqual(t, Libinjection, detector.Name())
+	}
 }
 
 func Test_errorResponse(t *testing.T) {
@@ -137,6 +143,10 @@ func Test_OnTrafficFromClient(t *testing.T) {
 	defer server.Close()
 
 	p.PredictionAPIAddress = server.URL
+	p.Threshold = 0.8
+	scorePath, err := ParseJSONPath("outputs[0][0]")
+	require.NoError(t, err)
+	p.Backend = &HTTPBackend{Address: server.URL, Schema: ResponseSchema{ScorePath: scorePath}}
 
 	query := pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"}
 	queryBytes, err := query.Encode(nil)
@@ -283,3 +293,94 @@ func Test_OnTrafficFromClientEmptyQuery(t *testing.T) {
 	assert.NotContains(t, resp.GetFields(), "response")
 	assert.NotContains(t, resp.GetFields(), sdkAct.Signals)
 }
+
+func Test_OnTrafficFromClientExtendedProtocol(t *testing.T) {
+	p := &Plugin{
+		Logger:    hclog.NewNullLogger(),
+		Threshold: 0.8,
+	}
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case PredictPath:
+				var body map[string]string
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+				// Only the bound parameter is malicious.
+				confidence := 0.1
+				if strings.Contains(body["query"], "OR") {
+					confidence = 0.99
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Header().Set("Content-Type", "application/json")
+				resp := map[string]any{"confidence": confidence}
+				data, _ := json.Marshal(resp)
+				_, err := w.Write(data)
+				require.NoError(t, err)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+
+	p.PredictionAPIAddress = server.URL
+
+	// The injection is carried in the bound parameter, not in the query.
+	request := encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE name = $1"},
+		&pgproto3.Bind{Parameters: [][]byte{[]byte("' OR '1'='1' --")}},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	reqJSON, err := v1.NewStruct(map[string]any{
+		"request": request,
+	})
+	require.NoError(t, err)
+
+	resp, err := p.OnTrafficFromClient(context.Background(), reqJSON)
+	require.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Contains(t, resp.GetFields(), "parse")
+	assert.Contains(t, resp.GetFields(), "response")
+	assert.Contains(t, resp.GetFields(), sdkAct.Signals)
+
+	signals := resp.Fields[sdkAct.Signals].GetListValue().AsSlice()
+	require.Len(t, signals, 2)
+	logSignal := signals[1].(map[string]any)
+	metadata := logSignal["metadata"].(map[string]any)
+	assert.Equal(t, BindSource, metadata[SourceField])
+	assert.Equal(t, DeepLearningModel, metadata[DetectorField])
+	assert.Equal(t, "' OR '1'='1' --", metadata[QueryField])
+}
+
+func Test_OnTrafficFromClientDetectOnly(t *testing.T) {
+	p := &Plugin{
+		Logger:             hclog.NewNullLogger(),
+		Mode:               DetectOnlyMode,
+		Detectors:          []string{Libinjection},
+		EnableLibinjection: true,
+	}
+
+	query := pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"}
+	queryBytes, err := query.Encode(nil)
+	require.NoError(t, err)
+
+	reqJSON, err := v1.NewStruct(map[string]any{
+		"request": queryBytes,
+	})
+	require.NoError(t, err)
+
+	resp, err := p.OnTrafficFromClient(context.Background(), reqJSON)
+	require.NoError(t, err)
+	// The request passes through, but the detection is logged.
+	assert.NotContains(t, resp.GetFields(), "response")
+	assert.Contains(t, resp.GetFields(), sdkAct.Signals)
+	signals := resp.Fields[sdkAct.Signals].GetListValue().AsSlice()
+	require.Len(t, signals, 1)
+	logSignal := signals[0].(map[string]any)
+	assert.Equal(t, "log", logSignal["name"])
+	metadata := logSignal["metadata"].(map[string]any)
+	assert.Equal(t, DetectOnlyMode, metadata[ModeField])
+	assert.Equal(t, Libinjection, metadata[DetectorField])
+}
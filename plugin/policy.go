@@ -0,0 +1,253 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy overrides the detection and response settings of the plugin for the
+// clients it matches.
+type Policy struct {
+	Name      string      `yaml:"name"`
+	Match     PolicyMatch `yaml:"match"`
+	Overrides `yaml:",inline"`
+}
+
+// Overrides are the detection and response settings that can be overridden.
+// The overrides are optional, so that the unset ones keep the settings of the
+// plugin.
+type Overrides struct {
+	Detectors                  []string `yaml:"detectors"`
+	EnableLibinjection         *bool    `yaml:"enableLibinjection"`
+	LibinjectionPermissiveMode *bool    `yaml:"libinjectionPermissiveMode"`
+	Threshold                  *float32 `yaml:"threshold"`
+	NormalizeQueries           *bool    `yaml:"normalizeQueries"`
+	BlockStackedQueries        *bool    `yaml:"blockStackedQueries"`
+	ResponseType               *string  `yaml:"responseType"`
+	ErrorMessage               *string  `yaml:"errorMessage"`
+	ErrorSeverity              *string  `yaml:"errorSeverity"`
+	ErrorNumber                *string  `yaml:"errorNumber"`
+	ErrorDetail                *string  `yaml:"errorDetail"`
+}
+
+// PolicyMatch selects the clients of a policy. A client matches if it matches
+// every non-empty list, and it matches a list if it matches any of its entries.
+// An empty match selects all clients. The application name is chosen by the
+// client, so a policy that only matches application names can't loosen the
+// detection settings.
+type PolicyMatch struct {
+	Databases        []string `yaml:"databases"`
+	Users            []string `yaml:"users"`
+	ApplicationNames []string `yaml:"applicationNames"`
+	ClientCIDRs      []string `yaml:"clientCIDRs"`
+
+	prefixes []netip.Prefix
+}
+
+// policyFile is the format of the policy file.
+type policyFile struct {
+	Policies []*Policy `yaml:"policies"`
+}
+
+// LoadPolicies reads the policies from a YAML file.
+func LoadPolicies(path string) ([]*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policies: %w", err)
+	}
+	return ParsePolicies(data)
+}
+
+// ParsePolicies parses and validates the policies of a YAML document.
+func ParsePolicies(data []byte) ([]*Policy, error) {
+	var file policyFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse policies: %w", err)
+	}
+
+	var errs []error
+	for idx, policy := range file.Policies {
+		if err := policy.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("policy %d (%s): %w", idx, policy.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return file.Policies, nil
+}
+
+func (p *Policy) validate() error {
+	errs := []error{p.Overrides.validate()}
+	for _, cidr := range p.Match.ClientCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid client CIDR: %w", err))
+			continue
+		}
+		p.Match.prefixes = append(p.Match.prefixes, prefix.Masked())
+	}
+	return errors.Join(errs...)
+}
+
+func (o *Overrides) validate() error {
+	var errs []error
+	for _, name := range o.Detectors {
+		if _, ok := getDetectorFactory(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown detector: %s", name))
+		}
+	}
+	if o.Threshold != nil && (*o.Threshold < 0 || *o.Threshold > 1) {
+		errs = append(errs, fmt.Errorf("threshold must be between 0 and 1: %v", *o.Threshold))
+	}
+	if o.ResponseType != nil && *o.ResponseType != ResponseType && *o.ResponseType != EmptyResponseType {
+		errs = append(errs, fmt.Errorf("invalid response type: %s", *o.ResponseType))
+	}
+	if o.ErrorSeverity != nil && !slices.Contains(ErrorSeverities, *o.ErrorSeverity) {
+		errs = append(errs, fmt.Errorf("invalid error severity: %s", *o.ErrorSeverity))
+	}
+	if o.ErrorNumber != nil && !sqlStatePattern.MatchString(*o.ErrorNumber) {
+		errs = append(errs, fmt.Errorf(
+			"invalid error number, which must be a SQLSTATE of five digits or uppercase letters: %q",
+			*o.ErrorNumber))
+	}
+	return errors.Join(errs...)
+}
+
+// Matches returns true if the session is selected by the match.
+func (m *PolicyMatch) Matches(session Session) bool {
+	if len(m.Databases) > 0 && !slices.Contains(m.Databases, session.Database) {
+		return false
+	}
+	if len(m.Users) > 0 && !slices.Contains(m.Users, session.User) {
+		return false
+	}
+	if len(m.ApplicationNames) > 0 && !slices.Contains(m.ApplicationNames, session.ApplicationName) {
+		return false
+	}
+	if len(m.prefixes) > 0 {
+		addr, ok := clientIP(session.ClientAddress)
+		if !ok {
+			return false
+		}
+		if !slices.ContainsFunc(m.prefixes, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientControlled returns true if the match only selects clients by their
+// application name, which any client can set to anything.
+func (m *PolicyMatch) clientControlled() bool {
+	return len(m.ApplicationNames) > 0 &&
+		len(m.Databases) == 0 && len(m.Users) == 0 && len(m.ClientCIDRs) == 0
+}
+
+// clientIP returns the IP address of the client address, with or without port.
+func clientIP(address string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// withPolicy returns the plugin with the settings of the first policy that
+// matches the session, and the policy. The plugin itself is returned if no
+// policy matches.
+func (p *Plugin) withPolicy(session Session) (*Plugin, *Policy) {
+	for _, policy := range p.Policies {
+		if !policy.Match.Matches(session) {
+			continue
+		}
+
+		effective := *p
+		if policy.Match.clientControlled() {
+			policy.tightened(p).apply(&effective)
+		} else {
+			policy.apply(&effective)
+		}
+		return &effective, policy
+	}
+	return p, nil
+}
+
+// tightened returns the overrides without the ones that loosen the detection
+// settings of the plugin, i.e. that drop a detector, disable libinjection,
+// query normalization or the blocking of stacked queries, enable the
+// permissive mode of libinjection or raise the threshold. The detectors are
+// compared with the pipeline of the plugin, which runs the default detectors
+// if none are configured.
+func (o *Overrides) tightened(p *Plugin) *Overrides {
+	tightened := *o
+	if o.Detectors != nil && slices.ContainsFunc(p.pipeline().Detectors, func(detector Detector) bool {
+		return !slices.Contains(o.Detectors, detector.Name())
+	}) {
+		tightened.Detectors = nil
+	}
+	if o.EnableLibinjection != nil && !*o.EnableLibinjection {
+		tightened.EnableLibinjection = nil
+	}
+	if o.LibinjectionPermissiveMode != nil && *o.LibinjectionPermissiveMode {
+		tightened.LibinjectionPermissiveMode = nil
+	}
+	if o.Threshold != nil && *o.Threshold > p.Threshold {
+		tightened.Threshold = nil
+	}
+	if o.NormalizeQueries != nil && !*o.NormalizeQueries {
+		tightened.NormalizeQueries = nil
+	}
+	if o.BlockStackedQueries != nil && !*o.BlockStackedQueries {
+		tightened.BlockStackedQueries = nil
+	}
+	return &tightened
+}
+
+// apply overrides the settings of the plugin.
+func (o *Overrides) apply(p *Plugin) {
+	if o.Detectors != nil {
+		p.Detectors = o.Detectors
+	}
+	if o.EnableLibinjection != nil {
+		p.EnableLibinjection = *o.EnableLibinjection
+	}
+	if o.LibinjectionPermissiveMode != nil {
+		p.LibinjectionPermissiveMode = *o.LibinjectionPermissiveMode
+	}
+	if o.Threshold != nil {
+		p.Threshold = *o.Threshold
+	}
+	if o.NormalizeQueries != nil {
+		p.NormalizeQueries = *o.NormalizeQueries
+	}
+	if o.BlockStackedQueries != nil {
+		p.BlockStackedQueries = *o.BlockStackedQueries
+	}
+	if o.ResponseType != nil {
+		p.ResponseType = *o.ResponseType
+	}
+	if o.ErrorMessage != nil {
+		p.ErrorMessage = *o.ErrorMessage
+	}
+	if o.ErrorSeverity != nil {
+		p.ErrorSeverity = *o.ErrorSeverity
+	}
+	if o.ErrorNumber != nil {
+		p.ErrorNumber = *o.ErrorNumber
+	}
+	if o.ErrorDetail != nil {
+		p.ErrorDetail = *o.ErrorDetail
+	}
+}
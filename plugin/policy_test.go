@@ -0,0 +1,222 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicies = `
+policies:
+  - name: reporting
+    match:
+      databases: [reporting]
+    threshold: 0.95
+    responseType: empty
+  - name: app
+    match:
+      databases: [app]
+      clientCIDRs: [10.0.0.0/8]
+    enableLibinjection: true
+    libinjectionPermissiveMode: false
+    errorMessage: Blocked by policy
+`
+
+func Test_ParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies([]byte(testPolicies))
+	require.NoError(t, err)
+	require.Len(t, policies, 2)
+	assert.Equal(t, "reporting", policies[0].Name)
+	assert.InDelta(t, 0.95, *policies[0].Threshold, 0.0001)
+	assert.Nil(t, policies[0].ErrorMessage)
+	assert.False(t, *policies[1].LibinjectionPermissiveMode)
+}
+
+func Test_ParsePoliciesInvalid(t *testing.T) {
+	_, err := ParsePolicies([]byte(`
+policies:
+  - name: broken
+    match:
+      clientCIDRs: [10.0.0.0/33]
+    detectors: [unknown]
+    threshold: 2
+    responseType: silent
+    errorSeverity: FATAL
+    errorNumber: "4200"
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid client CIDR")
+	assert.Contains(t, err.Error(), "unknown detector: unknown")
+	assert.Contains(t, err.Error(), "threshold must be between 0 and 1")
+	assert.Contains(t, err.Error(), "invalid response type: silent")
+	assert.Contains(t, err.Error(), "invalid error severity: FATAL")
+	assert.Contains(t, err.Error(), `invalid error number, which must be a SQLSTATE of five digits or uppercase letters: "4200"`)
+}
+
+func Test_PolicyMatch(t *testing.T) {
+	policies, err := ParsePolicies([]byte(testPolicies))
+	require.NoError(t, err)
+	match := policies[1].Match
+
+	assert.True(t, match.Matches(Session{Database: "app", ClientAddress: "10.1.2.3:5432"}))
+	assert.True(t, match.Matches(Session{Database: "app", ClientAddress: "10.1.2.3"}))
+	assert.False(t, match.Matches(Session{Database: "app", ClientAddress: "192.168.1.1:5432"}))
+	assert.False(t, match.Matches(Session{Database: "app"}))
+	assert.False(t, match.Matches(Session{Database: "reporting", ClientAddress: "10.1.2.3:5432"}))
+	assert.True(t, (&PolicyMatch{}).Matches(Session{}))
+}
+
+func Test_withPolicy(t *testing.T) {
+	policies, err := ParsePolicies([]byte(testPolicies))
+	require.NoError(t, err)
+	p := &Plugin{
+		Threshold:                  0.8,
+		LibinjectionPermissiveMode: true,
+		ResponseType:               ResponseType,
+		ErrorMessage:               ErrorMessage,
+		Policies:                   policies,
+	}
+
+	effective, policy := p.withPolicy(Session{Database: "reporting"})
+	require.NotNil(t, policy)
+	assert.Equal(t, "reporting", policy.Name)
+	assert.InDelta(t, 0.95, effective.Threshold, 0.0001)
+	assert.Equal(t, EmptyResponseType, effective.ResponseType)
+	assert.Equal(t, ErrorMessage, effective.ErrorMessage)
+	// The plugin itself is left untouched.
+	assert.InDelta(t, 0.8, p.Threshold, 0.0001)
+
+	effective, policy = p.withPolicy(Session{Database: "app", ClientAddress: "10.0.0.1:1234"})
+	require.NotNil(t, policy)
+	assert.True(t, effective.EnableLibinjection)
+	assert.False(t, effective.LibinjectionPermissiveMode)
+	assert.Equal(t, "Blocked by policy", effective.ErrorMessage)
+
+	effective, policy = p.withPolicy(Session{Database: "other"})
+	assert.Nil(t, policy)
+	assert.Same(t, p, effective)
+}
+
+func Test_withPolicyApplicationName(t *testing.T) {
+	policies, err := ParsePolicies([]byte(`
+policies:
+  - name: loose
+    match:
+      applicationNames: [migrate]
+    detectors: [libinjection]
+    enableLibinjection: false
+    libinjectionPermissiveMode: true
+    threshold: 0.99
+    normalizeQueries: false
+    blockStackedQueries: false
+    errorMessage: Blocked by policy
+  - name: strict
+    match:
+      applicationNames: [checkout]
+    detectors: [libinjection, deep_learning_model]
+    enableLibinjection: true
+    libinjectionPermissiveMode: false
+    threshold: 0.5
+    normalizeQueries: true
+    blockStackedQueries: true
+`))
+	require.NoError(t, err)
+	p := &Plugin{
+		Detectors:                  []string{DeepLearningModel},
+		EnableLibinjection:         true,
+		LibinjectionPermissiveMode: false,
+		Threshold:                  0.8,
+		NormalizeQueries:           true,
+		BlockStackedQueries:        true,
+		ErrorMessage:               ErrorMessage,
+		Policies:                   policies,
+	}
+
+	// The client chooses its application name, so the policy can't loosen
+	// the detection settings.
+	effective, policy := p.withPolicy(Session{ApplicationName: "migrate"})
+	require.NotNil(t, policy)
+	assert.Equal(t, "loose", policy.Name)
+	assert.Equal(t, []string{DeepLearningModel}, effective.Detectors)
+	assert.True(t, effective.EnableLibinjection)
+	assert.False(t, effective.LibinjectionPermissiveMode)
+	assert.InDelta(t, 0.8, effective.Threshold, 0.0001)
+	assert.True(t, effective.NormalizeQueries)
+	assert.True(t, effective.BlockStackedQueries)
+	assert.Equal(t, "Blocked by policy", effective.ErrorMessage)
+
+	// It can tighten them.
+	p.EnableLibinjection = false
+	p.LibinjectionPermissiveMode = true
+	p.NormalizeQueries = false
+	p.BlockStackedQueries = false
+	effective, _ = p.withPolicy(Session{ApplicationName: "checkout"})
+	assert.Equal(t, []string{Libinjection, DeepLearningModel}, effective.Detectors)
+	assert.True(t, effective.EnableLibinjection)
+	assert.False(t, effective.LibinjectionPermissiveMode)
+	assert.InDelta(t, 0.5, effective.Threshold, 0.0001)
+	assert.True(t, effective.NormalizeQueries)
+	assert.True(t, effective.BlockStackedQueries)
+
+	// The default detectors run if none are configured, so they can't be
+	// dropped either.
+	p.Detectors = nil
+	p.EnableLibinjection = true
+	policies[0].Detectors = []string{SyntaxTree}
+	effective, _ = p.withPolicy(Session{ApplicationName: "migrate"})
+	assert.Nil(t, effective.Detectors)
+	policies[0].Detectors = []string{DeepLearningModel, Libinjection, SyntaxTree}
+	effective, _ = p.withPolicy(Session{ApplicationName: "migrate"})
+	assert.Equal(t, []string{DeepLearningModel, Libinjection, SyntaxTree}, effective.Detectors)
+
+	// A policy that also matches the user can loosen them.
+	policies[0].Match.Users = []string{"migrator"}
+	policies[0].Detectors = []string{SyntaxTree}
+	effective, _ = p.withPolicy(Session{User: "migrator", ApplicationName: "migrate"})
+	assert.Equal(t, []string{SyntaxTree}, effective.Detectors)
+	assert.InDelta(t, 0.99, effective.Threshold, 0.0001)
+}
+
+func Test_OnTrafficFromClientPolicy(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+
+	policies, err := ParsePolicies([]byte(`
+policies:
+  - name: reporting
+    match:
+      databases: [reporting]
+    responseType: empty
+    errorMessage: Blocked by policy
+`))
+	require.NoError(t, err)
+
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		Detectors:    []string{"keyword"},
+		ResponseType: ResponseType,
+		ErrorMessage: ErrorMessage,
+		Connections:  NewConnectionTracker(),
+		Policies:     policies,
+	}
+	req := newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"}))
+	p.connection(req).SetSession(Session{Database: "reporting"})
+
+	resp, err := p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.EmptyQueryResponse{},
+		&pgproto3.ReadyForQuery{},
+	}, decodeResponse(t, resp.Fields[ResponseField].GetBytesValue()))
+
+	signals := resp.Fields[sdkAct.Signals].GetListValue().AsSlice()
+	require.Len(t, signals, 2)
+	logSignal := signals[1].(map[string]any)
+	assert.Equal(t, "Blocked by policy", logSignal["metadata"].(map[string]any)["message"])
+	assert.Equal(t, "reporting", logSignal["metadata"].(map[string]any)[PolicyField])
+}
@@ -0,0 +1,195 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// DetectionConfig is the detection policy of the config file, which overrides
+// the settings of the plugin and can be changed without restarting GatewayD.
+type DetectionConfig struct {
+	Mode                *string `yaml:"mode"`
+	DetectorCombination *string `yaml:"detectorCombination"`
+	Overrides           `yaml:",inline"`
+	// Allowlist are queries whose fingerprints skip the detectors, in addition
+	// to the fingerprints of the allowlist file.
+	Allowlist []string `yaml:"allowlist"`
+	// Policies replace the policies of the policy file, if set.
+	Policies []*Policy `yaml:"policies"`
+
+	allowlist *Allowlist
+}
+
+// ParseDetectionConfig parses and validates the config file. All the errors
+// are reported at once, so that they can be fixed in one go.
+func ParseDetectionConfig(data []byte) (*DetectionConfig, error) {
+	config := &DetectionConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	// Typos must not be silently ignored in a security policy.
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	errs := []error{config.Overrides.validate()}
+	if config.Mode != nil && *config.Mode != PreventMode && *config.Mode != DetectOnlyMode {
+		errs = append(errs, fmt.Errorf("invalid mode: %s", *config.Mode))
+	}
+	if config.DetectorCombination != nil &&
+		!slices.Contains([]string{CombineAny, CombineAll}, *config.DetectorCombination) {
+		errs = append(errs, fmt.Errorf("invalid detector combination: %s", *config.DetectorCombination))
+	}
+	if len(config.Allowlist) > 0 {
+		config.allowlist, _ = NewAllowlist(AllowlistEnforce, "", 0)
+		for idx, query := range config.Allowlist {
+			if err := config.allowlist.Add(query); err != nil {
+				errs = append(errs, fmt.Errorf("allowlist %d: %w", idx, err))
+			}
+		}
+	}
+	for idx, policy := range config.Policies {
+		if err := policy.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("policy %d (%s): %w", idx, policy.Name, err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// apply overrides the settings of the plugin.
+func (c *DetectionConfig) apply(p *Plugin) {
+	if c.Mode != nil {
+		p.Mode = *c.Mode
+	}
+	if c.DetectorCombination != nil {
+		p.DetectorCombination = *c.DetectorCombination
+	}
+	c.Overrides.apply(p)
+	if c.allowlist != nil {
+		p.StaticAllowlist = c.allowlist
+	}
+	if c.Policies != nil {
+		p.Policies = c.Policies
+	}
+}
+
+// ConfigFile holds the detection config of a file, which is reloaded when the
+// file changes. The config is replaced atomically, and a config that fails to
+// load or validate is rejected, so that the previous config stays in effect.
+type ConfigFile struct {
+	path    string
+	config  atomic.Pointer[DetectionConfig]
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewConfigFile returns a new ConfigFile and loads the config. The ConfigFile
+// is returned even if the config fails to load, so that it is loaded as soon
+// as the file is fixed.
+func NewConfigFile(path string) (*ConfigFile, error) {
+	file := &ConfigFile{path: path}
+	return file, file.Reload()
+}
+
+// Config returns the current config, which is nil until a config is loaded.
+func (f *ConfigFile) Config() *DetectionConfig {
+	if f == nil {
+		return nil
+	}
+	return f.config.Load()
+}
+
+// Reload loads the config from the file, and keeps the previous config if the
+// new config is invalid.
+func (f *ConfigFile) Reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		ConfigReloads.With(prometheus.Labels{ResultField: ReloadFailure}).Inc()
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		ConfigReloads.With(prometheus.Labels{ResultField: ReloadFailure}).Inc()
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	config, err := ParseDetectionConfig(data)
+	if err != nil {
+		ConfigReloads.With(prometheus.Labels{ResultField: ReloadFailure}).Inc()
+		return err
+	}
+
+	f.config.Store(config)
+	ConfigReloads.With(prometheus.Labels{ResultField: ReloadSuccess}).Inc()
+	return nil
+}
+
+// changed returns true if the file was modified since it was last loaded.
+func (f *ConfigFile) changed() bool {
+	info, err := os.Stat(f.path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil {
+		// A file that is being replaced may be missing for a moment.
+		return false
+	}
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+// Watch checks the file for changes at the given interval and reloads it,
+// calling onReload with the result of each reload, until the context is done.
+func (f *ConfigFile) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if f.changed() {
+				onReload(f.Reload())
+			}
+		}
+	}
+}
+
+// current returns the plugin with the settings of the config file, or the
+// plugin itself if there is no config file.
+func (p *Plugin) current() *Plugin {
+	config := p.ConfigFile.Config()
+	if config == nil {
+		return p
+	}
+
+	current := *p
+	config.apply(&current)
+	return &current
+}
+
+// allowed returns true if the query is allowlisted by the allowlist file or
+// the config file.
+func (p *Plugin) allowed(query string) bool {
+	return p.Allowlist.Allowed(query) || p.StaticAllowlist.Allowed(query)
+}
@@ -0,0 +1,181 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDetectionConfig = `
+mode: detect-only
+detectorCombination: all
+threshold: 0.9
+errorMessage: Blocked by config
+allowlist:
+  - SELECT * FROM users WHERE id = 1 OR 1=1
+policies:
+  - name: reporting
+    match:
+      databases: [reporting]
+    responseType: empty
+`
+
+func Test_ParseDetectionConfig(t *testing.T) {
+	config, err := ParseDetectionConfig([]byte(testDetectionConfig))
+	require.NoError(t, err)
+	assert.Equal(t, DetectOnlyMode, *config.Mode)
+	assert.Equal(t, CombineAll, *config.DetectorCombination)
+	assert.InDelta(t, 0.9, *config.Threshold, 0.0001)
+	assert.True(t, config.allowlist.Allowed("SELECT * FROM users WHERE id = 2 OR 1=1"))
+	require.Len(t, config.Policies, 1)
+
+	config, err = ParseDetectionConfig(nil)
+	require.NoError(t, err)
+	assert.Nil(t, config.Mode)
+}
+
+func Test_ParseDetectionConfigInvalid(t *testing.T) {
+	_, err := ParseDetectionConfig([]byte(`
+mode: panic
+detectorCombination: some
+threshold: 2
+errorSeverity: PANIC
+policies:
+  - name: broken
+    detectors: [unknown]
+    errorNumber: 42p01
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid mode: panic")
+	assert.Contains(t, err.Error(), "invalid detector combination: some")
+	assert.Contains(t, err.Error(), "threshold must be between 0 and 1")
+	assert.Contains(t, err.Error(), "policy 0 (broken): unknown detector: unknown")
+	assert.Contains(t, err.Error(), "invalid error severity: PANIC")
+	assert.Contains(t, err.Error(), `invalid error number, which must be a SQLSTATE of five digits or uppercase letters: "42p01"`)
+
+	_, err = ParseDetectionConfig([]byte("treshold: 0.5\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "treshold")
+}
+
+func Test_ConfigFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("threshold: 0.9\n"), 0o600))
+
+	file, err := NewConfigFile(path)
+	require.NoError(t, err)
+	assert.False(t, file.changed())
+	assert.InDelta(t, 0.9, *file.Config().Threshold, 0.0001)
+
+	// An invalid config is rejected and the previous config stays in effect.
+	require.NoError(t, os.WriteFile(path, []byte("threshold: 2.5\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	assert.True(t, file.changed())
+	require.Error(t, file.Reload())
+	assert.False(t, file.changed())
+	assert.InDelta(t, 0.9, *file.Config().Threshold, 0.0001)
+
+	require.NoError(t, os.WriteFile(path, []byte("threshold: 0.7\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	require.NoError(t, file.Reload())
+	assert.InDelta(t, 0.7, *file.Config().Threshold, 0.0001)
+
+	// A missing file fails to load, but is returned so that it can be fixed.
+	file, err = NewConfigFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	require.Error(t, err)
+	require.NotNil(t, file)
+	assert.Nil(t, file.Config())
+}
+
+func Test_ConfigFileWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("threshold: 0.9\n"), 0o600))
+	file, err := NewConfigFile(path)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reloads := make(chan error, 10)
+	stopped := make(chan struct{})
+	go func() {
+		file.Watch(ctx, time.Millisecond, func(err error) { reloads <- err })
+		close(stopped)
+	}()
+
+	require.NoError(t, os.WriteFile(path, []byte("threshold: 0.7\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	select {
+	case err := <-reloads:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the config file was not reloaded")
+	}
+	assert.InDelta(t, 0.7, *file.Config().Threshold, 0.0001)
+
+	// The file is no longer watched once the context is done.
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the config file is still watched")
+	}
+}
+
+func Test_current(t *testing.T) {
+	p := &Plugin{Mode: PreventMode, Threshold: 0.8, ErrorMessage: ErrorMessage}
+	assert.Same(t, p, p.current())
+
+	config, err := ParseDetectionConfig([]byte(testDetectionConfig))
+	require.NoError(t, err)
+	p.ConfigFile = &ConfigFile{}
+	p.ConfigFile.config.Store(config)
+
+	current := p.current()
+	assert.Equal(t, DetectOnlyMode, current.Mode)
+	assert.InDelta(t, 0.9, current.Threshold, 0.0001)
+	assert.Equal(t, "Blocked by config", current.ErrorMessage)
+	require.Len(t, current.Policies, 1)
+	// The plugin itself is left untouched.
+	assert.Equal(t, PreventMode, p.Mode)
+	assert.InDelta(t, 0.8, p.Threshold, 0.0001)
+}
+
+func Test_OnTrafficFromClientConfigFile(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+
+	config, err := ParseDetectionConfig([]byte(`
+allowlist:
+  - SELECT * FROM users WHERE id = 1 OR 1=1
+`))
+	require.NoError(t, err)
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		Mode:         PreventMode,
+		Detectors:    []string{"keyword"},
+		ResponseType: ResponseType,
+		ErrorMessage: ErrorMessage,
+		Connections:  NewConnectionTracker(),
+		ConfigFile:   &ConfigFile{},
+	}
+	p.ConfigFile.config.Store(config)
+
+	req := newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT * FROM users WHERE id = 5 OR 1=1"}))
+	resp, err := p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.NotContains(t, resp.GetFields(), ResponseField)
+	assert.NotContains(t, resp.GetFields(), sdkAct.Signals)
+
+	req = newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT * FROM orders WHERE id = 5 OR 1=1"}))
+	resp, err = p.OnTrafficFromClient(context.Background(), req)
+	require.NoError(t, err)
+	assert.Contains(t, resp.GetFields(), ResponseField)
+}
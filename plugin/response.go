@@ -0,0 +1,402 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	"github.com/gatewayd-io/gatewayd-plugin-sdk/databases/postgres"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prepareResponse blocks the request and creates the response that is sent
+// back to the client instead, depending on the messages in the request.
+// In detect-only mode, the detection is logged and the request passes through.
+func (p *Plugin) prepareResponse(req *v1.Struct, fields map[string]any) *v1.Struct {
+	if p.mode() == DetectOnlyMode {
+		fields[ModeField] = DetectOnlyMode
+		return p.logDetection(req, fields)
+	}
+
+	p.countPrevention(req)
+
+	if p.Protocol == MySQLProtocol {
+		return p.mysqlResponse(req, sdkAct.Log(p.LogLevel, p.ErrorMessage, fields))
+	}
+
+	request := decodeClientRequest(req.Fields[RequestField].GetBytesValue())
+	conn := p.connection(req)
+	logSignal := sdkAct.Log(p.LogLevel, p.ErrorMessage, fields)
+
+	if p.AbortTransactionOnBlock && conn.TxStatus() == TxStatusInTransaction {
+		return p.abortTransaction(req, request, logSignal)
+	}
+
+	var response []byte
+	var err error
+	if request.isExtended() {
+		response, err = p.extendedQueryResponse(request, conn)
+	} else {
+		response, err = p.simpleQueryResponse(conn)
+	}
+	if err != nil {
+		p.Logger.Error("Failed to encode response", ErrorField, err)
+		return req
+	}
+
+	return p.terminate(req, response, logSignal)
+}
+
+// logDetection logs the detection to the audit trail and lets the request
+// pass through.
+func (p *Plugin) logDetection(req *v1.Struct, fields map[string]any) *v1.Struct {
+	if err := setSignals(req, sdkAct.Log(p.LogLevel, p.ErrorMessage, fields)); err != nil {
+		p.Logger.Error("Failed to create signals", ErrorField, err)
+	}
+	return req
+}
+
+// ErrConnectionTerminated is returned for a message of a connection whose
+// banned client has already received a fatal error, which makes GatewayD close
+// the connection.
+var ErrConnectionTerminated = errors.New("connection of a banned client is terminated")
+
+// banResponse blocks a query of a banned client. With terminate banned
+// connections, a PostgreSQL client receives a fatal error instead, which
+// makes the client close the connection. A client that ignores the error has
+// its connection closed on its next message.
+func (p *Plugin) banResponse(req *v1.Struct, fields map[string]any) *v1.Struct {
+	if p.mode() == DetectOnlyMode || !p.TerminateBannedConnections || p.Protocol == MySQLProtocol {
+		return p.prepareResponse(req, fields)
+	}
+
+	p.countPrevention(req)
+	p.connection(req).SetTerminated(true)
+	response := postgres.ErrorResponse(p.ErrorMessage, FatalSeverity, p.ErrorNumber, p.ErrorDetail)
+	return p.terminate(req, response, sdkAct.Log(p.LogLevel, p.ErrorMessage, fields))
+}
+
+// logUnbans logs the bans lifted since the last request to the audit trail,
+// just like the bans.
+func (p *Plugin) logUnbans(req *v1.Struct) {
+	unbans := p.Offenders.TakeUnbans()
+	if len(unbans) == 0 {
+		return
+	}
+
+	signals := make([]*sdkAct.Signal, 0, len(unbans))
+	for _, ban := range unbans {
+		signals = append(signals, sdkAct.Log(p.LogLevel, "Client unbanned", map[string]any{
+			ActionField:      UnbanAction,
+			OffenderField:    ban.Offender,
+			BannedUntilField: ban.Until.Format(time.RFC3339),
+		}))
+	}
+	if err := setSignals(req, signals...); err != nil {
+		p.Logger.Error("Failed to create signals", ErrorField, err)
+	}
+}
+
+// countPrevention counts a blocked request by response type and client.
+func (p *Plugin) countPrevention(req *v1.Struct) {
+	session := p.connection(req).Session()
+	Preventions.With(prometheus.Labels{
+		ResponseTypeField: p.ResponseType,
+		DatabaseField:     session.Database,
+		UserField:         session.User,
+	}).Inc()
+}
+
+// simpleQueryResponse creates the response to a blocked simple Query, which
+// is either an error or an empty query response, followed by ReadyForQuery.
+func (p *Plugin) simpleQueryResponse(conn *Connection) ([]byte, error) {
+	var response []byte
+
+	if p.ResponseType == ResponseType {
+		// Create a PostgreSQL error response.
+		response = postgres.ErrorResponse(
+			p.ErrorMessage,
+			p.ErrorSeverity,
+			p.ErrorNumber,
+			p.ErrorDetail,
+		)
+	} else {
+		// Create a PostgreSQL empty query response.
+		var err error
+		response, err = (&pgproto3.EmptyQueryResponse{}).Encode(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return (&pgproto3.ReadyForQuery{TxStatus: conn.TxStatus()}).Encode(response)
+}
+
+// extendedQueryResponse creates the response to blocked extended query
+// protocol messages. Every batch of messages up to a Sync is answered with an
+// error followed by ReadyForQuery, and a Sync without messages before it only
+// with ReadyForQuery. If the last batch doesn't end with Sync, the following
+// messages of the connection are discarded until the client sends Sync, just
+// like PostgreSQL does. An empty response acknowledges every message as if
+// the query was empty.
+func (p *Plugin) extendedQueryResponse(request *clientRequest, conn *Connection) ([]byte, error) {
+	if p.ResponseType == ResponseType {
+		errorResponse := postgres.ErrorResponse(
+			p.ErrorMessage,
+			p.ErrorSeverity,
+			p.ErrorNumber,
+			p.ErrorDetail,
+		)
+
+		var response []byte
+		batch := false
+		for _, message := range request.messages {
+			switch message.kind {
+			case SyncMessage:
+				if batch {
+					response = append(response, errorResponse...)
+					batch = false
+				}
+				var err error
+				response, err = (&pgproto3.ReadyForQuery{TxStatus: conn.TxStatus()}).Encode(response)
+				if err != nil {
+					return nil, err
+				}
+			case FlushMessage:
+			default:
+				batch = true
+			}
+		}
+		if batch {
+			conn.SetSkipUntilSync(true)
+			response = append(response, errorResponse...)
+		}
+		return response, nil
+	}
+
+	var response []byte
+	for _, message := range request.messages {
+		var backendMessage pgproto3.BackendMessage
+		switch message.kind {
+		case ParseMessage:
+			backendMessage = &pgproto3.ParseComplete{}
+		case BindMessage:
+			backendMessage = &pgproto3.BindComplete{}
+		case DescribeMessage:
+			if message.objectType == PreparedStatementObject {
+				var err error
+				response, err = (&pgproto3.ParameterDescription{}).Encode(response)
+				if err != nil {
+					return nil, err
+				}
+			}
+			backendMessage = &pgproto3.NoData{}
+		case ExecuteMessage:
+			backendMessage = &pgproto3.EmptyQueryResponse{}
+		case CloseMessage:
+			backendMessage = &pgproto3.CloseComplete{}
+		case SyncMessage:
+			backendMessage = &pgproto3.ReadyForQuery{TxStatus: conn.TxStatus()}
+		default:
+			continue
+		}
+
+		var err error
+		response, err = backendMessage.Encode(response)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// mysqlResponse creates the response to a blocked MySQL command, which is
+// either an error or an OK packet. Prepared statements are always answered
+// with an error, as the client expects the statement metadata otherwise.
+func (p *Plugin) mysqlResponse(req *v1.Struct, signals ...*sdkAct.Signal) *v1.Struct {
+	packet, ok := mysqlCommandPacket(req.Fields[RequestField].GetBytesValue())
+	if !ok {
+		p.Logger.Error("Failed to find the MySQL command of the request")
+		return req
+	}
+
+	conn := p.connection(req)
+	conn.SetMySQLPendingPrepare(nil)
+	conn.SetMySQLPendingExecute(nil)
+
+	var response []byte
+	if p.ResponseType != ResponseType && packet.payload[0] == mysqlComQuery {
+		response = mysqlOKResponse(packet.sequence, conn.MySQLServerStatus())
+	} else {
+		response = mysqlErrorResponse(packet.sequence, conn.MySQLCapabilities(),
+			p.MySQLErrorCode, p.ErrorNumber, p.ErrorMessage)
+	}
+
+	return p.terminate(req, response, signals...)
+}
+
+// discardUntilSync discards the messages of a connection that received an
+// error for a message of the extended query protocol, and answers the Sync
+// that ends the discarded batch with ReadyForQuery.
+func (p *Plugin) discardUntilSync(
+	req *v1.Struct, request *clientRequest, conn *Connection,
+) *v1.Struct {
+	var response []byte
+	if request.hasSync() {
+		conn.SetSkipUntilSync(false)
+
+		var err error
+		response, err = (&pgproto3.ReadyForQuery{TxStatus: conn.TxStatus()}).Encode(nil)
+		if err != nil {
+			p.Logger.Error("Failed to encode ready for query response", ErrorField, err)
+			return req
+		}
+	}
+
+	p.Logger.Debug("Discarding messages until Sync", SyncField, request.hasSync())
+	return p.terminate(req, response)
+}
+
+// discardBeforeSync discards the messages of a connection that received an
+// error for a message of the extended query protocol up to the Sync that ends
+// the discarded batch, and returns the rest of the request, which starts a
+// new batch. The Sync is kept, so that the server answers it with
+// ReadyForQuery before the messages that follow it.
+func (p *Plugin) discardBeforeSync(req *v1.Struct, remaining []byte, conn *Connection) *clientRequest {
+	conn.SetSkipUntilSync(false)
+	req.Fields[RequestField] = v1.NewBytesValue(remaining)
+
+	p.Logger.Debug("Discarding messages until Sync", SyncField, true)
+	return decodeClientRequest(remaining)
+}
+
+// abortTransaction replaces the blocked request with a statement that raises
+// the configured error on the server, so that the transaction of the client
+// is aborted and the server reports the failed transaction status itself.
+// The blocked messages never reach the server.
+func (p *Plugin) abortTransaction(
+	req *v1.Struct, request *clientRequest, signals ...*sdkAct.Signal,
+) *v1.Struct {
+	statement := fmt.Sprintf(
+		"DO $gatewayd$ BEGIN RAISE EXCEPTION USING ERRCODE = %s, MESSAGE = %s, DETAIL = %s; END $gatewayd$",
+		quoteLiteral(p.ErrorNumber), quoteLiteral(p.ErrorMessage), quoteLiteral(p.ErrorDetail))
+
+	var messages []pgproto3.FrontendMessage
+	if request.isExtended() {
+		// Every batch of messages up to a Sync raises the error, and a Sync
+		// without messages before it is answered with ReadyForQuery.
+		batch := false
+		for _, message := range request.messages {
+			switch message.kind {
+			case SyncMessage:
+				if batch {
+					messages = append(messages, &pgproto3.Query{String: statement})
+					batch = false
+				} else {
+					messages = append(messages, &pgproto3.Sync{})
+				}
+			case FlushMessage:
+			default:
+				batch = true
+			}
+		}
+		if batch {
+			// The server discards the following messages until Sync, as the
+			// client expects after an error in the extended query protocol.
+			messages = append(messages,
+				&pgproto3.Parse{Query: statement},
+				&pgproto3.Bind{},
+				&pgproto3.Execute{},
+			)
+		}
+	} else {
+		messages = []pgproto3.FrontendMessage{&pgproto3.Query{String: statement}}
+	}
+
+	var modified []byte
+	for _, message := range messages {
+		var err error
+		modified, err = message.Encode(modified)
+		if err != nil {
+			p.Logger.Error("Failed to encode request", ErrorField, err)
+			return req
+		}
+	}
+
+	if err := setSignals(req, signals...); err != nil {
+		p.Logger.Error("Failed to create signals", ErrorField, err)
+		return req
+	}
+
+	req.Fields[RequestField] = v1.NewBytesValue(modified)
+	return req
+}
+
+// quoteLiteral quotes a string as a SQL string literal.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// terminate stops the request from reaching the server and sends the response
+// back to the client instead.
+func (p *Plugin) terminate(req *v1.Struct, response []byte, signals ...*sdkAct.Signal) *v1.Struct {
+	if err := setSignals(req, append([]*sdkAct.Signal{sdkAct.Terminate()}, signals...)...); err != nil {
+		p.Logger.Error("Failed to create signals", ErrorField, err)
+		return req
+	}
+
+	// Create a response to send back to the client.
+	req.Fields[ResponseField] = v1.NewBytesValue(response)
+	return req
+}
+
+// setSignals adds the signals that GatewayD acts upon after the hook returns
+// to the signals of the request, e.g. the logs of the lifted bans.
+func setSignals(req *v1.Struct, signals ...*sdkAct.Signal) error {
+	signalList := make([]any, 0, len(signals))
+	for _, signal := range signals {
+		signalList = append(signalList, signalValue(signal.ToMap()))
+	}
+
+	list, err := v1.NewList(signalList)
+	if err != nil {
+		return err
+	}
+
+	if existing := req.Fields[sdkAct.Signals].GetListValue(); existing != nil {
+		list.Values = append(existing.GetValues(), list.GetValues()...)
+	}
+	req.Fields[sdkAct.Signals] = v1.NewListValue(list)
+	return nil
+}
+
+// signalValue converts the string slices of the audit fields of a signal,
+// e.g. the denied entries of the denylist, to []any, as the signals must be
+// converted to a list of structs, which supports no other slices.
+func signalValue(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		converted := make(map[string]any, len(value))
+		for key, item := range value {
+			converted[key] = signalValue(item)
+		}
+		return converted
+	case []any:
+		converted := make([]any, 0, len(value))
+		for _, item := range value {
+			converted = append(converted, signalValue(item))
+		}
+		return converted
+	case []string:
+		converted := make([]any, 0, len(value))
+		for _, item := range value {
+			converted = append(converted, item)
+		}
+		return converted
+	}
+	return value
+}
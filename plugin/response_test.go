@@ -0,0 +1,343 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	v1 "github.com/gatewayd-io/gatewayd-plugin-sdk/plugin/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeResponse decodes the backend messages of a response.
+func decodeResponse(t *testing.T, response []byte) []pgproto3.BackendMessage {
+	t.Helper()
+
+	frontend := pgproto3.NewFrontend(bytes.NewReader(response), nil)
+	messages := []pgproto3.BackendMessage{}
+	for {
+		message, err := frontend.Receive()
+		if err != nil {
+			return messages
+		}
+		switch message.(type) {
+		case *pgproto3.ErrorResponse:
+			messages = append(messages, &pgproto3.ErrorResponse{})
+		case *pgproto3.ReadyForQuery:
+			messages = append(messages, &pgproto3.ReadyForQuery{})
+		default:
+			messages = append(messages, message)
+		}
+	}
+}
+
+func newTrafficRequest(t *testing.T, request []byte) *v1.Struct {
+	t.Helper()
+
+	req, err := v1.NewStruct(map[string]any{
+		"client": map[string]any{
+			"local":  "localhost:15432",
+			"remote": "127.0.0.1:45678",
+		},
+		"request": request,
+	})
+	require.NoError(t, err)
+	return req
+}
+
+func Test_prepareResponseExtendedWithSync(t *testing.T) {
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		ResponseType: ResponseType,
+		Connections:  NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+		&pgproto3.Bind{},
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	))
+
+	resp := p.prepareResponse(req, map[string]any{})
+	messages := decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ErrorResponse{},
+		&pgproto3.ReadyForQuery{},
+	}, messages)
+	assert.False(t, p.connection(req).SkipUntilSync())
+}
+
+func Test_prepareResponseExtendedWithoutSync(t *testing.T) {
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		ResponseType: ResponseType,
+		Connections:  NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Flush{},
+	))
+
+	resp := p.prepareResponse(req, map[string]any{})
+	messages := decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{&pgproto3.ErrorResponse{}}, messages)
+	assert.True(t, p.connection(req).SkipUntilSync())
+
+	// The following messages are discarded without a response.
+	resp, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Describe{ObjectType: 'P'},
+		&pgproto3.Execute{},
+	)))
+	require.NoError(t, err)
+	assert.Contains(t, resp.GetFields(), sdkAct.Signals)
+	assert.Empty(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.True(t, p.connection(req).SkipUntilSync())
+
+	// Sync ends the discarded batch.
+	resp, err = p.OnTrafficFromClient(
+		context.Background(), newTrafficRequest(t, encodeMessages(t, &pgproto3.Sync{})))
+	require.NoError(t, err)
+	messages = decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{&pgproto3.ReadyForQuery{}}, messages)
+	assert.False(t, p.connection(req).SkipUntilSync())
+}
+
+func Test_prepareResponseExtendedMultipleSyncs(t *testing.T) {
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		ResponseType: ResponseType,
+		Connections:  NewConnectionTracker(),
+	}
+
+	// Every Sync is answered with ReadyForQuery.
+	req := newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+		&pgproto3.Sync{},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+		&pgproto3.Execute{},
+	))
+
+	resp := p.prepareResponse(req, map[string]any{})
+	messages := decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ErrorResponse{},
+		&pgproto3.ReadyForQuery{},
+		&pgproto3.ReadyForQuery{},
+		&pgproto3.ErrorResponse{},
+		&pgproto3.ReadyForQuery{},
+		&pgproto3.ErrorResponse{},
+	}, messages)
+	assert.True(t, p.connection(req).SkipUntilSync())
+
+	// The messages after the Sync that ends the discarded batch are
+	// inspected, and pass through with the Sync if they are clean.
+	clean := encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = $1"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	p.Detectors = []string{"keyword"}
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+	resp, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		append(encodeMessages(t, &pgproto3.Execute{}, &pgproto3.Sync{}), clean...)))
+	require.NoError(t, err)
+	assert.NotContains(t, resp.GetFields(), ResponseField)
+	assert.Equal(t, append(encodeMessages(t, &pgproto3.Sync{}), clean...),
+		resp.Fields[RequestField].GetBytesValue())
+	assert.False(t, p.connection(req).SkipUntilSync())
+
+	// They are blocked like any other request otherwise.
+	p.connection(req).SetSkipUntilSync(true)
+	resp, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Sync{},
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)))
+	require.NoError(t, err)
+	messages = decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ReadyForQuery{},
+		&pgproto3.ErrorResponse{},
+		&pgproto3.ReadyForQuery{},
+	}, messages)
+	assert.False(t, p.connection(req).SkipUntilSync())
+}
+
+func Test_fromFirstSync(t *testing.T) {
+	sync := encodeMessages(t, &pgproto3.Sync{}, &pgproto3.Query{String: "SELECT 1"})
+	assert.Equal(t, sync, fromFirstSync(append(encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT 'S'"}, &pgproto3.Execute{}), sync...)))
+	assert.Equal(t, sync, fromFirstSync(sync))
+	assert.Nil(t, fromFirstSync(encodeMessages(t, &pgproto3.Execute{}, &pgproto3.Flush{})))
+	assert.Nil(t, fromFirstSync(nil))
+}
+
+func Test_prepareResponseExtendedEmpty(t *testing.T) {
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		ResponseType: "empty",
+		Connections:  NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+		&pgproto3.Describe{ObjectType: 'S'},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	))
+
+	resp := p.prepareResponse(req, map[string]any{})
+	messages := decodeResponse(t, resp.Fields[ResponseField].GetBytesValue())
+	assert.Equal(t, []pgproto3.BackendMessage{
+		&pgproto3.ParseComplete{},
+		&pgproto3.ParameterDescription{ParameterOIDs: []uint32{}},
+		&pgproto3.NoData{},
+		&pgproto3.BindComplete{},
+		&pgproto3.EmptyQueryResponse{},
+		&pgproto3.ReadyForQuery{},
+	}, messages)
+	assert.False(t, p.connection(req).SkipUntilSync())
+}
+
+func Test_OnClosed(t *testing.T) {
+	p := &Plugin{
+		Logger:      hclog.NewNullLogger(),
+		Connections: NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, nil)
+	p.connection(req).SetSkipUntilSync(true)
+	assert.Equal(t, 1, p.Connections.Len())
+
+	_, err := p.OnClosed(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, 0, p.Connections.Len())
+}
+
+func newServerResponse(t *testing.T, messages ...pgproto3.BackendMessage) *v1.Struct {
+	t.Helper()
+
+	var response []byte
+	for _, message := range messages {
+		var err error
+		response, err = message.Encode(response)
+		require.NoError(t, err)
+	}
+
+	resp, err := v1.NewStruct(map[string]any{
+		"client": map[string]any{
+			"local":  "localhost:15432",
+			"remote": "127.0.0.1:45678",
+		},
+		"response": response,
+	})
+	require.NoError(t, err)
+	return resp
+}
+
+func Test_OnTrafficFromServerTxStatus(t *testing.T) {
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		ResponseType: ResponseType,
+		Connections:  NewConnectionTracker(),
+	}
+
+	_, err := p.OnTrafficFromServer(context.Background(), newServerResponse(t,
+		&pgproto3.CommandComplete{CommandTag: []byte("BEGIN")},
+		&pgproto3.ReadyForQuery{TxStatus: 'T'},
+	))
+	require.NoError(t, err)
+
+	req := newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+	))
+	assert.Equal(t, TxStatusInTransaction, p.connection(req).TxStatus())
+
+	// The blocked response reports the transaction status of the server.
+	resp := p.prepareResponse(req, map[string]any{})
+	frontend := pgproto3.NewFrontend(
+		bytes.NewReader(resp.Fields[ResponseField].GetBytesValue()), nil)
+	_, err = frontend.Receive()
+	require.NoError(t, err)
+	message, err := frontend.Receive()
+	require.NoError(t, err)
+	readyForQuery, ok := message.(*pgproto3.ReadyForQuery)
+	require.True(t, ok)
+	assert.Equal(t, TxStatusInTransaction, readyForQuery.TxStatus)
+
+	// A response without ReadyForQuery doesn't change the status.
+	_, err = p.OnTrafficFromServer(context.Background(), newServerResponse(t,
+		&pgproto3.DataRow{Values: [][]byte{[]byte("Z")}},
+	))
+	require.NoError(t, err)
+	assert.Equal(t, TxStatusInTransaction, p.connection(req).TxStatus())
+}
+
+func Test_prepareResponseAbortTransaction(t *testing.T) {
+	p := &Plugin{
+		Logger:                  hclog.NewNullLogger(),
+		ResponseType:            ResponseType,
+		ErrorNumber:             ErrorNumber,
+		ErrorMessage:            ErrorMessage,
+		ErrorDetail:             ErrorDetail,
+		AbortTransactionOnBlock: true,
+		Connections:             NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+	))
+	p.connection(req).SetTxStatus(TxStatusInTransaction)
+
+	resp := p.prepareResponse(req, map[string]any{})
+	// The request is forwarded to the server to abort the transaction.
+	assert.NotContains(t, resp.GetFields(), ResponseField)
+	assert.Len(t, resp.Fields[sdkAct.Signals].GetListValue().AsSlice(), 1)
+
+	decoded := decodeClientRequest(resp.Fields[RequestField].GetBytesValue())
+	require.Len(t, decoded.queries, 1)
+	assert.Equal(t,
+		"DO $gatewayd$ BEGIN RAISE EXCEPTION USING ERRCODE = '42000', "+
+			"MESSAGE = 'SQL injection detected', "+
+			"DETAIL = 'Back off, you''re not welcome here.'; END $gatewayd$",
+		decoded.queries[0].text)
+
+	// Every batch up to a Sync raises the error, and the server answers
+	// every Sync with ReadyForQuery.
+	req = newTrafficRequest(t, encodeMessages(t,
+		&pgproto3.Sync{},
+		&pgproto3.Parse{Query: "SELECT * FROM users WHERE id = 1 OR 1=1"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+	))
+	resp = p.prepareResponse(req, map[string]any{})
+	decoded = decodeClientRequest(resp.Fields[RequestField].GetBytesValue())
+	assert.Equal(t, []clientMessage{
+		{kind: SyncMessage},
+		{kind: QueryMessage},
+		{kind: ParseMessage},
+		{kind: BindMessage},
+		{kind: ExecuteMessage},
+	}, decoded.messages)
+}
@@ -0,0 +1,295 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// Columns of the PostgreSQL csvlog.
+// Ref: https://www.postgresql.org/docs/current/runtime-config-logging.html#RUNTIME-CONFIG-LOGGING-CSVLOG
+const (
+	csvlogUserName        = 1
+	csvlogDatabaseName    = 2
+	csvlogConnectionFrom  = 4
+	csvlogMessage         = 13
+	csvlogApplicationName = 22
+
+	maxScanLineSize = 16 * 1024 * 1024
+)
+
+// ScanQuery is a query of a query corpus, along with the client that sent it,
+// if the corpus records it.
+type ScanQuery struct {
+	Line    int
+	Text    string
+	Session Session
+}
+
+// scanRecord is a query of a JSONL corpus.
+type scanRecord struct {
+	Query           string `json:"query"`
+	User            string `json:"user"`
+	Database        string `json:"database"`
+	ApplicationName string `json:"application_name"`
+	ClientAddress   string `json:"client_address"`
+}
+
+// ScanFormatOf returns the format of a query corpus by its file extension,
+// defaulting to one query per line.
+func ScanFormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson", ".json":
+		return ScanFormatJSONL
+	case ".csv":
+		return ScanFormatCSVLog
+	default:
+		return ScanFormatLines
+	}
+}
+
+// ReadScanQueries reads the queries of a corpus in the given format, and calls
+// fn with each query. Reading stops at the first error.
+func ReadScanQueries(reader io.Reader, format string, fn func(ScanQuery) error) error {
+	switch format {
+	case ScanFormatLines:
+		return readScanLines(reader, func(line int, text string) error {
+			return fn(ScanQuery{Line: line, Text: text})
+		})
+	case ScanFormatJSONL:
+		return readScanLines(reader, func(line int, text string) error {
+			var record scanRecord
+			if err := json.Unmarshal([]byte(text), &record); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			if record.Query == "" {
+				return fmt.Errorf("line %d: query is required", line)
+			}
+			return fn(ScanQuery{
+				Line: line,
+				Text: record.Query,
+				Session: Session{
+					User:            record.User,
+					Database:        record.Database,
+					ApplicationName: record.ApplicationName,
+					ClientAddress:   record.ClientAddress,
+				},
+			})
+		})
+	case ScanFormatCSVLog:
+		return readScanCSVLog(reader, fn)
+	default:
+		return fmt.Errorf("unknown format: %s", format)
+	}
+}
+
+// readScanLines calls fn with every non-empty line.
+func readScanLines(reader io.Reader, fn func(line int, text string) error) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, maxScanLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if err := fn(line, text); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readScanCSVLog calls fn with the statements logged by log_statement or
+// log_min_duration_statement. The other messages are skipped.
+func readScanCSVLog(reader io.Reader, fn func(ScanQuery) error) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	for {
+		record, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) <= csvlogMessage {
+			continue
+		}
+		text, ok := csvlogStatement(record[csvlogMessage])
+		if !ok {
+			continue
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		query := ScanQuery{
+			Line: line,
+			Text: text,
+			Session: Session{
+				User:          record[csvlogUserName],
+				Database:      record[csvlogDatabaseName],
+				ClientAddress: record[csvlogConnectionFrom],
+			},
+		}
+		if len(record) > csvlogApplicationName {
+			query.Session.ApplicationName = record[csvlogApplicationName]
+		}
+		if err := fn(query); err != nil {
+			return err
+		}
+	}
+}
+
+// csvlogStatement returns the statement of a log message, e.g.
+// "statement: SELECT 1" or "duration: 0.1 ms  execute <unnamed>: SELECT 1".
+func csvlogStatement(message string) (string, bool) {
+	if strings.HasPrefix(message, "duration: ") {
+		var ok bool
+		if _, message, ok = strings.Cut(message, " ms  "); !ok {
+			return "", false
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(message, "statement: "):
+		return strings.TrimPrefix(message, "statement: "), true
+	case strings.HasPrefix(message, "execute "):
+		_, statement, ok := strings.Cut(message, ": ")
+		return statement, ok
+	default:
+		return "", false
+	}
+}
+
+// ScanResult is the verdict of the plugin on a query of a corpus.
+type ScanResult struct {
+	File        string             `json:"file,omitempty"`
+	Line        int                `json:"line"`
+	Query       string             `json:"query"`
+	Session     map[string]any     `json:"session,omitempty"`
+	Detected    bool               `json:"detected"`
+	Allowlisted bool               `json:"allowlisted"`
+	Detector    string             `json:"detector,omitempty"`
+	Variant     string             `json:"variant,omitempty"`
+	Statement   string             `json:"statement,omitempty"`
+	Flagged     string             `json:"flagged,omitempty"`
+	Scores      map[string]float32 `json:"scores,omitempty"`
+	Policy      string             `json:"policy,omitempty"`
+	Errors      []string           `json:"errors,omitempty"`
+}
+
+// Verdict returns the verdict as a single word.
+func (r *ScanResult) Verdict() string {
+	switch {
+	case r.Detected:
+		return ScanDetected
+	case r.Allowlisted:
+		return ScanAllowlisted
+	case len(r.Errors) > 0:
+		return ScanFailed
+	default:
+		return ScanClean
+	}
+}
+
+// Scan runs the query through the same settings, policies, allowlists and
+// detectors as OnTrafficFromClient, without blocking anything.
+func (p *Plugin) Scan(ctx context.Context, query ScanQuery) *ScanResult {
+	p = p.current()
+	ctx = WithSession(ctx, query.Session)
+	effective, policy := p.withPolicy(query.Session)
+
+	result := effective.inspect(ctx, effective.pipeline(), &clientQuery{source: QuerySource, text: query.Text})
+	scan := &ScanResult{
+		Line:        query.Line,
+		Query:       query.Text,
+		Session:     query.Session.Fields(),
+		Detected:    result.Detected,
+		Allowlisted: result.Allowlisted,
+		Scores:      map[string]float32{},
+	}
+	if len(scan.Session) == 0 {
+		scan.Session = nil
+	}
+	if verdict := result.Verdict(); verdict != nil {
+		scan.Detector = verdict.Detector
+		scan.Variant = result.Variant
+		scan.Statement = result.Statement
+	}
+	for _, verdict := range result.Verdicts {
+		scan.Scores[verdict.Detector] = verdict.Score
+	}
+	if result.Flagged != nil {
+		scan.Flagged = result.Flagged.Detector
+		scan.Scores[result.Flagged.Detector] = result.Flagged.Score
+	}
+	if policy != nil {
+		scan.Policy = policy.Name
+	}
+	for _, err := range result.Errors {
+		scan.Errors = append(scan.Errors, err.Error())
+	}
+	return scan
+}
+
+// ScanSummary counts the verdicts of a scan.
+type ScanSummary struct {
+	Queries     int
+	Detected    int
+	Allowlisted int
+	Failed      int
+	// Detectors counts the detections by detector.
+	Detectors map[string]int
+}
+
+// Add counts the verdict of a query.
+func (s *ScanSummary) Add(result *ScanResult) {
+	s.Queries++
+	switch result.Verdict() {
+	case ScanDetected:
+		s.Detected++
+		if s.Detectors == nil {
+			s.Detectors = map[string]int{}
+		}
+		s.Detectors[result.Detector]++
+	case ScanAllowlisted:
+		s.Allowlisted++
+	}
+	if len(result.Errors) > 0 {
+		s.Failed++
+	}
+}
+
+// Write writes the summary as a table.
+func (s *ScanSummary) Write(writer io.Writer) error {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "Queries\t%d\n", s.Queries)
+	fmt.Fprintf(table, "Detected\t%d\t%s\n", s.Detected, percentage(s.Detected, s.Queries))
+	fmt.Fprintf(table, "Allowlisted\t%d\t%s\n", s.Allowlisted, percentage(s.Allowlisted, s.Queries))
+	fmt.Fprintf(table, "Failed\t%d\t%s\n", s.Failed, percentage(s.Failed, s.Queries))
+
+	detectors := make([]string, 0, len(s.Detectors))
+	for detector := range s.Detectors {
+		detectors = append(detectors, detector)
+	}
+	slices.Sort(detectors)
+	for _, detector := range detectors {
+		fmt.Fprintf(table, "Detected by %s\t%d\t%s\n",
+			detector, s.Detectors[detector], percentage(s.Detectors[detector], s.Queries))
+	}
+	return table.Flush()
+}
+
+func percentage(count, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(count)*100/float64(total))
+}
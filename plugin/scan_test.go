@@ -0,0 +1,135 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readScanQueries(t *testing.T, corpus, format string) []ScanQuery {
+	t.Helper()
+
+	var queries []ScanQuery
+	require.NoError(t, ReadScanQueries(strings.NewReader(corpus), format, func(query ScanQuery) error {
+		queries = append(queries, query)
+		return nil
+	}))
+	return queries
+}
+
+func Test_ScanFormatOf(t *testing.T) {
+	assert.Equal(t, ScanFormatJSONL, ScanFormatOf("queries.jsonl"))
+	assert.Equal(t, ScanFormatCSVLog, ScanFormatOf("postgresql.CSV"))
+	assert.Equal(t, ScanFormatLines, ScanFormatOf("queries.sql"))
+	assert.Equal(t, ScanFormatLines, ScanFormatOf("-"))
+}
+
+func Test_ReadScanQueriesLines(t *testing.T) {
+	queries := readScanQueries(t, "SELECT 1\n\n  SELECT 2  \n", ScanFormatLines)
+	assert.Equal(t, []ScanQuery{
+		{Line: 1, Text: "SELECT 1"},
+		{Line: 3, Text: "SELECT 2"},
+	}, queries)
+}
+
+func Test_ReadScanQueriesJSONL(t *testing.T) {
+	queries := readScanQueries(t,
+		`{"query": "SELECT 1", "user": "alice", "database": "app", "client_address": "10.0.0.1"}`+"\n",
+		ScanFormatJSONL)
+	assert.Equal(t, []ScanQuery{{
+		Line:    1,
+		Text:    "SELECT 1",
+		Session: Session{User: "alice", Database: "app", ClientAddress: "10.0.0.1"},
+	}}, queries)
+
+	err := ReadScanQueries(strings.NewReader("{}\n"), ScanFormatJSONL, func(ScanQuery) error {
+		return nil
+	})
+	require.EqualError(t, err, "line 1: query is required")
+}
+
+func Test_ReadScanQueriesCSVLog(t *testing.T) {
+	corpus := `2024-01-01 00:00:00.000 UTC,"alice","app",42,"10.0.0.1:5432",abc.1,1,"SELECT",2024-01-01 00:00:00 UTC,3/1,0,LOG,00000,"statement: SELECT *
+FROM users",,,,,,,,,"psql","client backend",,0
+2024-01-01 00:00:01.000 UTC,"alice","app",42,"10.0.0.1:5432",abc.1,2,"idle",2024-01-01 00:00:00 UTC,3/1,0,LOG,00000,"connection authorized: user=alice",,,,,,,,,"psql","client backend",,0
+2024-01-01 00:00:02.000 UTC,"bob","app",43,"10.0.0.2:5432",abc.2,1,"SELECT",2024-01-01 00:00:00 UTC,4/1,0,LOG,00000,"duration: 0.123 ms  execute <unnamed>: SELECT $1",,,,,,,,,"","client backend",,0
+`
+	queries := readScanQueries(t, corpus, ScanFormatCSVLog)
+	require.Len(t, queries, 2)
+	assert.Equal(t, ScanQuery{
+		Line: 1,
+		Text: "SELECT *\nFROM users",
+		Session: Session{
+			User:            "alice",
+			Database:        "app",
+			ApplicationName: "psql",
+			ClientAddress:   "10.0.0.1:5432",
+		},
+	}, queries[0])
+	assert.Equal(t, 4, queries[1].Line)
+	assert.Equal(t, "SELECT $1", queries[1].Text)
+	assert.Equal(t, "bob", queries[1].Session.User)
+}
+
+func Test_Scan(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+
+	allowlist, err := NewAllowlist(AllowlistEnforce, "", 0)
+	require.NoError(t, err)
+	require.NoError(t, allowlist.Add("SELECT * FROM users WHERE id = 1 OR id = 2"))
+	policies, err := ParsePolicies([]byte(`
+policies:
+  - name: reporting
+    match:
+      databases: [reporting]
+    detectors: [libinjection]
+    enableLibinjection: false
+`))
+	require.NoError(t, err)
+
+	p := &Plugin{
+		Logger:    hclog.NewNullLogger(),
+		Detectors: []string{"keyword"},
+		Allowlist: allowlist,
+		Policies:  policies,
+	}
+
+	result := p.Scan(context.Background(), ScanQuery{Line: 1, Text: "SELECT 1 OR 1=1"})
+	assert.True(t, result.Detected)
+	assert.Equal(t, ScanDetected, result.Verdict())
+	assert.Equal(t, "keyword", result.Detector)
+
+	result = p.Scan(context.Background(), ScanQuery{Text: "SELECT * FROM users WHERE id = 3 OR id = 4"})
+	assert.Equal(t, ScanAllowlisted, result.Verdict())
+
+	result = p.Scan(context.Background(), ScanQuery{
+		Text:    "SELECT 1 OR 1=1",
+		Session: Session{Database: "reporting"},
+	})
+	assert.Equal(t, ScanClean, result.Verdict())
+	assert.Equal(t, "reporting", result.Policy)
+	assert.Equal(t, map[string]any{DatabaseField: "reporting"}, result.Session)
+}
+
+func Test_ScanSummary(t *testing.T) {
+	summary := &ScanSummary{}
+	summary.Add(&ScanResult{Detected: true, Detector: Libinjection})
+	summary.Add(&ScanResult{Allowlisted: true})
+	summary.Add(&ScanResult{Errors: []string{"deep_learning_model: timeout"}})
+	summary.Add(&ScanResult{})
+
+	assert.Equal(t, 4, summary.Queries)
+	assert.Equal(t, 1, summary.Detected)
+	assert.Equal(t, 1, summary.Allowlisted)
+	assert.Equal(t, 1, summary.Failed)
+
+	var output bytes.Buffer
+	require.NoError(t, summary.Write(&output))
+	assert.Contains(t, output.String(), "Detected                  1  25.0%")
+	assert.Contains(t, output.String(), "Detected by libinjection  1  25.0%")
+}
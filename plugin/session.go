@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// Session identifies the client of a connection, as announced by the client
+// in the startup message of PostgreSQL or the handshake response of MySQL.
+type Session struct {
+	User            string
+	Database        string
+	ApplicationName string
+	// ClientAddress is the remote address of the client, as passed by GatewayD.
+	ClientAddress string
+}
+
+// Fields returns the audit fields of the session, omitting the unknown ones.
+func (s Session) Fields() map[string]any {
+	fields := map[string]any{}
+	for key, value := range map[string]string{
+		UserField:            s.User,
+		DatabaseField:        s.Database,
+		ApplicationNameField: s.ApplicationName,
+		ClientAddressField:   s.ClientAddress,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+type sessionContextKey struct{}
+
+// WithSession returns a copy of the context that carries the session, so that
+// the detectors can make decisions based on the client.
+func WithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+// SessionFromContext returns the session carried by the context, if any.
+func SessionFromContext(ctx context.Context) (Session, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(Session)
+	return session, ok
+}
+
+// postgresStartupSession returns the session from a PostgreSQL startup
+// message. SSL and GSS encryption requests are not startup messages.
+func postgresStartupSession(request []byte) *Session {
+	backend := pgproto3.NewBackend(bytes.NewReader(request), nil)
+	message, err := backend.ReceiveStartupMessage()
+	if err != nil {
+		return nil
+	}
+
+	startup, ok := message.(*pgproto3.StartupMessage)
+	if !ok {
+		return nil
+	}
+
+	session := &Session{
+		User:            startup.Parameters["user"],
+		Database:        startup.Parameters["database"],
+		ApplicationName: startup.Parameters["application_name"],
+	}
+	// The database defaults to the user name.
+	if session.Database == "" {
+		session.Database = session.User
+	}
+	return session
+}
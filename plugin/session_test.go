@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	sdkAct "github.com/gatewayd-io/gatewayd-plugin-sdk/act"
+	"github.com/hashicorp/go-hclog"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_OnTrafficFromClientSession(t *testing.T) {
+	RegisterDetector("keyword", func(*Plugin) Detector { return &keywordDetector{keyword: "OR"} })
+
+	p := &Plugin{
+		Logger:       hclog.NewNullLogger(),
+		Detectors:    []string{"keyword"},
+		ResponseType: ResponseType,
+		Connections:  NewConnectionTracker(),
+	}
+
+	req := newTrafficRequest(t, nil)
+	_, err := p.OnOpened(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, Session{ClientAddress: "127.0.0.1:45678"}, p.connection(req).Session())
+
+	startup, err := (&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters: map[string]string{
+			"user":             "alice",
+			"database":         "reporting",
+			"application_name": "psql",
+		},
+	}).Encode(nil)
+	require.NoError(t, err)
+
+	_, err = p.OnTrafficFromClient(context.Background(), newTrafficRequest(t, startup))
+	require.NoError(t, err)
+	assert.Equal(t, Session{
+		User:            "alice",
+		Database:        "reporting",
+		ApplicationName: "psql",
+		ClientAddress:   "127.0.0.1:45678",
+	}, p.connection(req).Session())
+
+	// The session is part of the audit trail.
+	resp, err := p.OnTrafficFromClient(context.Background(), newTrafficRequest(t,
+		encodeMessages(t, &pgproto3.Query{String: "SELECT * FROM users WHERE id = 1 OR 1=1"})))
+	require.NoError(t, err)
+	signals := resp.Fields[sdkAct.Signals].GetListValue().AsSlice()
+	require.Len(t, signals, 2)
+	metadata := signals[1].(map[string]any)["metadata"].(map[string]any)
+	assert.Equal(t, "alice", metadata[UserField])
+	assert.Equal(t, "reporting", metadata[DatabaseField])
+	assert.Equal(t, "psql", metadata[ApplicationNameField])
+	assert.Equal(t, "127.0.0.1:45678", metadata[ClientAddressField])
+}
+
+func Test_postgresStartupSessionDefaultDatabase(t *testing.T) {
+	startup, err := (&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "bob"},
+	}).Encode(nil)
+	require.NoError(t, err)
+
+	session := postgresStartupSession(startup)
+	require.NotNil(t, session)
+	assert.Equal(t, "bob", session.Database)
+
+	sslRequest, err := (&pgproto3.SSLRequest{}).Encode(nil)
+	require.NoError(t, err)
+	assert.Nil(t, postgresStartupSession(sslRequest))
+}
+
+func Test_mysqlHandshakeResponse(t *testing.T) {
+	capabilities := mysqlClientProtocol41 | mysqlClientSecureConnection |
+		mysqlClientConnectWithDB | mysqlClientPluginAuth | mysqlClientConnectAttrs
+	payload := make([]byte, mysqlHandshakeResponseMinLength)
+	binary.LittleEndian.PutUint32(payload, capabilities)
+	payload = append(payload, "alice\x00"...)
+	payload = append(payload, 3, 1, 2, 3)
+	payload = append(payload, "shop\x00"...)
+	payload = append(payload, "mysql_native_password\x00"...)
+	attributes := append(mysqlLengthEncodedString("_os"), mysqlLengthEncodedString("Linux")...)
+	attributes = append(attributes, mysqlLengthEncodedString("program_name")...)
+	attributes = append(attributes, mysqlLengthEncodedString("mysql")...)
+	payload = append(payload, byte(len(attributes)))
+	payload = append(payload, attributes...)
+
+	request := decodeMySQLRequest(writeMySQLPacket(nil, 1, payload), nil)
+	require.NotNil(t, request.session)
+	assert.Equal(t, Session{
+		User:            "alice",
+		Database:        "shop",
+		ApplicationName: "mysql",
+	}, *request.session)
+
+	// An SSL request only contains the capabilities.
+	request = decodeMySQLRequest(writeMySQLPacket(nil, 1, payload[:mysqlHandshakeResponseMinLength]), nil)
+	assert.Nil(t, request.session)
+}
+
+func Test_SessionFromContext(t *testing.T) {
+	_, ok := SessionFromContext(context.Background())
+	assert.False(t, ok)
+
+	ctx := WithSession(context.Background(), Session{User: "alice"})
+	session, ok := SessionFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", session.User)
+	assert.Equal(t, map[string]any{UserField: "alice"}, session.Fields())
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"strings"
+
+	pganalyze "github.com/pganalyze/pg_query_go/v6"
+	pgQuery "github.com/wasilibs/go-pgquery"
+)
+
+// SplitStatements splits a PostgreSQL query into its statements at the
+// semicolons that separate them, using the lexer of PostgreSQL, so that the
+// semicolons of strings, dollar-quoted strings, quoted identifiers, comments
+// and BEGIN ATOMIC function bodies don't split the query. Empty statements,
+// i.e. only whitespace or comments, are skipped. An error is returned if the
+// query can't be scanned, e.g. due to an unterminated string.
+func SplitStatements(query string) ([]string, error) {
+	scanned, err := pgQuery.Scan(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []string
+	start, empty := 0, true
+	// depth is the nesting depth of BEGIN ATOMIC ... END blocks, including the
+	// CASE ... END expressions inside them.
+	depth := 0
+	for idx, token := range scanned.Tokens {
+		switch token.Token {
+		case pganalyze.Token_C_COMMENT, pganalyze.Token_SQL_COMMENT:
+			continue
+		case pganalyze.Token_BEGIN_P:
+			if idx+1 < len(scanned.Tokens) && scanned.Tokens[idx+1].Token == pganalyze.Token_ATOMIC {
+				depth++
+			}
+		case pganalyze.Token_CASE:
+			if depth > 0 {
+				depth++
+			}
+		case pganalyze.Token_END_P:
+			if depth > 0 {
+				depth--
+			}
+		case pganalyze.Token_ASCII_59:
+			if depth > 0 {
+				break
+			}
+			if !empty {
+				statements = append(statements, strings.TrimSpace(query[start:token.Start]))
+			}
+			start, empty = int(token.End), true
+			continue
+		}
+		empty = false
+	}
+	if !empty {
+		statements = append(statements, strings.TrimSpace(query[start:]))
+	}
+	return statements, nil
+}
+
+// statements returns the statements of a simple PostgreSQL Query message, or
+// nil if the query can't be split, e.g. because it is the SQL of a Parse
+// message, which can only contain a single statement.
+func (p *Plugin) statements(query *clientQuery) []string {
+	if query.source != QuerySource || p.Protocol == MySQLProtocol {
+		return nil
+	}
+	statements, err := SplitStatements(query.text)
+	if err != nil {
+		p.Logger.Trace("Failed to split query into statements", ErrorField, err)
+		return nil
+	}
+	return statements
+}
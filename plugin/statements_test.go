@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_SplitStatements(t *testing.T) {
+	for query, expected := range map[string][]string{
+		"SELECT 1":                            {"SELECT 1"},
+		"SELECT 1;":                           {"SELECT 1"},
+		"SELECT 1; DROP TABLE users; -- done": {"SELECT 1", "DROP TABLE users"},
+		";; SELECT 1 ;/* ; */; SELECT 2":      {"SELECT 1", "SELECT 2"},
+		// Semicolons of strings, identifiers and comments don't split the query.
+		`SELECT ';', E'\';', $x$;$x$, ";" -- ;` + "\n; SELECT 2": {
+			`SELECT ';', E'\';', $x$;$x$, ";" -- ;`, "SELECT 2",
+		},
+		"CREATE FUNCTION f() RETURNS int BEGIN ATOMIC SELECT CASE WHEN true THEN 1 END; SELECT 2; END; SELECT f()": {
+			"CREATE FUNCTION f() RETURNS int BEGIN ATOMIC SELECT CASE WHEN true THEN 1 END; SELECT 2; END",
+			"SELECT f()",
+		},
+		"BEGIN; SELECT 1; END;": {"BEGIN", "SELECT 1", "END"},
+		"-- nothing":            nil,
+	} {
+		statements, err := SplitStatements(query)
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, statements, query)
+	}
+
+	_, err := SplitStatements("SELECT 'a; SELECT 2")
+	require.Error(t, err)
+}
+
+// prefixDetector flags the queries with the prefix.
+type prefixDetector struct {
+	prefix string
+}
+
+func (d *prefixDetector) Name() string {
+	return "prefix"
+}
+
+func (d *prefixDetector) Inspect(_ context.Context, query string) (*Verdict, error) {
+	return &Verdict{Detector: d.Name(), Injection: strings.HasPrefix(query, d.prefix)}, nil
+}
+
+func Test_InspectStatements(t *testing.T) {
+	pipeline := &Pipeline{
+		Detectors: []Detector{&prefixDetector{prefix: "DROP"}},
+		Logger:    hclog.NewNullLogger(),
+	}
+	p := &Plugin{Logger: hclog.NewNullLogger()}
+	query := &clientQuery{source: QuerySource, text: "SELECT * FROM users WHERE id = 1; DROP TABLE users"}
+
+	result := p.inspect(context.Background(), pipeline, query)
+	assert.True(t, result.Detected)
+	assert.Equal(t, "DROP TABLE users", result.Statement)
+
+	// The SQL of a Parse message and MySQL queries are not split.
+	result = p.inspect(context.Background(), pipeline, &clientQuery{source: ParseSource, text: query.text})
+	assert.False(t, result.Detected)
+	mysql := &Plugin{Logger: hclog.NewNullLogger(), Protocol: MySQLProtocol}
+	result = mysql.inspect(context.Background(), pipeline, query)
+	assert.False(t, result.Detected)
+
+	// The statements of normalized queries are normalized as well.
+	pipeline.Detectors = []Detector{&prefixDetector{prefix: "SELECT pg_sleep"}}
+	p.NormalizeQueries = true
+	result = p.inspect(context.Background(), pipeline, &clientQuery{
+		source: QuerySource, text: "SELECT 1; /* x */ select PG_SLEEP(10)",
+	})
+	assert.True(t, result.Detected)
+	assert.Equal(t, "/* x */ select PG_SLEEP(10)", result.Statement)
+	assert.Equal(t, NormalizedVariant, result.Variant)
+	assert.Equal(t, "SELECT pg_sleep(10)", result.NormalizedQuery)
+}
+
+func Test_InspectBlockStackedQueries(t *testing.T) {
+	pipeline := &Pipeline{
+		Detectors: []Detector{&prefixDetector{prefix: "DROP"}},
+		Logger:    hclog.NewNullLogger(),
+	}
+	p := &Plugin{Logger: hclog.NewNullLogger(), BlockStackedQueries: true}
+
+	result := p.inspect(context.Background(), pipeline, &clientQuery{
+		source: QuerySource, text: "SELECT 1; SELECT 2; -- comment",
+	})
+	assert.True(t, result.Detected)
+	verdict := result.Verdict()
+	require.NotNil(t, verdict)
+	assert.Equal(t, StackedQueries, verdict.Detector)
+	assert.Equal(t, map[string]any{StatementsField: 2}, verdict.Evidence)
+
+	// A query with more statements than can be inspected is blocked, even if
+	// stacked queries are allowed.
+	p.BlockStackedQueries = false
+	result = p.inspect(context.Background(), pipeline, &clientQuery{
+		source: QuerySource, text: strings.Repeat("SELECT 1;", MaxInspectedStatements+1),
+	})
+	assert.True(t, result.Detected)
+	assert.Equal(t, StackedQueries, result.Verdict().Detector)
+	assert.Equal(t, map[string]any{StatementsField: MaxInspectedStatements + 1}, result.Verdict().Evidence)
+	result = p.inspect(context.Background(), pipeline, &clientQuery{
+		source: QuerySource, text: strings.Repeat("SELECT 1;", MaxInspectedStatements),
+	})
+	assert.False(t, result.Detected)
+	p.BlockStackedQueries = true
+
+	// A single statement with a trailing semicolon is not a stacked query.
+	result = p.inspect(context.Background(), pipeline, &clientQuery{source: QuerySource, text: "SELECT 1;"})
+	assert.False(t, result.Detected)
+
+	// The policy of an application that sends stacked queries allows them.
+	allow := false
+	p.Policies = []*Policy{{
+		Name:      "migrations",
+		Match:     PolicyMatch{Users: []string{"migrator"}, ApplicationNames: []string{"migrate"}},
+		Overrides: Overrides{BlockStackedQueries: &allow},
+	}}
+	effective, _ := p.withPolicy(Session{User: "migrator", ApplicationName: "migrate"})
+	result = effective.inspect(context.Background(), pipeline, &clientQuery{
+		source: QuerySource, text: "CREATE TABLE t (id int); CREATE INDEX ON t (id)",
+	})
+	assert.False(t, result.Detected)
+}
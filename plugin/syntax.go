@@ -0,0 +1,363 @@
+package plugin
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	pganalyze "github.com/pganalyze/pg_query_go/v6"
+	pgQuery "github.com/wasilibs/go-pgquery"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The rules of the syntax tree detector, in the order they are reported.
+var syntaxRules = []string{
+	RuleTautology,
+	RuleUnionNullPadding,
+	RuleOrderByProbing,
+	RuleConditionalTimeDelay,
+	RuleCatalogSubquery,
+}
+
+// orderByProbeLimit is the highest ORDER BY position of a query that selects
+// all columns with *, whose number of columns is unknown, that is not
+// considered probing.
+const orderByProbeLimit = 20
+
+// SyntaxTreeDetector parses the query with the PostgreSQL grammar and flags
+// the structures typical of injections, each detected by a rule:
+//
+//   - tautology: an OR of the WHERE, HAVING or JOIN condition with a
+//     comparison of constants that is always true, e.g. 1=1 or 'a'='a', or
+//     the constant true.
+//   - union_null_padding: a UNION with a SELECT of NULLs, except for at most
+//     one column, that pads the columns to the count of the query.
+//   - order_by_probing: an ORDER BY position beyond the columns of the query,
+//     which probes the number of columns.
+//   - conditional_time_delay: pg_sleep() in a condition, CASE or boolean
+//     expression, which leaks data by the time the query takes.
+//   - catalog_subquery: a subquery or UNION of pg_catalog or
+//     information_schema, in a query of the tables of the application.
+//
+// Queries that can't be parsed, e.g. fragments or MySQL queries, are clean.
+type SyntaxTreeDetector struct {
+	Logger hclog.Logger
+}
+
+var _ Detector = (*SyntaxTreeDetector)(nil)
+
+func (d *SyntaxTreeDetector) Name() string {
+	return SyntaxTree
+}
+
+func (d *SyntaxTreeDetector) Inspect(_ context.Context, query string) (*Verdict, error) {
+	rules, err := MatchSyntaxRules(query)
+	if err != nil {
+		d.Logger.Trace("Failed to parse query", ErrorField, err)
+	}
+	d.Logger.Trace("Syntax tree rules", RulesField, rules)
+
+	verdict := &Verdict{Detector: SyntaxTree}
+	if len(rules) > 0 {
+		verdict.Injection = true
+		verdict.Score = 1
+		verdict.Evidence = map[string]any{
+			RuleField:  rules[0],
+			RulesField: rules,
+		}
+	}
+	return verdict, nil
+}
+
+// MatchSyntaxRules parses the query and returns the IDs of the rules of the
+// syntax tree detector that match it.
+func MatchSyntaxRules(query string) ([]string, error) {
+	tree, err := pgQuery.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[string]bool{}
+	for _, statement := range tree.GetStmts() {
+		visitor := &syntaxVisitor{matched: matched}
+		walkSyntaxTree(statement.GetStmt().ProtoReflect(), nil, visitor.visit)
+		if visitor.catalogSubquery && visitor.userRelation {
+			matched[RuleCatalogSubquery] = true
+		}
+	}
+
+	var rules []string
+	for _, rule := range syntaxRules {
+		if matched[rule] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// syntaxAncestor is a node of the syntax tree, and the field of the node the
+// path to the visited node goes through.
+type syntaxAncestor struct {
+	node  proto.Message
+	field protoreflect.Name
+}
+
+// walkSyntaxTree calls visit with every node of the syntax tree, depth-first,
+// and its ancestors, starting with the root.
+func walkSyntaxTree(
+	node protoreflect.Message, ancestors []syntaxAncestor,
+	visit func(node proto.Message, ancestors []syntaxAncestor),
+) {
+	visit(node.Interface(), ancestors)
+	node.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		if field.Kind() != protoreflect.MessageKind {
+			return true
+		}
+		path := append(ancestors[:len(ancestors):len(ancestors)], syntaxAncestor{node.Interface(), field.Name()})
+		if field.IsList() {
+			for idx := range value.List().Len() {
+				walkSyntaxTree(value.List().Get(idx).Message(), path, visit)
+			}
+			return true
+		}
+		walkSyntaxTree(value.Message(), path, visit)
+		return true
+	})
+}
+
+// syntaxVisitor matches the rules against the nodes of a statement.
+type syntaxVisitor struct {
+	matched map[string]bool
+	// catalogSubquery is true if a subquery or UNION selects from the catalog,
+	// and userRelation if the statement refers to any other relation.
+	catalogSubquery bool
+	userRelation    bool
+}
+
+func (v *syntaxVisitor) visit(node proto.Message, ancestors []syntaxAncestor) {
+	switch node := node.(type) {
+	case *pganalyze.BoolExpr:
+		if node.GetBoolop() == pganalyze.BoolExprType_OR_EXPR && inCondition(ancestors) &&
+			slices.ContainsFunc(node.GetArgs(), isTautology) {
+			v.matched[RuleTautology] = true
+		}
+	case *pganalyze.SelectStmt:
+		if node.GetOp() == pganalyze.SetOperation_SETOP_UNION && isNullPadding(node.GetRarg()) {
+			v.matched[RuleUnionNullPadding] = true
+		}
+		if isOrderByProbing(node) {
+			v.matched[RuleOrderByProbing] = true
+		}
+	case *pganalyze.FuncCall:
+		if isSleep(node) && isConditional(ancestors) {
+			v.matched[RuleConditionalTimeDelay] = true
+		}
+	case *pganalyze.RangeVar:
+		if !isCatalogRelation(node) {
+			v.userRelation = true
+		} else if isSubquery(ancestors) {
+			v.catalogSubquery = true
+		}
+	}
+}
+
+// inCondition returns true if the node is part of a WHERE, HAVING or JOIN
+// condition.
+func inCondition(ancestors []syntaxAncestor) bool {
+	return slices.ContainsFunc(ancestors, func(ancestor syntaxAncestor) bool {
+		switch ancestor.field {
+		case "where_clause", "having_clause", "quals":
+			return true
+		}
+		return false
+	})
+}
+
+// isConditional returns true if the node is evaluated depending on a
+// condition.
+func isConditional(ancestors []syntaxAncestor) bool {
+	if inCondition(ancestors) {
+		return true
+	}
+	return slices.ContainsFunc(ancestors, func(ancestor syntaxAncestor) bool {
+		switch ancestor.node.(type) {
+		case *pganalyze.CaseExpr, *pganalyze.BoolExpr, *pganalyze.CoalesceExpr, *pganalyze.NullIfExpr:
+			return true
+		}
+		return false
+	})
+}
+
+// isSubquery returns true if the node is part of a subquery or of the
+// SELECT of a set operation, e.g. a UNION.
+func isSubquery(ancestors []syntaxAncestor) bool {
+	return slices.ContainsFunc(ancestors, func(ancestor syntaxAncestor) bool {
+		switch node := ancestor.node.(type) {
+		case *pganalyze.SubLink, *pganalyze.RangeSubselect:
+			return true
+		case *pganalyze.SelectStmt:
+			return node.GetOp() != pganalyze.SetOperation_SETOP_NONE
+		}
+		return false
+	})
+}
+
+// isTautology returns true if the expression is the constant true, or a
+// comparison of constants that is always true.
+func isTautology(expr *pganalyze.Node) bool {
+	if value, ok := constantValue(expr); ok {
+		return value == "true"
+	}
+
+	comparison := expr.GetAExpr()
+	if comparison == nil || comparison.GetKind() != pganalyze.A_Expr_Kind_AEXPR_OP ||
+		len(comparison.GetName()) != 1 {
+		return false
+	}
+	left, ok := constantValue(comparison.GetLexpr())
+	if !ok {
+		return false
+	}
+	right, ok := constantValue(comparison.GetRexpr())
+	if !ok {
+		return false
+	}
+
+	// Numbers are compared by value, and everything else as strings, as
+	// PostgreSQL casts the untyped string of '1'=1 to the type of the number.
+	order := strings.Compare(left, right)
+	leftNumber, leftErr := strconv.ParseFloat(left, 64)
+	rightNumber, rightErr := strconv.ParseFloat(right, 64)
+	if leftErr == nil && rightErr == nil {
+		order = 0
+		if leftNumber < rightNumber {
+			order = -1
+		} else if leftNumber > rightNumber {
+			order = 1
+		}
+	}
+
+	switch comparison.GetName()[0].GetString_().GetSval() {
+	case "=":
+		return order == 0
+	case "<>", "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	case ">=":
+		return order >= 0
+	}
+	return false
+}
+
+// constantValue returns the value of a constant as a string, with or without
+// a cast, or false if the expression is not a constant or is NULL.
+func constantValue(expr *pganalyze.Node) (string, bool) {
+	if cast := expr.GetTypeCast(); cast != nil {
+		expr = cast.GetArg()
+	}
+	constant := expr.GetAConst()
+	if constant == nil || constant.GetIsnull() {
+		return "", false
+	}
+	switch {
+	case constant.GetIval() != nil:
+		return strconv.Itoa(int(constant.GetIval().GetIval())), true
+	case constant.GetFval() != nil:
+		return constant.GetFval().GetFval(), true
+	case constant.GetBoolval() != nil:
+		return strconv.FormatBool(constant.GetBoolval().GetBoolval()), true
+	case constant.GetSval() != nil:
+		return constant.GetSval().GetSval(), true
+	case constant.GetBsval() != nil:
+		return constant.GetBsval().GetBsval(), true
+	}
+	return "", false
+}
+
+// isNull returns true if the expression is NULL, with or without a cast.
+func isNull(expr *pganalyze.Node) bool {
+	if cast := expr.GetTypeCast(); cast != nil {
+		expr = cast.GetArg()
+	}
+	return expr.GetAConst().GetIsnull()
+}
+
+// isNullPadding returns true if the SELECT has several columns, all of which
+// are NULL except for at most one.
+func isNullPadding(stmt *pganalyze.SelectStmt) bool {
+	targets := stmt.GetTargetList()
+	if len(targets) < 2 {
+		return false
+	}
+	nulls := 0
+	for _, target := range targets {
+		if isNull(target.GetResTarget().GetVal()) {
+			nulls++
+		}
+	}
+	return nulls >= len(targets)-1
+}
+
+// isOrderByProbing returns true if the SELECT is ordered by a position that
+// is not one of its columns. The columns of a set operation are the columns
+// of its first SELECT.
+func isOrderByProbing(stmt *pganalyze.SelectStmt) bool {
+	columns := stmt
+	for columns.GetOp() != pganalyze.SetOperation_SETOP_NONE && columns.GetLarg() != nil {
+		columns = columns.GetLarg()
+	}
+	targets := columns.GetTargetList()
+	star := slices.ContainsFunc(targets, func(target *pganalyze.Node) bool {
+		return slices.ContainsFunc(target.GetResTarget().GetVal().GetColumnRef().GetFields(),
+			func(field *pganalyze.Node) bool { return field.GetAStar() != nil })
+	})
+
+	for _, sort := range stmt.GetSortClause() {
+		position := sort.GetSortBy().GetNode().GetAConst().GetIval()
+		if position == nil {
+			continue
+		}
+		switch value := int(position.GetIval()); {
+		case value < 1:
+			return true
+		case star && value > orderByProbeLimit:
+			return true
+		case !star && value > len(targets):
+			return true
+		}
+	}
+	return false
+}
+
+// isSleep returns true if the function is one of the pg_sleep functions.
+func isSleep(call *pganalyze.FuncCall) bool {
+	names := call.GetFuncname()
+	if len(names) == 0 {
+		return false
+	}
+	switch names[len(names)-1].GetString_().GetSval() {
+	case "pg_sleep", "pg_sleep_for", "pg_sleep_until":
+		return true
+	}
+	return false
+}
+
+// isCatalogRelation returns true if the relation is a relation of
+// pg_catalog or information_schema.
+func isCatalogRelation(relation *pganalyze.RangeVar) bool {
+	switch relation.GetSchemaname() {
+	case "pg_catalog", "information_schema":
+		return true
+	case "":
+		return strings.HasPrefix(relation.GetRelname(), "pg_")
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MatchSyntaxRules(t *testing.T) {
+	for query, expected := range map[string][]string{
+		// Tautologies.
+		"SELECT * FROM users WHERE name = '' OR 1=1":                     {RuleTautology},
+		"SELECT * FROM users WHERE name = '' OR 'a'='a' --":              {RuleTautology},
+		"SELECT * FROM users WHERE id = 1 OR '1'=1":                      {RuleTautology},
+		"SELECT * FROM users WHERE id = 1 OR 2 > 1.5 OR name = 'x'":      {RuleTautology},
+		"SELECT * FROM users WHERE id = 1 OR true":                       {RuleTautology},
+		"UPDATE users SET admin = true WHERE id = 2 OR 'x'<>'y'":         {RuleTautology},
+		"SELECT * FROM users u JOIN orders o ON o.user_id = u.id OR 1=1": {RuleTautology},
+		"SELECT * FROM users WHERE 1=1 AND name = $1":                    nil,
+		"SELECT * FROM users WHERE id = 1 OR id = 2":                     nil,
+		"SELECT * FROM users WHERE id = 1 OR 1=2":                        nil,
+		"SELECT 1=1 OR false":                                            nil,
+		// UNION SELECT with NULL padding.
+		"SELECT id, name, email FROM users WHERE id = 1 UNION SELECT NULL, NULL, version()": {
+			RuleUnionNullPadding,
+		},
+		"SELECT id, name FROM users UNION ALL SELECT NULL::int, NULL":               {RuleUnionNullPadding},
+		"SELECT id, name FROM users UNION SELECT id, NULL FROM admins":              {RuleUnionNullPadding},
+		"SELECT id, name, email FROM users UNION SELECT id, name, NULL FROM admins": nil,
+		// ORDER BY probing.
+		"SELECT id, name FROM users WHERE id = 1 ORDER BY 3":          {RuleOrderByProbing},
+		"SELECT * FROM users WHERE id = 1 ORDER BY 30":                {RuleOrderByProbing},
+		"SELECT id FROM users UNION SELECT id FROM admins ORDER BY 2": {RuleOrderByProbing},
+		"SELECT id, name FROM users ORDER BY 2, 1":                    nil,
+		"SELECT * FROM users ORDER BY 3":                              nil,
+		// Conditional time delays.
+		"SELECT CASE WHEN current_user = 'postgres' THEN pg_sleep(5) ELSE pg_sleep(0) END": {
+			RuleConditionalTimeDelay,
+		},
+		"SELECT * FROM users WHERE id = 1 AND (SELECT 1 FROM pg_sleep(5)) = 1": {RuleConditionalTimeDelay},
+		"SELECT * FROM users WHERE id = 1 AND pg_catalog.pg_sleep_for('5 seconds') IS NULL": {
+			RuleConditionalTimeDelay,
+		},
+		"SELECT pg_sleep(1)": nil,
+		// Subqueries against the catalog.
+		"SELECT * FROM users WHERE id = 1 AND 1 = (SELECT 1 FROM pg_shadow WHERE usename = 'postgres')": {
+			RuleCatalogSubquery,
+		},
+		"SELECT name FROM users UNION SELECT table_name FROM information_schema.tables": {
+			RuleCatalogSubquery,
+		},
+		"SELECT * FROM pg_catalog.pg_class c WHERE c.relnamespace = (SELECT oid FROM pg_namespace WHERE nspname = 'public')": nil,
+		"SELECT * FROM pg_stat_activity": nil,
+		// Several rules.
+		"SELECT id, name FROM users WHERE id = -1 OR 1=1 UNION SELECT NULL, usename FROM pg_user": {
+			RuleTautology, RuleUnionNullPadding, RuleCatalogSubquery,
+		},
+	} {
+		rules, err := MatchSyntaxRules(query)
+		require.NoError(t, err, query)
+		assert.Equal(t, expected, rules, query)
+	}
+
+	_, err := MatchSyntaxRules("1 OR 1=1")
+	require.Error(t, err)
+}
+
+func Test_SyntaxTreeDetector(t *testing.T) {
+	detector := &SyntaxTreeDetector{Logger: hclog.NewNullLogger()}
+
+	verdict, err := detector.Inspect(context.Background(), "SELECT * FROM users WHERE name = '' OR 'a'='a'")
+	require.NoError(t, err)
+	assert.True(t, verdict.Injection)
+	assert.InDelta(t, 1, verdict.Score, 0)
+	assert.Equal(t, map[string]any{
+		RuleField:  RuleTautology,
+		RulesField: []string{RuleTautology},
+	}, verdict.Evidence)
+
+	// Neither a clean query nor a query that can't be parsed is flagged.
+	for _, query := range []string{"SELECT * FROM users WHERE id = 1", "' OR 1=1 --"} {
+		verdict, err = detector.Inspect(context.Background(), query)
+		require.NoError(t, err)
+		assert.False(t, verdict.Injection, query)
+		assert.Nil(t, verdict.Evidence)
+	}
+
+	// The detector is not available for MySQL.
+	factory, ok := getDetectorFactory(SyntaxTree)
+	require.True(t, ok)
+	assert.NotNil(t, factory(&Plugin{Logger: hclog.NewNullLogger()}))
+	assert.Nil(t, factory(&Plugin{Logger: hclog.NewNullLogger(), Protocol: MySQLProtocol}))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gatewayd-io/gatewayd-plugin-sdk/logging"
+	"github.com/gatewayd-io/gatewayd-plugin-sql-ids-ips/plugin"
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/cast"
+)
+
+// runScan runs the detectors on query corpora outside of GatewayD, with the
+// same environment variables as the plugin, and prints the verdicts and a
+// summary. It returns the exit code.
+func runScan(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "",
+		"Format of the queries: lines, jsonl or csvlog (default: by file extension)")
+	output := flags.String("output", "text", "Format of the verdicts: text or json")
+	detectedOnly := flags.Bool("detected-only", false, "Only print the verdicts of detected queries")
+	configFile := flags.String("config-file", "",
+		"Config file that overrides the settings, like CONFIG_FILE")
+	logLevel := flags.String("log-level", "error", "Log level")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: gatewayd-plugin-sql-ids-ips scan [flags] [file ...]")
+		fmt.Fprintln(stderr, "Reads the queries from stdin if no file is given.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(stderr, "Invalid output: %s\n", *output)
+		return 2
+	}
+
+	scanner, err := newOfflinePlugin(newLogger(*logLevel, stderr), *configFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer scanner.Close()
+
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	summary := &plugin.ScanSummary{}
+	encoder := json.NewEncoder(stdout)
+	for _, file := range files {
+		fileFormat := *format
+		if fileFormat == "" {
+			fileFormat = plugin.ScanFormatOf(file)
+		}
+
+		err := readFile(file, stdin, func(reader io.Reader) error {
+			return plugin.ReadScanQueries(reader, fileFormat, func(query plugin.ScanQuery) error {
+				result := scanner.Scan(context.Background(), query)
+				result.File = file
+				summary.Add(result)
+				if *detectedOnly && !result.Detected {
+					return nil
+				}
+				if *output == "json" {
+					return encoder.Encode(result)
+				}
+				_, err := fmt.Fprintf(stdout, "%s:%d\t%s\t%s\t%q\n",
+					file, result.Line, result.Verdict(), result.Detector, result.Query)
+				return err
+			})
+		})
+		if err != nil {
+			fmt.Fprintf(stderr, "Failed to scan %s: %s\n", file, err)
+			return 1
+		}
+	}
+
+	// The summary doesn't mix with the verdicts if they are processed as JSON.
+	summaryOutput := stdout
+	if *output == "json" {
+		summaryOutput = stderr
+	} else {
+		fmt.Fprintln(stdout)
+	}
+	if err := summary.Write(summaryOutput); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// newOfflinePlugin returns the plugin as configured by the environment
+// variables and the config file, with the allowlist and policies loaded, but
+// without any of the components that run in the background or record the
+// queries, for the subcommands that run outside of GatewayD.
+func newOfflinePlugin(logger hclog.Logger, configFile string) (*plugin.Plugin, error) {
+	config, err := plugin.LoadConfig(cast.ToStringMap(plugin.PluginConfig["config"]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid plugin config: %w", err)
+	}
+
+	scanner := &plugin.Plugin{Logger: logger}
+	config.Apply(scanner)
+
+	// The allowlist is only used if enforced, so that it never learns offline.
+	if config.AllowlistMode == plugin.AllowlistEnforce {
+		allowlist, err := plugin.NewAllowlist(plugin.AllowlistEnforce, config.AllowlistFile, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load allowlist: %w", err)
+		}
+		scanner.Allowlist = allowlist
+	}
+
+	if config.PolicyFile != "" {
+		policies, err := plugin.LoadPolicies(config.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load policies: %w", err)
+		}
+		scanner.Policies = policies
+	}
+
+	if configFile == "" {
+		configFile = config.ConfigFile
+	}
+	if configFile != "" {
+		file, err := plugin.NewConfigFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config file: %w", err)
+		}
+		scanner.ConfigFile = file
+	}
+
+	return scanner, nil
+}
+
+func newLogger(logLevel string, output io.Writer) hclog.Logger {
+	return hclog.New(&hclog.LoggerOptions{
+		Level:      logging.GetLogLevel(logLevel),
+		Output:     output,
+		JSONFormat: true,
+		Color:      hclog.ColorOff,
+	})
+}
+
+// readFile calls fn with the content of the file, or stdin if the file is "-".
+func readFile(file string, stdin io.Reader, fn func(io.Reader) error) error {
+	if file == "-" {
+		return fn(stdin)
+	}
+
+	reader, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return fn(reader)
+}